@@ -11,10 +11,11 @@ import (
 )
 
 type IMeta struct {
-	Total   int64  `json:"total,omitempty"`   // トータル件数
-	Page    int    `json:"page,omitempty"`    // ページ数
-	Current int    `json:"current,omitempty"` // 現在のページ
-	Elapsed string `json:"elapsed,omitempty"` // 所要時間
+	Total   int64               `json:"total,omitempty"`   // トータル件数
+	Page    int                 `json:"page,omitempty"`    // ページ数
+	Current int                 `json:"current,omitempty"` // 現在のページ
+	Elapsed string              `json:"elapsed,omitempty"` // 所要時間
+	Timings map[string]*ITiming `json:"timings,omitempty"` // 依存先毎の所要時間 DevModeのみ
 }
 
 type IError struct {
@@ -42,22 +43,49 @@ func (p *IFiberEx) MetaMiddleware() func(*fiber.Ctx) error {
 		c.Locals("page_max", 0)
 		c.Locals("page_current", 0)
 		c.Locals("userid", "-")
-		return c.Next()
+		timings := newRequestTimings()
+		c.Locals("timings", timings)
+		c.SetUserContext(contextWithTimings(c.UserContext(), timings))
+		c.SetUserContext(contextWithDBState(c.UserContext(), &requestDBState{}))
+		var queries *queryRecorder
+		if p.Config.queryCheck() {
+			queries = newQueryRecorder()
+			c.Locals("queries", queries)
+			c.SetUserContext(contextWithQueryRecorder(c.UserContext(), queries))
+		}
+		err := c.Next()
+		c.Set("Server-Timing", timings.header(time.Since(c.Locals("start_time").(time.Time))))
+		if queries != nil {
+			p.reportQueries(p.Context(c), queries)
+		}
+		return err
 	}
 }
 
 func (p *IFiberEx) NewMeta(c *fiber.Ctx) *IMeta {
 	stop := time.Now().Local()
-	return &IMeta{
+	rs := &IMeta{
 		Total:   c.Locals("total_count").(int64),
 		Page:    c.Locals("page_max").(int),
 		Current: c.Locals("page_current").(int),
 		Elapsed: stop.Sub(c.Locals("start_time").(time.Time)).String(),
 	}
+	if timings, ok := c.Locals("timings").(*requestTimings); ok && p.Config.DevMode != nil && *p.Config.DevMode {
+		rs.Timings = timings.meta()
+	}
+	return rs
+}
+
+// IMetaのページング情報を設定する
+func (p *IFiberEx) Paging(c *fiber.Ctx, total int64, page int, current int) {
+	c.Locals("total_count", total)
+	c.Locals("page_max", page)
+	c.Locals("page_current", current)
 }
 
 func (p *IFiberEx) result(c *fiber.Ctx, code int, body *IResponse) error {
 	body.Meta = p.NewMeta(c)
+	body = p.maskResponse(c, body)
 	rs, err := json.Marshal(body)
 	if err != nil {
 		return c.SendStatus(500)
@@ -68,6 +96,9 @@ func (p *IFiberEx) result(c *fiber.Ctx, code int, body *IResponse) error {
 
 func (p *IFiberEx) ResultError(c *fiber.Ctx, code int, err error, errors ...IError) error {
 	p.Log.Error(fmt.Sprintf("api error: %s", err))
+	if code >= 500 {
+		p.reportError(c, err, ErrorSourceHttp, stackFrames(1))
+	}
 	return p.result(c, code, &IResponse{
 		Errors: errors,
 	})
@@ -84,19 +115,27 @@ func (p *IFiberEx) Result(c *fiber.Ctx, code int, results ...interface{}) error
 }
 
 func (p *IFiberEx) RequestParser(c *fiber.Ctx, params interface{}) bool {
+	parser := c.BodyParser
 	if c.Method() != "GET" {
-		if err := c.QueryParser(params); err != nil {
-			if err := p.ResultError(c, 400, err); err == nil {
-				return false
-			}
+		parser = c.QueryParser
+	}
+	return p.parseRequest(c, params, parser) && p.validateRequest(c, params)
+}
+
+// parserでパラメータを変換する エラーの場合はレスポンスを返してfalseを返す
+func (p *IFiberEx) parseRequest(c *fiber.Ctx, params interface{}, parser func(interface{}) error) bool {
+	if err := parser(params); err != nil {
+		if err := p.ResultError(c, 400, err); err == nil {
+			return false
 		}
 	} else {
-		if err := c.BodyParser(params); err != nil {
-			if err := p.ResultError(c, 400, err); err == nil {
-				return false
-			}
-		}
+		p.maskRequest(c, params)
 	}
+	return true
+}
+
+// パラメータを検証する エラーの場合はレスポンスを返してfalseを返す
+func (p *IFiberEx) validateRequest(c *fiber.Ctx, params interface{}) bool {
 	if err := p.Validation(params); len(err) > 0 {
 		if err := p.ResultError(c, 400, fmt.Errorf("validation error: %+v", err), err...); err == nil {
 			return false
@@ -0,0 +1,321 @@
+package gofiber_extend
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/exp/slices"
+	"gorm.io/gorm"
+)
+
+const (
+	ApiKeyHeader          = "X-Api-Key"
+	ApiKeyTimestampHeader = "X-Api-Timestamp"
+	ApiKeyNonceHeader     = "X-Api-Nonce"
+	ApiKeySignatureHeader = "X-Api-Signature"
+)
+
+type IApiKeyConfig struct {
+	Tolerance   time.Duration // 署名タイムスタンプの許容誤差
+	NoncePrefix string        // nonce保存時のredisキー
+	LastUsedKey string        // 最終利用日時を保持するredisのハッシュキー
+}
+
+var defaultApiKeyConfig *IApiKeyConfig = &IApiKeyConfig{
+	Tolerance:   5 * time.Minute,
+	NoncePrefix: "apikey:nonce:",
+	LastUsedKey: "apikey:last_used",
+}
+
+// APIキー
+// 平文のシークレットは保存しない 署名鍵はシークレットからHKDFで導出して保存する
+type IApiKey struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	KeyId      string     `gorm:"size:32;uniqueIndex" json:"key_id"` // 公開するキーID
+	Hash       string     `gorm:"size:64" json:"-"`                  // シークレットのハッシュ
+	SigningKey string     `gorm:"size:64" json:"-"`                  // 署名鍵(hex)
+	Name       string     `gorm:"size:255" json:"name"`              // 用途
+	UserId     string     `gorm:"size:255;index" json:"user_id"`     // 所有者
+	Scopes     string     `gorm:"size:1024" json:"scopes"`           // カンマ区切りのスコープ
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`              // 有効期限
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`            // 最終利用日時
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`              // 失効日時
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+func (IApiKey) TableName() string {
+	return "api_keys"
+}
+
+func (p *IApiKey) ScopeList() []string {
+	if p.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(p.Scopes, ",")
+}
+
+// 指定されたスコープをすべて保持しているか
+func (p *IApiKey) HasScopes(scopes ...string) bool {
+	list := p.ScopeList()
+	for _, scope := range scopes {
+		if !slices.Contains(list, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *IApiKey) Active(now time.Time) bool {
+	if p.RevokedAt != nil {
+		return false
+	}
+	if p.ExpiresAt != nil && !now.Before(*p.ExpiresAt) {
+		return false
+	}
+	return true
+}
+
+func (p *IFiberEx) MigrateApiKey() error {
+	return p.DB.AutoMigrate(&IApiKey{})
+}
+
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func apiKeyHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// 署名鍵の導出に使用するラベル ハッシュとは別の値にし、DBのハッシュから署名できないようにする
+const apiSigningKeyInfo = "gofiber_extend apikey signing v1"
+
+// シークレットから署名鍵を導出する
+func apiSigningKey(secret string) (string, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(apiSigningKeyInfo)), key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// APIキーを発行する
+// シークレットは発行時にのみ返却される
+func (p *IFiberEx) CreateApiKey(name string, userid string, scopes []string, expiresAt *time.Time) (*IApiKey, string, error) {
+	keyId, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	signingKey, err := apiSigningKey(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	key := &IApiKey{
+		KeyId:      keyId,
+		Hash:       apiKeyHash(secret),
+		SigningKey: signingKey,
+		Name:       name,
+		UserId:     userid,
+		Scopes:     strings.Join(scopes, ","),
+		ExpiresAt:  expiresAt,
+	}
+	if err := p.DB.Create(key).Error; err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+func (p *IFiberEx) FindApiKey(keyId string) (*IApiKey, error) {
+	key := &IApiKey{}
+	if err := p.DB.Where("key_id = ?", keyId).First(key).Error; err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (p *IFiberEx) RevokeApiKey(keyId string) error {
+	return p.DB.Model(&IApiKey{}).Where("key_id = ?", keyId).Update("revoked_at", time.Now().Local()).Error
+}
+
+// 最終利用日時をredisに記録する
+func (p *IFiberEx) touchApiKey(keyId string, now time.Time) {
+	if err := p.Redis.HSet(background, p.Config.ApiKeyConfig.LastUsedKey, keyId, now.Unix()).Err(); err != nil {
+		p.Log.Error(err.Error())
+	}
+}
+
+// redisに記録された最終利用日時をDBへ書き戻す
+// IJobのProcなどから定期的に呼び出す
+func (p *IFiberEx) FlushApiKeyLastUsed() error {
+	key := p.Config.ApiKeyConfig.LastUsedKey
+	values, err := p.Redis.HGetAll(background, key).Result()
+	if err != nil {
+		return err
+	}
+	for keyId, value := range values {
+		unix, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		if err := p.DB.Model(&IApiKey{}).Where("key_id = ?", keyId).Update("last_used_at", time.Unix(unix, 0).Local()).Error; err != nil {
+			return err
+		}
+		if err := p.Redis.HDel(background, key, keyId).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 署名対象の文字列を生成する
+func ApiSignaturePayload(method string, uri string, timestamp string, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return strings.Join([]string{
+		strings.ToUpper(method),
+		uri,
+		timestamp,
+		nonce,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+}
+
+func apiSignature(signingKey string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 署名付きリクエストを検証するミドルウェア
+// scopesが指定された場合はすべてのスコープを保持している必要がある
+func (p *IFiberEx) ApiKeyMiddleware(scopes ...string) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		conf := p.Config.ApiKeyConfig
+		keyId := c.Get(ApiKeyHeader)
+		timestamp := c.Get(ApiKeyTimestampHeader)
+		nonce := c.Get(ApiKeyNonceHeader)
+		signature := c.Get(ApiKeySignatureHeader)
+		if keyId == "" || timestamp == "" || nonce == "" || signature == "" {
+			return p.ResultError(c, 401, fmt.Errorf("api key: missing headers"), E40101.Errors()...)
+		}
+
+		// タイムスタンプの検証
+		now := time.Now().Local()
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return p.ResultError(c, 401, fmt.Errorf("api key: invalid timestamp: %s", timestamp), E40101.Errors()...)
+		}
+		diff := now.Sub(time.Unix(unix, 0))
+		if diff > conf.Tolerance || diff < -conf.Tolerance {
+			return p.ResultError(c, 401, fmt.Errorf("api key: timestamp out of range: %s", timestamp), E40101.Errors()...)
+		}
+
+		// キーの検証
+		key, err := p.FindApiKey(keyId)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return p.ResultError(c, 401, fmt.Errorf("api key: %s: %s", keyId, err), E40101.Errors()...)
+		} else if err != nil {
+			return p.ResultError(c, 500, err, E99999.Errors()...)
+		}
+		if !key.Active(now) {
+			return p.ResultError(c, 401, fmt.Errorf("api key: inactive: %s", keyId), E40101.Errors()...)
+		}
+		// 署名鍵を保存する前に発行したキーは再発行が必要
+		if key.SigningKey == "" {
+			return p.ResultError(c, 401, fmt.Errorf("api key: no signing key: %s", keyId), E40101.Errors()...)
+		}
+
+		// 署名の検証
+		payload := ApiSignaturePayload(c.Method(), c.OriginalURL(), timestamp, nonce, c.Body())
+		if !hmac.Equal([]byte(apiSignature(key.SigningKey, payload)), []byte(signature)) {
+			return p.ResultError(c, 401, fmt.Errorf("api key: signature mismatch: %s", keyId), E40101.Errors()...)
+		}
+
+		// リプレイ攻撃対策: 許容誤差の間はnonceを保持する
+		ok, err := p.Redis.SetNX(background, conf.NoncePrefix+keyId+":"+nonce, timestamp, conf.Tolerance*2).Result()
+		if err != nil {
+			return p.ResultError(c, 500, err, E99999.Errors()...)
+		}
+		if !ok {
+			return p.ResultError(c, 401, fmt.Errorf("api key: nonce reused: %s", keyId), E40101.Errors()...)
+		}
+
+		if !key.HasScopes(scopes...) {
+			return p.ResultError(c, 403, fmt.Errorf("api key: scope required: %+v", scopes), E40301.Errors()...)
+		}
+
+		p.touchApiKey(keyId, now)
+		c.Locals("apikey", key)
+		c.Locals("userid", key.UserId)
+		return c.Next()
+	}
+}
+
+// 外部APIへのリクエストに署名する
+type IApiSigner struct {
+	KeyId  string
+	Secret string
+}
+
+// 署名ヘッダを生成する
+func (p *IApiSigner) Headers(method string, uri string, body []byte) (map[string]string, error) {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	signingKey, err := apiSigningKey(p.Secret)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	payload := ApiSignaturePayload(method, uri, timestamp, nonce, body)
+	return map[string]string{
+		ApiKeyHeader:          p.KeyId,
+		ApiKeyTimestampHeader: timestamp,
+		ApiKeyNonceHeader:     nonce,
+		ApiKeySignatureHeader: apiSignature(signingKey, payload),
+	}, nil
+}
+
+// net/httpのリクエストに署名ヘッダを付与する
+func (p *IApiSigner) Sign(req *http.Request) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	headers, err := p.Headers(req.Method, req.URL.RequestURI(), body)
+	if err != nil {
+		return err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return nil
+}
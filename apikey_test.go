@@ -0,0 +1,110 @@
+package gofiber_extend_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestApiKey(t *testing.T) {
+	test := newSQLiteTest(t, ext.IFiberExConfig{
+		DevMode:      ext.Bool(true),
+		UseRedis:     true,
+		RedisOptions: &redis.Options{},
+	})
+	if err := test.Ex.MigrateApiKey(); err != nil {
+		t.Fatal(err)
+	}
+	test.Routes(func(app *fiber.App) {
+		app.Post("/signed", test.Ex.ApiKeyMiddleware("orders:write"), func(c *fiber.Ctx) error {
+			return test.Ex.Result(c, 200, map[string]interface{}{"userid": c.Locals("userid")})
+		})
+	})
+	test.Run("signed_request", func() {
+		key, secret, err := test.Ex.CreateApiKey("partner", "user1", []string{"orders:read", "orders:write"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer := &ext.IApiSigner{KeyId: key.KeyId, Secret: secret}
+		body := map[string]interface{}{"id": 1}
+		test.Api("valid", &ext.ITestRequest{Method: "POST", Path: "/signed", Body: body, Signer: signer}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.result.userid`,
+			Want:   "user1",
+		})
+		test.Api("wrong_secret", &ext.ITestRequest{Method: "POST", Path: "/signed", Body: body, Signer: &ext.IApiSigner{KeyId: key.KeyId, Secret: "x"}}, 401, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.error[0].code`,
+			Want:   "E40101",
+		})
+		test.Api("no_headers", &ext.ITestRequest{Method: "POST", Path: "/signed", Body: body}, 401)
+		// 同じnonceのリクエストは拒否する
+		replay, err := signer.Headers("POST", "/signed", []byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.Api("nonce", &ext.ITestRequest{Method: "POST", Path: "/signed", Headers: replay}, 200)
+		test.Api("nonce_replay", &ext.ITestRequest{Method: "POST", Path: "/signed", Headers: replay}, 401, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.error[0].code`,
+			Want:   "E40101",
+		})
+		// DBに保存されたハッシュでは署名できない
+		stored, err := test.Ex.FindApiKey(key.KeyId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(stored.Hash))
+		mac.Write([]byte(ext.ApiSignaturePayload("POST", "/signed", timestamp, "forged", []byte{})))
+		test.Api("forged", &ext.ITestRequest{Method: "POST", Path: "/signed", Headers: map[string]string{
+			ext.ApiKeyHeader:          key.KeyId,
+			ext.ApiKeyTimestampHeader: timestamp,
+			ext.ApiKeyNonceHeader:     "forged",
+			ext.ApiKeySignatureHeader: hex.EncodeToString(mac.Sum(nil)),
+		}}, 401)
+		// 署名鍵はシークレットから導出したもの
+		if stored.SigningKey == "" || stored.SigningKey == secret || stored.SigningKey == stored.Hash {
+			t.Errorf("signing key: %s", stored.SigningKey)
+		}
+		test.Api("last_used", &ext.ITestRequest{Method: "POST", Path: "/signed", Body: body, Signer: signer}, 200, &ext.ITestCase{
+			Method: ext.TestMethodNotEqual,
+			Want:   "",
+			Store: func() interface{} {
+				return test.Redis.HGet("apikey:last_used", key.KeyId)
+			},
+		})
+		reader, secret, err := test.Ex.CreateApiKey("reader", "user2", []string{"orders:read"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.Api("forbidden", &ext.ITestRequest{Method: "POST", Path: "/signed", Signer: &ext.IApiSigner{KeyId: reader.KeyId, Secret: secret}}, 403, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.error[0].code`,
+			Want:   "E40301",
+		})
+	})
+	test.Run("db_error", func() {
+		key, secret, err := test.Ex.CreateApiKey("partner", "user3", []string{"orders:write"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// キーが無い場合以外のDBのエラーは401にしない
+		if err := test.Ex.DB.Exec("ALTER TABLE api_keys RENAME TO api_keys_old").Error; err != nil {
+			t.Fatal(err)
+		}
+		defer test.Ex.DB.Exec("ALTER TABLE api_keys_old RENAME TO api_keys")
+		test.Api("unavailable", &ext.ITestRequest{Method: "POST", Path: "/signed", Signer: &ext.IApiSigner{KeyId: key.KeyId, Secret: secret}}, 500, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.error[0].code`,
+			Want:   "E99999",
+		})
+	})
+}
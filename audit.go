@@ -0,0 +1,478 @@
+package gofiber_extend
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// 監査ログの保存先
+const (
+	AuditSinkDB = "db"
+	AuditSinkES = "es"
+)
+
+// 監査ログの操作
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// 監査ログの設定 指定した場合のみ有効
+type IAuditConfig struct {
+	Models  []interface{} // 監査するモデル
+	Sink    string        // db/es
+	Index   string        // esのインデックス名 未指定の場合はaudit-<AppName>
+	Exclude []string      // 記録しないカラム名
+	Redact  []string      // 値をマスクするカラム名
+	Mask    string        // マスク後の文字列
+}
+
+var defaultAuditConfig *IAuditConfig = &IAuditConfig{
+	Sink:   AuditSinkDB,
+	Redact: []string{"password", "secret", "token", "access_token", "refresh_token"},
+	Mask:   "***",
+}
+
+// 変更前後の値
+type IAuditDiff struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// カラム名と変更前後の値
+type IAuditChanges map[string]*IAuditDiff
+
+func (p IAuditChanges) Value() (driver.Value, error) {
+	rs, err := json.Marshal(p)
+	return string(rs), err
+}
+
+func (p *IAuditChanges) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*p = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, p)
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	}
+	return fmt.Errorf("audit: cannot scan %T", src)
+}
+
+type IAuditLog struct {
+	ID        uint64        `gorm:"primaryKey" json:"id,omitempty"`
+	Table     string        `gorm:"column:entity_table;size:191;index:idx_audit_entity" json:"table"`
+	EntityId  string        `gorm:"size:191;index:idx_audit_entity" json:"entity_id"`
+	Action    string        `gorm:"size:16" json:"action"` // create/update/delete
+	Changes   IAuditChanges `gorm:"type:text" json:"changes"`
+	UserId    string        `gorm:"size:191;index" json:"user_id"`
+	RequestId string        `gorm:"size:64" json:"request_id"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+func (IAuditLog) TableName() string {
+	return "audit_logs"
+}
+
+func (p *IFiberEx) MigrateAudit() error {
+	return UsePrimary(p.DB).AutoMigrate(&IAuditLog{})
+}
+
+// 対象モデルの作成・更新・削除を記録するgormのプラグイン
+type auditPlugin struct {
+	config  *IAuditConfig
+	tables  map[string]bool
+	exclude map[string]bool
+	redact  map[string]bool
+}
+
+func newAuditPlugin(config *IAuditConfig) *auditPlugin {
+	rs := &auditPlugin{
+		config:  config,
+		tables:  map[string]bool{},
+		exclude: map[string]bool{},
+		redact:  map[string]bool{},
+	}
+	for _, column := range config.Exclude {
+		rs.exclude[strings.ToLower(column)] = true
+	}
+	for _, column := range config.Redact {
+		rs.redact[strings.ToLower(column)] = true
+	}
+	return rs
+}
+
+func (p *auditPlugin) Name() string {
+	return "audit"
+}
+
+func (p *auditPlugin) Initialize(db *gorm.DB) error {
+	for _, model := range p.config.Models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		p.tables[stmt.Schema.Table] = true
+	}
+	callback := db.Callback()
+	if err := callback.Create().After("gorm:create").Register("audit:create", p.afterCreate); err != nil {
+		return err
+	}
+	if err := callback.Update().Before("gorm:update").Register("audit:before_update", p.snapshot); err != nil {
+		return err
+	}
+	if err := callback.Update().After("gorm:update").Register("audit:update", p.afterUpdate); err != nil {
+		return err
+	}
+	if err := callback.Delete().Before("gorm:delete").Register("audit:before_delete", p.snapshot); err != nil {
+		return err
+	}
+	return callback.Delete().After("gorm:delete").Register("audit:delete", p.afterDelete)
+}
+
+// 単一の主キーを持つ対象モデルのみ記録する
+func (p *auditPlugin) target(db *gorm.DB) bool {
+	stmt := db.Statement
+	return !db.DryRun && stmt.Schema != nil && p.tables[stmt.Schema.Table] && stmt.Schema.PrioritizedPrimaryField != nil
+}
+
+// 比較・保存できる値にする
+func auditValue(value interface{}) interface{} {
+	if valuer, ok := value.(driver.Valuer); ok {
+		if v, err := valuer.Value(); err == nil {
+			value = v
+		}
+	}
+	if v, ok := value.([]byte); ok {
+		return string(v)
+	}
+	return value
+}
+
+// 暗号化したカラムは常にマスクする
+func (p *auditPlugin) value(field *schema.Field, value interface{}) interface{} {
+	if value != nil && (p.redact[strings.ToLower(field.DBName)] || encryptedField(field)) {
+		return p.config.Mask
+	}
+	return value
+}
+
+func (p *auditPlugin) afterCreate(db *gorm.DB) {
+	if db.Error != nil || !p.target(db) {
+		return
+	}
+	stmt := db.Statement
+	logs := []*IAuditLog{}
+	eachReflectValue(stmt.ReflectValue, func(rv reflect.Value) {
+		changes := IAuditChanges{}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName == "" || p.exclude[strings.ToLower(field.DBName)] {
+				continue
+			}
+			value, zero := field.ValueOf(stmt.Context, rv)
+			if zero {
+				continue
+			}
+			changes[field.DBName] = &IAuditDiff{After: p.value(field, auditValue(value))}
+		}
+		id, _ := stmt.Schema.PrioritizedPrimaryField.ValueOf(stmt.Context, rv)
+		logs = append(logs, p.newLog(db, AuditCreate, fmt.Sprint(auditValue(id)), changes))
+	})
+	p.write(db, logs)
+}
+
+func eachReflectValue(rv reflect.Value, fn func(reflect.Value)) {
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			fn(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		fn(rv)
+	}
+}
+
+// 更新・削除の対象となる行
+func (p *auditPlugin) rows(db *gorm.DB, where []clause.Expression, unscoped bool) ([]map[string]interface{}, error) {
+	stmt := db.Statement
+	q := UsePrimary(db.Session(&gorm.Session{NewDB: true, SkipHooks: true})).Model(reflect.New(stmt.Schema.ModelType).Interface())
+	if unscoped {
+		q = q.Unscoped()
+	}
+	rs := []map[string]interface{}{}
+	if err := q.Clauses(clause.Where{Exprs: where}).Find(&rs).Error; err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// 変更前の値を取得する
+func (p *auditPlugin) snapshot(db *gorm.DB) {
+	if db.Error != nil || !p.target(db) {
+		return
+	}
+	stmt := db.Statement
+	where := []clause.Expression{}
+	if c, ok := stmt.Clauses["WHERE"]; ok {
+		if w, ok := c.Expression.(clause.Where); ok {
+			where = append(where, w.Exprs...)
+		}
+	}
+	pk := stmt.Schema.PrioritizedPrimaryField
+	ids := []interface{}{}
+	eachReflectValue(stmt.ReflectValue, func(rv reflect.Value) {
+		if id, zero := pk.ValueOf(stmt.Context, rv); !zero {
+			ids = append(ids, id)
+		}
+	})
+	if len(ids) > 0 {
+		where = append(where, clause.IN{Column: clause.Column{Table: stmt.Schema.Table, Name: pk.DBName}, Values: ids})
+	}
+	if len(where) == 0 && !db.AllowGlobalUpdate {
+		return
+	}
+	rows, err := p.rows(db, where, stmt.Unscoped)
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+	stmt.Settings.Store("audit:before", rows)
+}
+
+func (p *auditPlugin) before(db *gorm.DB) []map[string]interface{} {
+	if rows, ok := db.Statement.Settings.Load("audit:before"); ok {
+		db.Statement.Settings.Delete("audit:before")
+		return rows.([]map[string]interface{})
+	}
+	return nil
+}
+
+func (p *auditPlugin) afterUpdate(db *gorm.DB) {
+	before := p.before(db)
+	if db.Error != nil || db.RowsAffected == 0 || len(before) == 0 {
+		return
+	}
+	stmt := db.Statement
+	pk := stmt.Schema.PrioritizedPrimaryField
+	ids := []interface{}{}
+	for _, row := range before {
+		ids = append(ids, row[pk.DBName])
+	}
+	after, err := p.rows(db, []clause.Expression{
+		clause.IN{Column: clause.Column{Table: stmt.Schema.Table, Name: pk.DBName}, Values: ids},
+	}, true)
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+	current := map[string]map[string]interface{}{}
+	for _, row := range after {
+		current[fmt.Sprint(auditValue(row[pk.DBName]))] = row
+	}
+	logs := []*IAuditLog{}
+	for _, row := range before {
+		id := fmt.Sprint(auditValue(row[pk.DBName]))
+		changes := IAuditChanges{}
+		for _, field := range stmt.Schema.Fields {
+			column := field.DBName
+			if column == "" || field.AutoUpdateTime > 0 || p.exclude[strings.ToLower(column)] {
+				continue
+			}
+			b, a := auditValue(row[column]), auditValue(current[id][column])
+			if encryptedField(field) {
+				b, a = auditDecrypt(stmt.Schema.Table, column, b), auditDecrypt(stmt.Schema.Table, column, a)
+			}
+			if !reflect.DeepEqual(b, a) {
+				changes[column] = &IAuditDiff{Before: p.value(field, b), After: p.value(field, a)}
+			}
+		}
+		if len(changes) > 0 {
+			logs = append(logs, p.newLog(db, AuditUpdate, id, changes))
+		}
+	}
+	p.write(db, logs)
+}
+
+// 暗号文は毎回異なるため復号して比較する
+func auditDecrypt(table string, column string, value interface{}) interface{} {
+	if text, ok := value.(string); ok && Crypto != nil {
+		if plain, err := Crypto.Decrypt(table, column, text); err == nil {
+			return plain
+		}
+	}
+	return value
+}
+
+func (p *auditPlugin) afterDelete(db *gorm.DB) {
+	before := p.before(db)
+	if db.Error != nil || db.RowsAffected == 0 || len(before) == 0 {
+		return
+	}
+	stmt := db.Statement
+	pk := stmt.Schema.PrioritizedPrimaryField
+	logs := []*IAuditLog{}
+	for _, row := range before {
+		changes := IAuditChanges{}
+		for _, field := range stmt.Schema.Fields {
+			value, ok := row[field.DBName]
+			if ok && !p.exclude[strings.ToLower(field.DBName)] {
+				changes[field.DBName] = &IAuditDiff{Before: p.value(field, auditValue(value))}
+			}
+		}
+		logs = append(logs, p.newLog(db, AuditDelete, fmt.Sprint(auditValue(row[pk.DBName])), changes))
+	}
+	p.write(db, logs)
+}
+
+func (p *auditPlugin) newLog(db *gorm.DB, action string, id string, changes IAuditChanges) *IAuditLog {
+	ctx := db.Statement.Context
+	return &IAuditLog{
+		Table:     db.Statement.Schema.Table,
+		EntityId:  id,
+		Action:    action,
+		Changes:   changes,
+		UserId:    UserIdFromContext(ctx),
+		RequestId: RequestIdFromContext(ctx),
+		CreatedAt: time.Now(),
+	}
+}
+
+// dbの場合は同じトランザクションで保存し、失敗した場合は操作もエラーにする
+// esの場合はTxMiddlewareのトランザクション内であればコミット後に送信する
+func (p *auditPlugin) write(db *gorm.DB, logs []*IAuditLog) {
+	if len(logs) == 0 {
+		return
+	}
+	if p.config.Sink != AuditSinkES {
+		if err := db.Session(&gorm.Session{NewDB: true, SkipHooks: true}).Create(&logs).Error; err != nil {
+			_ = db.AddError(err)
+		}
+		return
+	}
+	send := func() error {
+		return p.index(logs)
+	}
+	if !afterCommitContext(db.Statement.Context, send) {
+		if err := send(); err != nil {
+			ComponentLog(LogComponentDB).Warn("audit.index", zap.Error(err))
+		}
+	}
+}
+
+func (p *auditPlugin) index(logs []*IAuditLog) error {
+	if ES == nil {
+		return fmt.Errorf("audit: elasticsearch is not configured")
+	}
+	for _, log := range logs {
+		body, err := json.Marshal(log)
+		if err != nil {
+			return err
+		}
+		res, err := ES.Index(p.config.Index, bytes.NewReader(body), ES.Index.WithContext(background))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.IsError() {
+			return fmt.Errorf("audit: index: %s", res.Status())
+		}
+	}
+	return nil
+}
+
+// エンティティの変更履歴を新しい順に返す
+func (p *IFiberEx) AuditHistory(ctx context.Context, model interface{}, id interface{}) ([]*IAuditLog, error) {
+	conf := p.Config.AuditConfig
+	if conf == nil {
+		return nil, fmt.Errorf("audit: not configured")
+	}
+	stmt := &gorm.Statement{DB: p.DB}
+	if err := stmt.Parse(model); err != nil {
+		return nil, err
+	}
+	if conf.Sink == AuditSinkES {
+		return p.auditHistoryES(ctx, conf, stmt.Schema, fmt.Sprint(id))
+	}
+	rs := []*IAuditLog{}
+	if err := p.DB.WithContext(ctx).
+		Where(&IAuditLog{Table: stmt.Schema.Table, EntityId: fmt.Sprint(id)}).
+		Order("created_at DESC").Order("id DESC").
+		Find(&rs).Error; err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (p *IFiberEx) auditHistoryES(ctx context.Context, conf *IAuditConfig, s *schema.Schema, id string) ([]*IAuditLog, error) {
+	if p.ES == nil {
+		return nil, fmt.Errorf("audit: elasticsearch is not configured")
+	}
+	// 動的マッピングの場合の文字列はkeywordで完全一致させる
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{"term": map[string]interface{}{"table.keyword": s.Table}},
+					map[string]interface{}{"term": map[string]interface{}{"entity_id.keyword": id}},
+				},
+			},
+		},
+		"sort": []interface{}{map[string]interface{}{"created_at": "desc"}},
+		"size": 1000,
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.ES.Search(
+		p.ES.Search.WithContext(ctx),
+		p.ES.Search.WithIndex(conf.Index),
+		p.ES.Search.WithBody(bytes.NewReader(query)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("audit: search: %s", res.Status())
+	}
+	body := struct {
+		Hits struct {
+			Hits []struct {
+				Source *IAuditLog `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	rs := []*IAuditLog{}
+	for _, hit := range body.Hits.Hits {
+		rs = append(rs, hit.Source)
+	}
+	return rs, nil
+}
+
+// :idのエンティティの変更履歴を返す
+func (p *IFiberEx) AuditHistoryHandler(model interface{}) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		rs, err := p.AuditHistory(p.Context(c), model, c.Params("id"))
+		if err != nil {
+			return p.ResultError(c, 500, err)
+		}
+		return p.Result(c, 200, rs)
+	}
+}
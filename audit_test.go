@@ -0,0 +1,139 @@
+package gofiber_extend_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"gorm.io/gorm"
+)
+
+type auditItem struct {
+	ID        uint
+	Name      string
+	Password  string
+	Memo      string
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt
+}
+
+type auditOther struct {
+	ID   uint
+	Name string
+}
+
+func TestAudit(t *testing.T) {
+	test := newSQLiteTest(t, ext.IFiberExConfig{
+		AuditConfig: &ext.IAuditConfig{
+			Models:  []interface{}{&auditItem{}},
+			Exclude: []string{"memo"},
+		},
+	})
+	if err := test.Ex.MigrateAudit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ext.DB.AutoMigrate(&auditItem{}, &auditOther{}); err != nil {
+		t.Fatal(err)
+	}
+	repo := ext.NewRepository[auditItem](ext.DB)
+	test.Routes(func(app *fiber.App) {
+		app.Use(func(c *fiber.Ctx) error {
+			c.Locals("userid", c.Get("X-User"))
+			return c.Next()
+		})
+		app.Get("/items/:id/audit", test.Ex.AuditHistoryHandler(&auditItem{}))
+		app.Patch("/items/:id/:name", test.Ex.TxMiddleware(), func(c *fiber.Ctx) error {
+			item, err := repo.WithTx(test.Ex.Tx(c)).Find(test.Ex.Context(c), c.Params("id"))
+			if err != nil {
+				return test.Ex.ResultError(c, 404, err)
+			}
+			item.Name, item.Memo = utils.CopyString(c.Params("name")), "memo"
+			if err := repo.WithTx(test.Ex.Tx(c)).Update(test.Ex.Context(c), item, "name", "memo"); err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			if item.Name == "rollback" {
+				return test.Ex.ResultError(c, 400, fmt.Errorf("rollback"))
+			}
+			return test.Ex.Result(c, 200, item)
+		})
+		app.Delete("/items/:id", test.Ex.TxMiddleware(), func(c *fiber.Ctx) error {
+			if err := test.Ex.Tx(c).Delete(&auditItem{}, c.Params("id")).Error; err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			return test.Ex.Result(c, 200, nil)
+		})
+	})
+	user := map[string]string{"X-User": "u1"}
+	history := func() []*ext.IAuditLog {
+		logs, err := test.Ex.AuditHistory(context.Background(), &auditItem{}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return logs
+	}
+	latest := func(fn func(*ext.IAuditLog) interface{}) func() interface{} {
+		return func() interface{} {
+			logs := history()
+			if len(logs) == 0 {
+				return nil
+			}
+			return fn(logs[0])
+		}
+	}
+	count := func() interface{} {
+		var count int64
+		ext.DB.Model(&ext.IAuditLog{}).Count(&count)
+		return int(count)
+	}
+
+	test.Job("create", func() {}, func() {
+		ctx := ext.ContextWithUserId(context.Background(), "u0")
+		if err := repo.Create(ctx, &auditItem{Name: "a", Password: "pass", Memo: "memo"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ext.DB.Create(&auditOther{Name: "other"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: 1, Store: count},
+		{Method: ext.TestMethodEqual, Want: "create u0", Store: latest(func(log *ext.IAuditLog) interface{} {
+			return log.Action + " " + log.UserId
+		})},
+		{Method: ext.TestMethodEqual, Want: "a *** false", Store: latest(func(log *ext.IAuditLog) interface{} {
+			_, memo := log.Changes["memo"]
+			return fmt.Sprintf("%v %v %v", log.Changes["name"].After, log.Changes["password"].After, memo)
+		})},
+	}...)
+	test.Api("update", &ext.ITestRequest{Method: "PATCH", Path: "/items/1/b", Headers: user}, 200, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: 2, Store: count},
+		{Method: ext.TestMethodEqual, Want: "update u1 true", Store: latest(func(log *ext.IAuditLog) interface{} {
+			return fmt.Sprintf("%s %s %v", log.Action, log.UserId, log.RequestId != "")
+		})},
+		// 変更されたカラムのみ
+		{Method: ext.TestMethodEqual, Want: "1 a b", Store: latest(func(log *ext.IAuditLog) interface{} {
+			return fmt.Sprintf("%d %v %v", len(log.Changes), log.Changes["name"].Before, log.Changes["name"].After)
+		})},
+	}...)
+	test.Api("unchanged", &ext.ITestRequest{Method: "PATCH", Path: "/items/1/b", Headers: user}, 200, &ext.ITestCase{
+		Method: ext.TestMethodEqual, Want: 2, Store: count,
+	})
+	test.Api("rollback", &ext.ITestRequest{Method: "PATCH", Path: "/items/1/rollback", Headers: user}, 400, &ext.ITestCase{
+		Method: ext.TestMethodEqual, Want: 2, Store: count,
+	})
+	test.Api("delete", &ext.ITestRequest{Method: "DELETE", Path: "/items/1", Headers: user}, 200, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: 3, Store: count},
+		{Method: ext.TestMethodEqual, Want: "delete b ***", Store: latest(func(log *ext.IAuditLog) interface{} {
+			return fmt.Sprintf("%s %v %v", log.Action, log.Changes["name"].Before, log.Changes["password"].Before)
+		})},
+	}...)
+	test.Api("history", &ext.ITestRequest{Method: "GET", Path: "/items/1/audit"}, 200, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Path: "$.result[0].action", Want: "delete"},
+		{Method: ext.TestMethodEqual, Path: "$.result[1].action", Want: "update"},
+		{Method: ext.TestMethodEqual, Path: "$.result[2].action", Want: "create"},
+		{Method: ext.TestMethodEqual, Path: "$.result[1].changes.name.after", Want: "b"},
+	}...)
+}
@@ -0,0 +1,356 @@
+package gofiber_extend
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/imdario/mergo"
+	"github.com/redis/go-redis/v9"
+	"github.com/tinylib/msgp/msgp"
+	"go.uber.org/zap"
+)
+
+// キャッシュが存在しない
+// loaderが返した場合は存在しないことをNegativeTTLの間キャッシュする
+var ErrCacheMiss = errors.New("cache: miss")
+
+// キャッシュする値の変換
+type ICacheCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCacheCodec struct{}
+
+func (jsonCacheCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCacheCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCacheCodec struct{}
+
+func (gobCacheCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCacheCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// tinylib/msgpで生成したMarshalMsg/UnmarshalMsgを使用する
+type msgpackCacheCodec struct{}
+
+func (msgpackCacheCodec) Marshal(v interface{}) ([]byte, error) {
+	marshaler, ok := v.(msgp.Marshaler)
+	if !ok {
+		return nil, fmt.Errorf("cache: %T does not implement msgp.Marshaler", v)
+	}
+	return marshaler.MarshalMsg(nil)
+}
+
+func (msgpackCacheCodec) Unmarshal(data []byte, v interface{}) error {
+	unmarshaler, ok := v.(msgp.Unmarshaler)
+	if !ok {
+		return fmt.Errorf("cache: %T does not implement msgp.Unmarshaler", v)
+	}
+	_, err := unmarshaler.UnmarshalMsg(data)
+	return err
+}
+
+var (
+	CacheCodecJSON    ICacheCodec = jsonCacheCodec{}
+	CacheCodecGob     ICacheCodec = gobCacheCodec{}
+	CacheCodecMsgpack ICacheCodec = msgpackCacheCodec{}
+)
+
+type ICacheConfig struct {
+	Prefix      string        // redisキーのプレフィックス
+	Codec       ICacheCodec   // 値の変換
+	NegativeTTL time.Duration // loaderがErrCacheMissを返した場合に保持する期間 0の場合は保持しない
+	Jitter      float64       // TTLのゆらぎの割合 0.1の場合は±10% 最大0.9
+	StaleTTL    time.Duration // TTL経過後に古い値を返しながら再読み込みする期間
+}
+
+var defaultCacheConfig *ICacheConfig = &ICacheConfig{
+	Prefix: "cache:",
+	Codec:  CacheCodecJSON,
+}
+
+// キャッシュの種類 保存する値の先頭1バイト
+const (
+	cacheEntryValue    byte = 'v'
+	cacheEntryNegative byte = 'n'
+)
+
+// TTLが0以下にならないようにJitterを制限する
+const maxCacheJitter = 0.9
+
+// 種類(1バイト) + 有効期限(UnixNano 8バイト 0の場合は無期限) + 値
+const cacheHeaderSize = 9
+
+type cacheEntry[T any] struct {
+	value    T
+	negative bool
+	stale    bool
+}
+
+type cacheCall[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// 型付きのキャッシュ
+// GetOrLoadは同じキーの同時の読み込みを1回にまとめる
+// 終了時はCloseでバックグラウンドの読み込みを停止する
+//
+//	users := ext.NewCache[User](ext.Redis, ext.ICacheConfig{Prefix: "user:", StaleTTL: time.Minute})
+//	user, err := users.GetOrLoad(ctx, id, 10*time.Minute, func(ctx context.Context) (User, error) {
+//		user := User{}
+//		if err := ext.DB.WithContext(ctx).First(&user, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+//			return user, ext.ErrCacheMiss
+//		}
+//		return user, err
+//	})
+type Cache[T any] struct {
+	redis   *redis.Client
+	config  ICacheConfig
+	mutex   sync.Mutex
+	calls   map[string]*cacheCall[T]
+	ctx     context.Context // バックグラウンドの読み込みのcontext Closeでキャンセルする
+	cancel  context.CancelFunc
+	closed  bool
+	refresh sync.WaitGroup
+}
+
+func NewCache[T any](client *redis.Client, config ...ICacheConfig) *Cache[T] {
+	conf := ICacheConfig{}
+	if len(config) > 0 {
+		conf = config[0]
+	}
+	if err := mergo.Merge(&conf, defaultCacheConfig); err != nil {
+		panic(err)
+	}
+	if conf.Jitter > maxCacheJitter {
+		conf.Jitter = maxCacheJitter
+	}
+	ctx, cancel := context.WithCancel(background)
+	return &Cache[T]{
+		redis:  client,
+		config: conf,
+		calls:  map[string]*cacheCall[T]{},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// バックグラウンドの読み込みをキャンセルし、終了を待つ
+func (p *Cache[T]) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	p.mutex.Unlock()
+	p.cancel()
+	p.refresh.Wait()
+}
+
+func (p *Cache[T]) key(key string) string {
+	return p.config.Prefix + key
+}
+
+// ゆらぎを加えたTTL
+func (p *Cache[T]) jitter(ttl time.Duration) time.Duration {
+	if ttl <= 0 || p.config.Jitter <= 0 {
+		return ttl
+	}
+	rs := ttl + time.Duration((rand.Float64()*2-1)*p.config.Jitter*float64(ttl))
+	if rs <= 0 {
+		return ttl
+	}
+	return rs
+}
+
+func (p *Cache[T]) get(ctx context.Context, key string) (*cacheEntry[T], error) {
+	buf, err := p.redis.Get(ctx, p.key(key)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+	if len(buf) < cacheHeaderSize {
+		return nil, fmt.Errorf("cache: %s: invalid entry", key)
+	}
+	entry := &cacheEntry[T]{negative: buf[0] == cacheEntryNegative}
+	if expire := int64(binary.BigEndian.Uint64(buf[1:cacheHeaderSize])); expire > 0 {
+		entry.stale = time.Now().UnixNano() > expire
+	}
+	if !entry.negative {
+		if err := p.config.Codec.Unmarshal(buf[cacheHeaderSize:], &entry.value); err != nil {
+			return nil, fmt.Errorf("cache: %s: %w", key, err)
+		}
+	}
+	return entry, nil
+}
+
+func (p *Cache[T]) set(ctx context.Context, key string, kind byte, value []byte, ttl time.Duration) error {
+	buf := make([]byte, cacheHeaderSize, cacheHeaderSize+len(value))
+	buf[0] = kind
+	expiration := time.Duration(0)
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(buf[1:cacheHeaderSize], uint64(time.Now().Add(ttl).UnixNano()))
+		expiration = ttl + p.config.StaleTTL
+	}
+	return p.redis.Set(ctx, p.key(key), append(buf, value...), expiration).Err()
+}
+
+// 取得する 存在しない場合はErrCacheMiss
+// StaleTTLの期間内の古い値も返す
+func (p *Cache[T]) Get(ctx context.Context, key string) (T, error) {
+	entry, err := p.get(ctx, key)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	if entry.negative {
+		return entry.value, ErrCacheMiss
+	}
+	return entry.value, nil
+}
+
+// 保存する ttlが0の場合は無期限
+func (p *Cache[T]) Set(ctx context.Context, key string, value T, ttl time.Duration) error {
+	buf, err := p.config.Codec.Marshal(&value)
+	if err != nil {
+		return err
+	}
+	return p.set(ctx, key, cacheEntryValue, buf, p.jitter(ttl))
+}
+
+func (p *Cache[T]) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	rs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		rs = append(rs, p.key(key))
+	}
+	return p.redis.Del(ctx, rs...).Err()
+}
+
+// キャッシュから取得し、存在しない場合はloaderで読み込んで保存する
+// 古い値はそのまま返し、バックグラウンドで読み込み直す
+// redisのエラーはログに出力してloaderの結果を返す
+func (p *Cache[T]) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader func(ctx context.Context) (T, error)) (T, error) {
+	entry, err := p.get(ctx, key)
+	if err != nil && err != ErrCacheMiss {
+		p.warn(ctx, "cache.get", key, err)
+	}
+	if entry != nil {
+		if entry.stale {
+			p.revalidate(ctx, key, ttl, loader)
+		}
+		if entry.negative {
+			return entry.value, ErrCacheMiss
+		}
+		return entry.value, nil
+	}
+	return p.load(ctx, key, ttl, loader)
+}
+
+func (p *Cache[T]) warn(ctx context.Context, msg string, key string, err error) {
+	if log := ComponentLoggerFromContext(ctx, LogComponentRedis); log != nil {
+		log.Warn(msg, zap.String("key", key), zap.Error(err))
+	}
+}
+
+// バックグラウンドで読み込み直す 読み込み中・Close後は何もしない
+func (p *Cache[T]) revalidate(ctx context.Context, key string, ttl time.Duration, loader func(ctx context.Context) (T, error)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.calls[key]; ok || p.closed {
+		return
+	}
+	p.refresh.Add(1)
+	go func() {
+		defer p.refresh.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				p.warn(ctx, "cache.refresh", key, fmt.Errorf("panic: %v", r))
+			}
+		}()
+		_, _ = p.load(cacheDetachedContext{Context: ctx, done: p.ctx}, key, ttl, loader)
+	}()
+}
+
+// 同じキーの読み込み中はその結果を待つ
+func (p *Cache[T]) load(ctx context.Context, key string, ttl time.Duration, loader func(ctx context.Context) (T, error)) (T, error) {
+	p.mutex.Lock()
+	if call, ok := p.calls[key]; ok {
+		p.mutex.Unlock()
+		select {
+		case <-call.done:
+			return call.value, call.err
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+	}
+	call := &cacheCall[T]{done: make(chan struct{}), err: fmt.Errorf("cache: %s: loader panicked", key)}
+	p.calls[key] = call
+	p.mutex.Unlock()
+	defer func() {
+		p.mutex.Lock()
+		delete(p.calls, key)
+		p.mutex.Unlock()
+		close(call.done)
+	}()
+
+	call.value, call.err = loader(ctx)
+	var err error
+	switch {
+	case errors.Is(call.err, ErrCacheMiss):
+		call.err = ErrCacheMiss
+		if p.config.NegativeTTL > 0 {
+			err = p.set(ctx, key, cacheEntryNegative, nil, p.jitter(p.config.NegativeTTL))
+		}
+	case call.err == nil:
+		err = p.Set(ctx, key, call.value, ttl)
+	}
+	if err != nil {
+		p.warn(ctx, "cache.set", key, err)
+	}
+	return call.value, call.err
+}
+
+// リクエストの終了後も読み込みを続けるため、リクエストのキャンセルを引き継がないcontext
+// 値はリクエストのものを使用し、doneのキャンセル(Close)で終了する
+type cacheDetachedContext struct {
+	context.Context
+	done context.Context
+}
+
+func (p cacheDetachedContext) Deadline() (time.Time, bool) {
+	return p.done.Deadline()
+}
+
+func (p cacheDetachedContext) Done() <-chan struct{} {
+	return p.done.Done()
+}
+
+func (p cacheDetachedContext) Err() error {
+	return p.done.Err()
+}
@@ -0,0 +1,219 @@
+package gofiber_extend_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"github.com/redis/go-redis/v9"
+)
+
+type cacheItem struct {
+	Name  string
+	Count int
+}
+
+func TestCache(t *testing.T) {
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		UseRedis:     true,
+		RedisOptions: &redis.Options{},
+	})
+	ctx := context.Background()
+	loads := int64(0)
+	loader := func(item cacheItem, err error) func(ctx context.Context) (cacheItem, error) {
+		return func(ctx context.Context) (cacheItem, error) {
+			atomic.AddInt64(&loads, 1)
+			time.Sleep(20 * time.Millisecond)
+			return item, err
+		}
+	}
+	result := func(item cacheItem, err error) string {
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("%s %d", item.Name, item.Count)
+	}
+
+	test.Run("get_set", func() {
+		cache := ext.NewCache[cacheItem](test.Ex.Redis)
+		test.Job("miss", func() {}, func() {}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+			_, err := cache.Get(ctx, "a")
+			return errors.Is(err, ext.ErrCacheMiss)
+		}})
+		test.Job("set", func() {}, func() {
+			if err := cache.Set(ctx, "a", cacheItem{Name: "a", Count: 1}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: "a 1", Store: func() interface{} {
+				return result(cache.Get(ctx, "a"))
+			}},
+			{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+				return test.Redis.Exists("cache:a")
+			}},
+		}...)
+		test.Job("delete", func() {}, func() {
+			if err := cache.Delete(ctx, "a"); err != nil {
+				t.Fatal(err)
+			}
+		}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: ext.ErrCacheMiss.Error(), Store: func() interface{} {
+			return result(cache.Get(ctx, "a"))
+		}})
+	})
+	test.Run("singleflight", func() {
+		atomic.StoreInt64(&loads, 0)
+		cache := ext.NewCache[cacheItem](test.Ex.Redis, ext.ICacheConfig{Jitter: 0.1})
+		results := make([]string, 10)
+		test.Job("concurrent", func() {}, func() {
+			wg := sync.WaitGroup{}
+			for i := range results {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					results[i] = result(cache.GetOrLoad(ctx, "b", time.Minute, loader(cacheItem{Name: "b", Count: 2}, nil)))
+				}(i)
+			}
+			wg.Wait()
+		}, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: int64(1), Store: func() interface{} {
+				return atomic.LoadInt64(&loads)
+			}},
+			{Method: ext.TestMethodEqual, Want: "b 2", Store: func() interface{} {
+				for _, rs := range results {
+					if rs != "b 2" {
+						return rs
+					}
+				}
+				return results[0]
+			}},
+			// ±10%のゆらぎ
+			{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+				ttl := test.Redis.TTL("cache:b")
+				return ttl >= 54*time.Second && ttl <= 66*time.Second
+			}},
+		}...)
+	})
+	test.Run("negative", func() {
+		atomic.StoreInt64(&loads, 0)
+		cache := ext.NewCache[cacheItem](test.Ex.Redis, ext.ICacheConfig{NegativeTTL: time.Minute})
+		test.Job("not_found", func() {}, func() {
+			for i := 0; i < 2; i++ {
+				if _, err := cache.GetOrLoad(ctx, "c", time.Minute, loader(cacheItem{}, fmt.Errorf("not found: %w", ext.ErrCacheMiss))); err != ext.ErrCacheMiss {
+					t.Errorf("negative: %v", err)
+				}
+			}
+		}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: int64(1), Store: func() interface{} {
+			return atomic.LoadInt64(&loads)
+		}})
+		// その他のエラーはキャッシュしない
+		test.Job("error", func() {}, func() {
+			for i := 0; i < 2; i++ {
+				if _, err := cache.GetOrLoad(ctx, "d", time.Minute, loader(cacheItem{}, errors.New("failed"))); err == nil {
+					t.Error("error: nil")
+				}
+			}
+		}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: int64(3), Store: func() interface{} {
+			return atomic.LoadInt64(&loads)
+		}})
+	})
+	test.Run("stale_while_revalidate", func() {
+		atomic.StoreInt64(&loads, 0)
+		cache := ext.NewCache[cacheItem](test.Ex.Redis, ext.ICacheConfig{StaleTTL: time.Minute, Codec: ext.CacheCodecGob})
+		t.Cleanup(cache.Close)
+		test.Job("stale", func() {
+			if err := cache.Set(ctx, "e", cacheItem{Name: "old"}, 10*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}, func() {}, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: "old 0", Store: func() interface{} {
+				return result(cache.GetOrLoad(ctx, "e", time.Minute, loader(cacheItem{Name: "new"}, nil)))
+			}},
+			{Method: ext.TestMethodEqual, Want: "new 0", Store: func() interface{} {
+				for i := 0; i < 50; i++ {
+					if item, err := cache.Get(ctx, "e"); err != nil || item.Name == "new" {
+						return result(item, err)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				return "timeout"
+			}},
+			{Method: ext.TestMethodEqual, Want: int64(1), Store: func() interface{} {
+				return atomic.LoadInt64(&loads)
+			}},
+		}...)
+	})
+	test.Run("refresh", func() {
+		cache := ext.NewCache[cacheItem](test.Ex.Redis, ext.ICacheConfig{StaleTTL: time.Minute})
+		stale := func(key string) {
+			if err := cache.Set(ctx, key, cacheItem{Name: "old"}, time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		// loaderのpanicはバックグラウンドで回復する
+		test.Job("panic", func() { stale("h") }, func() {}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: "old 0", Store: func() interface{} {
+			return result(cache.GetOrLoad(ctx, "h", time.Minute, func(ctx context.Context) (cacheItem, error) {
+				panic("failed")
+			}))
+		}})
+		// Closeは読み込み中のcontextをキャンセルして終了を待つ
+		canceled := int64(0)
+		test.Job("close", func() { stale("i") }, func() {
+			_, _ = cache.GetOrLoad(ctx, "i", time.Minute, func(ctx context.Context) (cacheItem, error) {
+				<-ctx.Done()
+				atomic.StoreInt64(&canceled, 1)
+				return cacheItem{}, ctx.Err()
+			})
+			cache.Close()
+		}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: int64(1), Store: func() interface{} {
+			return atomic.LoadInt64(&canceled)
+		}})
+	})
+	test.Run("jitter", func() {
+		// 1以上のJitterでも有効期限が0以下にならない
+		cache := ext.NewCache[cacheItem](test.Ex.Redis, ext.ICacheConfig{Jitter: 5})
+		test.Job("clamp", func() {}, func() {
+			for i := 0; i < 20; i++ {
+				if err := cache.Set(ctx, fmt.Sprint("j", i), cacheItem{}, time.Minute); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+			for i := 0; i < 20; i++ {
+				if ttl := test.Redis.TTL(fmt.Sprint("cache:j", i)); ttl < 6*time.Second || ttl > 114*time.Second {
+					return ttl
+				}
+			}
+			return true
+		}})
+	})
+	test.Run("codec", func() {
+		cache := ext.NewCache[cacheItem](test.Ex.Redis, ext.ICacheConfig{Codec: ext.CacheCodecMsgpack})
+		test.Job("msgpack", func() {}, func() {}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: "cache: *gofiber_extend_test.cacheItem does not implement msgp.Marshaler", Store: func() interface{} {
+			return result(cacheItem{}, cache.Set(ctx, "f", cacheItem{}, time.Minute))
+		}})
+	})
+	test.Run("redis_error", func() {
+		atomic.StoreInt64(&loads, 0)
+		client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+		defer client.Close()
+		cache := ext.NewCache[cacheItem](client)
+		test.Job("error", func() {}, func() {}, []*ext.ITestCase{
+			// 存在しない場合と区別できる
+			{Method: ext.TestMethodEqual, Want: false, Store: func() interface{} {
+				_, err := cache.Get(ctx, "g")
+				return err == nil || errors.Is(err, ext.ErrCacheMiss)
+			}},
+			// redisが使用できない場合もloaderの結果を返す
+			{Method: ext.TestMethodEqual, Want: "g 1", Store: func() interface{} {
+				return result(cache.GetOrLoad(ctx, "g", time.Minute, loader(cacheItem{Name: "g", Count: 1}, nil)))
+			}},
+		}...)
+	})
+}
@@ -0,0 +1,107 @@
+package gofiber_extend
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+type contextKey int
+
+const (
+	contextKeyLogger contextKey = iota
+	contextKeyLogFields
+	contextKeyRequestId
+	contextKeyTimings
+	contextKeyQueries
+	contextKeyDBState
+	contextKeyUserId
+	contextKeyTx
+	contextKeyTestDB
+)
+
+// loggerをcontextに格納する
+func ContextWithLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, contextKeyLogger, logger)
+}
+
+// ログに付与する項目をcontextに追加する
+func ContextWithLogFields(ctx context.Context, fields ...zap.Field) context.Context {
+	rs := append([]zap.Field{}, logFieldsFromContext(ctx)...)
+	return context.WithValue(ctx, contextKeyLogFields, append(rs, fields...))
+}
+
+func logFieldsFromContext(ctx context.Context) []zap.Field {
+	if ctx != nil {
+		if fields, ok := ctx.Value(contextKeyLogFields).([]zap.Field); ok {
+			return fields
+		}
+	}
+	return nil
+}
+
+// contextに格納されたloggerを取得する 未設定の場合は共通のlogger
+func LoggerFromContext(ctx context.Context) *zap.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(contextKeyLogger).(*zap.Logger); ok {
+			return logger
+		}
+	}
+	if Log == nil {
+		return nil
+	}
+	return Log.With(logFieldsFromContext(ctx)...)
+}
+
+// コンポーネント毎のloggerにcontextの項目を付与する
+func ComponentLoggerFromContext(ctx context.Context, name string) *zap.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(contextKeyLogger).(*zap.Logger); ok {
+			return logger
+		}
+	}
+	if Log == nil {
+		return nil
+	}
+	return ComponentLog(name).With(logFieldsFromContext(ctx)...)
+}
+
+func ContextWithRequestId(ctx context.Context, requestid string) context.Context {
+	return context.WithValue(ctx, contextKeyRequestId, requestid)
+}
+
+func RequestIdFromContext(ctx context.Context) string {
+	if ctx != nil {
+		if requestid, ok := ctx.Value(contextKeyRequestId).(string); ok {
+			return requestid
+		}
+	}
+	return ""
+}
+
+func ContextWithUserId(ctx context.Context, userid string) context.Context {
+	return context.WithValue(ctx, contextKeyUserId, userid)
+}
+
+func UserIdFromContext(ctx context.Context) string {
+	if ctx != nil {
+		if userid, ok := ctx.Value(contextKeyUserId).(string); ok {
+			return userid
+		}
+	}
+	return ""
+}
+
+// リクエスト情報を持つcontext
+// DB.WithContextやRedisのコマンド、JobEnqueueContextに渡すとログにリクエスト情報が出力される
+func (p *IFiberEx) Context(c *fiber.Ctx) context.Context {
+	ctx := c.UserContext()
+	if requestid, ok := c.Locals("requestid").(string); ok {
+		ctx = ContextWithRequestId(ctx, requestid)
+	}
+	if userid, ok := c.Locals("userid").(string); ok && userid != "-" {
+		ctx = ContextWithUserId(ctx, userid)
+	}
+	return ContextWithLogFields(ctx, p.logFields(c)...)
+}
@@ -0,0 +1,412 @@
+package gofiber_extend
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/exp/slices"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// カラム暗号化の設定
+type ICryptoConfig struct {
+	Keys        map[string]string // 鍵ID: base64の鍵(32バイト) ローテーション後も復号のため古い鍵を残す
+	CurrentKey  string            // 暗号化に使用する鍵ID
+	BlindKey    string            // ブラインドインデックスのHMACの鍵(base64)
+	Mask        string            // マスク後の文字列
+	UnmaskScope string            // マスクせずに返すAPIキーのスコープ
+	// マスクせずに返すか 未指定の場合はAPIキーのUnmaskScopeで判定する
+	Unmask func(c *fiber.Ctx) bool
+}
+
+var defaultCryptoConfig *ICryptoConfig = &ICryptoConfig{
+	Mask:        "***",
+	UnmaskScope: "pii:read",
+}
+
+// 暗号化したカラムのシリアライザ名 gorm:"serializer:encrypt"
+const EncryptSerializer = "encrypt"
+
+// ブラインドインデックスのカラムを指定するタグ blindindex:"email_bidx"
+const BlindIndexTag = "blindindex"
+
+// AES-GCMによるカラムの暗号化
+// 暗号文は<鍵ID>:<base64(nonce+暗号文)> テーブル名とカラム名を追加データとして使用する
+// 主キーはINSERTまで決まらないため追加データに含めない 同じテーブルとカラムの行同士で暗号文を入れ替えても復号できる
+type ICrypto struct {
+	config   *ICryptoConfig
+	aeads    map[string]cipher.AEAD
+	blindKey []byte
+}
+
+func NewCrypto(config *ICryptoConfig) (*ICrypto, error) {
+	rs := &ICrypto{config: config, aeads: map[string]cipher.AEAD{}}
+	for id, encoded := range config.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("crypto: invalid key id %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("crypto: key %s: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("crypto: key %s must be 32 bytes", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if rs.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := rs.aeads[config.CurrentKey]; !ok {
+		return nil, fmt.Errorf("crypto: current key %q is not found", config.CurrentKey)
+	}
+	if config.BlindKey != "" {
+		key, err := base64.StdEncoding.DecodeString(config.BlindKey)
+		if err != nil {
+			return nil, fmt.Errorf("crypto: blind key: %w", err)
+		}
+		rs.blindKey = key
+	}
+	return rs, nil
+}
+
+// テーブルとカラムを区別する追加データ
+func cryptoData(table string, column string) []byte {
+	return []byte(table + "." + column)
+}
+
+// 現在の鍵で暗号化する
+func (p *ICrypto) Encrypt(table string, column string, plain string) (string, error) {
+	aead := p.aeads[p.config.CurrentKey]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), cryptoData(table, column))
+	return p.config.CurrentKey + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// 暗号化した鍵で復号する
+func (p *ICrypto) Decrypt(table string, column string, value string) (string, error) {
+	id, encoded, ok := strings.Cut(value, ":")
+	if !ok {
+		return "", fmt.Errorf("crypto: invalid ciphertext")
+	}
+	aead, ok := p.aeads[id]
+	if !ok {
+		return "", fmt.Errorf("crypto: unknown key id %q", id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("crypto: invalid ciphertext")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], cryptoData(table, column))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// 暗号化に使用した鍵ID
+func (p *ICrypto) KeyId(value string) string {
+	id, _, _ := strings.Cut(value, ":")
+	return id
+}
+
+// 等価検索用の決定的なハッシュ カラム毎に異なる値になる
+func (p *ICrypto) BlindIndex(column string, plain string) (string, error) {
+	if len(p.blindKey) == 0 {
+		return "", fmt.Errorf("crypto: blind key is not configured")
+	}
+	key := hmac.New(sha256.New, p.blindKey)
+	key.Write([]byte(column))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write([]byte(plain))
+	return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+// 現在の鍵以外で暗号化された値を現在の鍵で暗号化し直す 更新した行数を返す
+func (p *ICrypto) Rotate(ctx context.Context, db *gorm.DB, model interface{}, batchSize int) (int, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return 0, err
+	}
+	pk := stmt.Schema.PrioritizedPrimaryField
+	if pk == nil {
+		return 0, fmt.Errorf("crypto: %s has no primary key", stmt.Schema.Name)
+	}
+	columns := []string{}
+	for _, field := range stmt.Schema.Fields {
+		if encryptedField(field) {
+			columns = append(columns, field.DBName)
+		}
+	}
+	if len(columns) == 0 {
+		return 0, nil
+	}
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	db = UsePrimary(db.WithContext(ctx))
+	updated := 0
+	var last interface{}
+	for {
+		rows := []map[string]interface{}{}
+		q := db.Table(stmt.Schema.Table).Select(append([]string{pk.DBName}, columns...)).Order(pk.DBName).Limit(batchSize)
+		if last != nil {
+			q = q.Where(clause.Gt{Column: pk.DBName, Value: last})
+		}
+		if err := q.Find(&rows).Error; err != nil {
+			return updated, err
+		}
+		for _, row := range rows {
+			values := map[string]interface{}{}
+			for _, column := range columns {
+				value, ok := auditValue(row[column]).(string)
+				if !ok || p.KeyId(value) == p.config.CurrentKey {
+					continue
+				}
+				plain, err := p.Decrypt(stmt.Schema.Table, column, value)
+				if err != nil {
+					return updated, fmt.Errorf("crypto: %s %v: %w", column, row[pk.DBName], err)
+				}
+				if values[column], err = p.Encrypt(stmt.Schema.Table, column, plain); err != nil {
+					return updated, err
+				}
+			}
+			if len(values) > 0 {
+				if err := db.Table(stmt.Schema.Table).Where(clause.Eq{Column: pk.DBName, Value: row[pk.DBName]}).UpdateColumns(values).Error; err != nil {
+					return updated, err
+				}
+				updated++
+			}
+		}
+		if len(rows) < batchSize {
+			return updated, nil
+		}
+		last = rows[len(rows)-1][pk.DBName]
+	}
+}
+
+func encryptedField(field *schema.Field) bool {
+	return strings.EqualFold(field.TagSettings["SERIALIZER"], EncryptSerializer)
+}
+
+// string/*stringのフィールドを暗号化して保存する
+type encryptSerializer struct{}
+
+func (encryptSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	value := reflect.New(field.FieldType).Elem()
+	if dbValue != nil {
+		if Crypto == nil {
+			return fmt.Errorf("crypto: not configured")
+		}
+		var text string
+		switch v := dbValue.(type) {
+		case []byte:
+			text = string(v)
+		case string:
+			text = v
+		default:
+			return fmt.Errorf("crypto: cannot scan %T", dbValue)
+		}
+		plain, err := Crypto.Decrypt(field.Schema.Table, field.DBName, text)
+		if err != nil {
+			return err
+		}
+		if value.Kind() == reflect.Ptr {
+			value.Set(reflect.New(field.FieldType.Elem()))
+			value.Elem().SetString(plain)
+		} else {
+			value.SetString(plain)
+		}
+	}
+	field.ReflectValueOf(ctx, dst).Set(value)
+	return nil
+}
+
+func (encryptSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	var plain string
+	switch v := fieldValue.(type) {
+	case string:
+		plain = v
+	case *string:
+		if v == nil {
+			return nil, nil
+		}
+		plain = *v
+	default:
+		return nil, fmt.Errorf("crypto: unsupported type %T", fieldValue)
+	}
+	if Crypto == nil {
+		return nil, fmt.Errorf("crypto: not configured")
+	}
+	return Crypto.Encrypt(field.Schema.Table, field.DBName, plain)
+}
+
+func init() {
+	schema.RegisterSerializer(EncryptSerializer, encryptSerializer{})
+}
+
+// 暗号化したカラムのブラインドインデックスを保存時に設定するgormのプラグイン
+type cryptoPlugin struct{}
+
+func (p *cryptoPlugin) Name() string {
+	return "crypto"
+}
+
+func (p *cryptoPlugin) Initialize(db *gorm.DB) error {
+	callback := db.Callback()
+	if err := callback.Create().Before("gorm:create").Register("crypto:create", p.beforeSave); err != nil {
+		return err
+	}
+	return callback.Update().Before("gorm:update").Register("crypto:update", p.beforeSave)
+}
+
+func (p *cryptoPlugin) beforeSave(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil || Crypto == nil {
+		return
+	}
+	p.blindIndex(db)
+	p.encryptMap(db)
+}
+
+// Update("email", ...)等のmapの場合はserializerが使用されないため暗号化する
+func (p *cryptoPlugin) encryptMap(db *gorm.DB) {
+	stmt := db.Statement
+	dest, ok := stmt.Dest.(map[string]interface{})
+	if !ok || db.Error != nil {
+		return
+	}
+	for _, field := range stmt.Schema.Fields {
+		if !encryptedField(field) {
+			continue
+		}
+		for _, key := range []string{field.DBName, field.Name} {
+			value, ok := dest[key]
+			if !ok {
+				continue
+			}
+			rs, err := encryptSerializer{}.Value(stmt.Context, field, stmt.ReflectValue, value)
+			if err != nil {
+				_ = db.AddError(err)
+				return
+			}
+			dest[key] = rs
+		}
+	}
+}
+
+func (p *cryptoPlugin) blindIndex(db *gorm.DB) {
+	stmt := db.Statement
+	for _, field := range stmt.Schema.Fields {
+		column := field.Tag.Get(BlindIndexTag)
+		if column == "" {
+			continue
+		}
+		target := stmt.Schema.LookUpField(column)
+		if target == nil {
+			_ = db.AddError(fmt.Errorf("crypto: blind index column %q is not found", column))
+			return
+		}
+		index := func(value interface{}) (interface{}, error) {
+			switch v := value.(type) {
+			case string:
+				if v == "" {
+					return "", nil
+				}
+				return Crypto.BlindIndex(field.DBName, v)
+			case *string:
+				if v == nil {
+					return nil, nil
+				}
+				return Crypto.BlindIndex(field.DBName, *v)
+			}
+			return nil, fmt.Errorf("crypto: unsupported type %T", value)
+		}
+		if dest, ok := stmt.Dest.(map[string]interface{}); ok {
+			for _, key := range []string{field.DBName, field.Name} {
+				if value, ok := dest[key]; ok {
+					rs, err := index(value)
+					if err != nil {
+						_ = db.AddError(err)
+						return
+					}
+					dest[target.DBName] = rs
+				}
+			}
+			continue
+		}
+		var err error
+		eachReflectValue(stmt.ReflectValue, func(rv reflect.Value) {
+			// serializerのフィールドはValueOfでは元の値を取得できない
+			rs, e := index(field.ReflectValueOf(stmt.Context, rv).Interface())
+			if e == nil {
+				e = target.Set(stmt.Context, rv, rs)
+			}
+			if e != nil {
+				err = e
+			}
+		})
+		if err != nil {
+			_ = db.AddError(err)
+			return
+		}
+		if len(stmt.Selects) > 0 && (slices.Contains(stmt.Selects, field.DBName) || slices.Contains(stmt.Selects, field.Name)) {
+			stmt.Selects = append(stmt.Selects, target.DBName)
+		}
+	}
+}
+
+// 暗号化したカラムをブラインドインデックスで等価検索する
+// columnは暗号化したカラム名
+func BlindIndexEq(column string, value string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if Crypto == nil {
+			_ = db.AddError(fmt.Errorf("crypto: not configured"))
+			return db
+		}
+		model := db.Statement.Model
+		if model == nil {
+			model = db.Statement.Dest
+		}
+		if err := db.Statement.Parse(model); err != nil {
+			_ = db.AddError(err)
+			return db
+		}
+		field := db.Statement.Schema.LookUpField(column)
+		if field == nil || field.Tag.Get(BlindIndexTag) == "" {
+			_ = db.AddError(fmt.Errorf("crypto: %s has no blind index", column))
+			return db
+		}
+		index, err := Crypto.BlindIndex(field.DBName, value)
+		if err != nil {
+			_ = db.AddError(err)
+			return db
+		}
+		target := db.Statement.Schema.LookUpField(field.Tag.Get(BlindIndexTag))
+		if target == nil {
+			_ = db.AddError(fmt.Errorf("crypto: blind index column %q is not found", field.Tag.Get(BlindIndexTag)))
+			return db
+		}
+		return db.Where(clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: target.DBName}, Value: index})
+	}
+}
@@ -0,0 +1,235 @@
+package gofiber_extend_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type cryptoUser struct {
+	ID         uint    `json:"id"`
+	Name       string  `json:"name"`
+	Email      string  `gorm:"serializer:encrypt" blindindex:"email_index" mask:"email" json:"email"`
+	EmailIndex string  `gorm:"size:32;index" json:"-"`
+	Phone      *string `gorm:"serializer:encrypt" mask:"phone" json:"phone"`
+	Note       string  `gorm:"serializer:encrypt" json:"note"`
+}
+
+// 相互に参照する型
+type maskNode struct {
+	Child  *maskChild
+	Secret string `mask:"all"`
+}
+
+type maskChild struct {
+	Parent *maskNode
+	Name   string
+}
+
+func cryptoKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestCrypto(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	ext.Crypto, ext.Log, ext.ErrorReporter = nil, zap.New(core), nil
+	defer func() { ext.Crypto, ext.Log, ext.ErrorReporter = nil, nil, nil }()
+	reportPath := filepath.Join(t.TempDir(), "errors.json")
+	test := newSQLiteTest(t, ext.IFiberExConfig{
+		AccessLog:         &ext.IAccessLogConfig{LogResponseBody: true},
+		UseErrorReport:    true,
+		ErrorReportConfig: &ext.IErrorReportConfig{FilePath: reportPath},
+		CryptoConfig: &ext.ICryptoConfig{
+			Keys:       map[string]string{"k1": cryptoKey('a')},
+			CurrentKey: "k1",
+			BlindKey:   cryptoKey('b'),
+			Unmask: func(c *fiber.Ctx) bool {
+				return c.Get("X-Unmask") != ""
+			},
+		},
+	})
+	if err := ext.DB.AutoMigrate(&cryptoUser{}); err != nil {
+		t.Fatal(err)
+	}
+	test.Routes(func(app *fiber.App) {
+		app.Get("/users/:id", func(c *fiber.Ctx) error {
+			user := &cryptoUser{}
+			if err := ext.DB.First(user, c.Params("id")).Error; err != nil {
+				return test.Ex.ResultError(c, 404, err)
+			}
+			return test.Ex.Result(c, 200, user)
+		})
+		app.Get("/search", func(c *fiber.Ctx) error {
+			params := &cryptoUser{}
+			if !test.Ex.RequestParser(c, params) {
+				return nil
+			}
+			return test.Ex.Result(c, 200, map[string]interface{}{"name": params.Name})
+		})
+		(&ext.Resource[cryptoUser]{
+			Ex:     test.Ex,
+			Fields: []string{"name", "email", "phone", "note"},
+			Authorize: func(c *fiber.Ctx, action string, item *cryptoUser) error {
+				if item.Name == "report" {
+					test.Ex.ReportError(c, errors.New("report"))
+				}
+				return nil
+			},
+		}).Mount(app.Group("/resources"))
+	})
+	raw := func(column string) func() interface{} {
+		return func() interface{} {
+			var value string
+			if err := ext.DB.Table("crypto_users").Select(column).Where("id = 1").Row().Scan(&value); err != nil {
+				return err
+			}
+			return value
+		}
+	}
+	keyId := func(column string) func() interface{} {
+		return func() interface{} {
+			return strings.Split(raw(column)().(string), ":")[0]
+		}
+	}
+	lookup := func(email string) func() interface{} {
+		return func() interface{} {
+			user := &cryptoUser{}
+			if err := ext.DB.Scopes(ext.BlindIndexEq("email", email)).First(user).Error; err != nil {
+				return err.Error()
+			}
+			return user.Name
+		}
+	}
+	phone := "090-1234-5678"
+
+	test.Job("encrypt", func() {}, func() {
+		if err := ext.DB.Create(&cryptoUser{Name: "a", Email: "alice@example.com", Phone: &phone, Note: "note"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: "k1", Store: keyId("email")},
+		{Method: ext.TestMethodEqual, Want: false, Store: func() interface{} {
+			return strings.Contains(raw("email")().(string), "alice")
+		}},
+		{Method: ext.TestMethodEqual, Want: "alice@example.com 090-1234-5678", Store: func() interface{} {
+			user := &cryptoUser{}
+			if err := ext.DB.First(user, 1).Error; err != nil {
+				return err
+			}
+			return user.Email + " " + *user.Phone
+		}},
+		{Method: ext.TestMethodEqual, Want: "a", Store: lookup("alice@example.com")},
+		{Method: ext.TestMethodEqual, Want: "record not found", Store: lookup("bob@example.com")},
+	}...)
+	test.Job("update", func() {}, func() {
+		if err := ext.DB.Model(&cryptoUser{ID: 1}).Update("email", "bob@example.com").Error; err != nil {
+			t.Fatal(err)
+		}
+	}, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: "a", Store: lookup("bob@example.com")},
+		{Method: ext.TestMethodEqual, Want: "record not found", Store: lookup("alice@example.com")},
+	}...)
+	// 暗号文はテーブルとカラムに紐づく
+	test.Job("bound", func() {}, func() {}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: "bob@example.com true true", Store: func() interface{} {
+		value := raw("email")().(string)
+		plain, err := ext.Crypto.Decrypt("crypto_users", "email", value)
+		if err != nil {
+			return err
+		}
+		_, otherTable := ext.Crypto.Decrypt("users", "email", value)
+		_, otherColumn := ext.Crypto.Decrypt("crypto_users", "note", value)
+		return fmt.Sprintf("%s %v %v", plain, otherTable != nil, otherColumn != nil)
+	}})
+	test.Api("masked", &ext.ITestRequest{Method: "GET", Path: "/users/1"}, 200, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Path: "$.result.email", Want: "b***@example.com"},
+		{Method: ext.TestMethodEqual, Path: "$.result.phone", Want: "*********5678"},
+		{Method: ext.TestMethodEqual, Path: "$.result.note", Want: "***"},
+		{Method: ext.TestMethodEqual, Path: "$.result.name", Want: "a"},
+	}...)
+	test.Api("unmasked", &ext.ITestRequest{Method: "GET", Path: "/users/1", Headers: map[string]string{"X-Unmask": "1"}}, 200, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Path: "$.result.email", Want: "bob@example.com"},
+		{Method: ext.TestMethodEqual, Path: "$.result.phone", Want: phone},
+		// アクセスログはマスクする
+		{Method: ext.TestMethodEqual, Want: "true false", Store: func() interface{} {
+			entries := logs.FilterMessage("api.request").AllUntimed()
+			response := entries[len(entries)-1].ContextMap()["response"].(string)
+			return fmt.Sprintf("%v %v", strings.Contains(response, "b***@example.com"), strings.Contains(response, "bob@"))
+		}},
+	}...)
+	// リクエストのbodyもアクセスログとエラー通知ではマスクする
+	test.Api("masked_request", &ext.ITestRequest{Method: "POST", Path: "/resources", Body: map[string]interface{}{
+		"name": "report", "email": "carol@example.com", "note": "secret note",
+	}}, 201, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: `{"email":"c***@example.com","name":"report","note":"***"}`, Store: func() interface{} {
+			entries := logs.FilterMessage("api.request").AllUntimed()
+			return entries[len(entries)-1].ContextMap()["body"]
+		}},
+		{Method: ext.TestMethodEqual, Want: "true false false", Store: func() interface{} {
+			test.Ex.Reporter.Flush(time.Second)
+			rs, err := os.ReadFile(reportPath)
+			if err != nil {
+				return err
+			}
+			report := string(rs)
+			return fmt.Sprintf("%v %v %v", strings.Contains(report, "c***@example.com"), strings.Contains(report, "carol@"), strings.Contains(report, "secret note"))
+		}},
+	}...)
+	test.Api("masked_params", &ext.ITestRequest{Method: "GET", Path: "/search", Body: map[string]interface{}{"name": "dave", "email": "dave@example.com"}}, 200, &ext.ITestCase{
+		Method: ext.TestMethodEqual,
+		Want:   `{"email":"d***@example.com","id":0,"name":"dave","note":"","phone":null}`,
+		Store: func() interface{} {
+			entries := logs.FilterMessage("api.request").AllUntimed()
+			return entries[len(entries)-1].ContextMap()["body"]
+		},
+	})
+	test.Job("mask_copy", func() {}, func() {}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: "bob@example.com b***@example.com", Store: func() interface{} {
+		user := &cryptoUser{Email: "bob@example.com"}
+		masked := ext.Mask([]*cryptoUser{user}).([]*cryptoUser)
+		return user.Email + " " + masked[0].Email
+	}})
+
+	test.Job("mask_recursive", func() {}, func() {}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: "secret ***", Store: func() interface{} {
+		// maskNodeの判定中にmaskChildを判定しても、maskChildをマスクしない型として保持しない
+		ext.Mask(&maskNode{})
+		child := &maskChild{Parent: &maskNode{Secret: "secret"}}
+		masked := ext.Mask(child).(*maskChild)
+		return child.Parent.Secret + " " + masked.Parent.Secret
+	}})
+
+	test.Job("rotate", func() {
+		var err error
+		if ext.Crypto, err = ext.NewCrypto(&ext.ICryptoConfig{
+			Keys:       map[string]string{"k1": cryptoKey('a'), "k2": cryptoKey('c')},
+			CurrentKey: "k2",
+			BlindKey:   cryptoKey('b'),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}, func() {
+		if n, err := ext.Crypto.Rotate(context.Background(), ext.DB, &cryptoUser{}, 10); err != nil || n != 2 {
+			t.Errorf("rotate: %d, %v", n, err)
+		}
+	}, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: "k2", Store: keyId("email")},
+		{Method: ext.TestMethodEqual, Want: "k2", Store: keyId("phone")},
+		{Method: ext.TestMethodEqual, Want: "a", Store: lookup("bob@example.com")},
+		{Method: ext.TestMethodEqual, Want: "bob@example.com", Store: func() interface{} {
+			user := &cryptoUser{}
+			if err := ext.DB.First(user, 1).Error; err != nil {
+				return err
+			}
+			return user.Email
+		}},
+	}...)
+}
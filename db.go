@@ -1,26 +1,307 @@
 package gofiber_extend
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	"go.uber.org/zap"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/utils"
 )
 
+const (
+	DialectMySQL    = "mysql"
+	DialectMariaDB  = "mariadb"
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite"
+)
+
+// インメモリのsqlite 接続間でデータを共有する
+const sqliteMemory = "file::memory:?cache=shared"
+
+func (p *IDBConfig) sqliteMemory() bool {
+	return p.DBName == "" || p.DBName == ":memory:" || strings.HasPrefix(p.DBName, "file::memory:")
+}
+
+// テスト用のデータベース名
+func (p *IDBConfig) testDBName() string {
+	if p.Dialect != DialectSQLite {
+		return p.DBName + "_test"
+	}
+	if p.sqliteMemory() {
+		return p.DBName
+	}
+	ext := filepath.Ext(p.DBName)
+	return strings.TrimSuffix(p.DBName, ext) + "_test" + ext
+}
+
+// 接続先のDSN Dsnが指定された場合はそのまま使用する
+func (p *IDBConfig) DSN() string {
+	if p.Dsn != "" {
+		return p.Dsn
+	}
+	params := url.Values{}
+	for key, value := range p.Params {
+		params.Set(key, value)
+	}
+	timezone := p.TimeZone
+	if timezone == "" {
+		timezone = "Local"
+	}
+	switch p.Dialect {
+	case DialectPostgres:
+		addr := p.Addr
+		if addr == "" {
+			addr = "db:5432"
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			host, port = addr, "5432"
+		}
+		options := map[string]string{
+			"host":     host,
+			"port":     port,
+			"user":     p.User,
+			"password": p.Pass,
+			"dbname":   p.DBName,
+			"sslmode":  "disable",
+			"TimeZone": timezone,
+		}
+		if timezone == "Local" {
+			options["TimeZone"] = "" // サーバの設定に従う
+		}
+		if p.TLS != "" {
+			options["sslmode"] = p.TLS
+		}
+		if p.Timeout > 0 {
+			options["connect_timeout"] = fmt.Sprintf("%d", int(p.Timeout.Seconds()))
+		}
+		for key := range params {
+			options[key] = params.Get(key)
+		}
+		keys := []string{}
+		for key := range options {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		rs := []string{}
+		for _, key := range keys {
+			if options[key] != "" {
+				rs = append(rs, fmt.Sprintf("%s=%s", key, postgresQuote(options[key])))
+			}
+		}
+		return strings.Join(rs, " ")
+	case DialectSQLite:
+		if p.sqliteMemory() {
+			return sqliteMemory
+		}
+		if len(params) == 0 {
+			return p.DBName
+		}
+		return "file:" + p.DBName + "?" + params.Encode()
+	default: // mysql/mariadb
+		addr := p.Addr
+		if addr == "" {
+			addr = "db:3306"
+		}
+		params.Set("charset", "utf8mb4")
+		params.Set("parseTime", "True")
+		params.Set("loc", timezone)
+		if p.TLS != "" {
+			params.Set("tls", p.TLS)
+		}
+		if p.Timeout > 0 {
+			params.Set("timeout", p.Timeout.String())
+		}
+		if p.ReadTimeout > 0 {
+			params.Set("readTimeout", p.ReadTimeout.String())
+		}
+		if p.WriteTimeout > 0 {
+			params.Set("writeTimeout", p.WriteTimeout.String())
+		}
+		for key, value := range p.Params {
+			params.Set(key, value)
+		}
+		return fmt.Sprintf("%s:%s@tcp(%s)/%s?%s", p.User, p.Pass, addr, p.DBName, params.Encode())
+	}
+}
+
+// postgresのkey=value形式の値 空白などを含む場合はクォートする
+func postgresQuote(value string) string {
+	if !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value) + "'"
+}
+
+func (p *IDBConfig) Dialector() gorm.Dialector {
+	switch p.Dialect {
+	case DialectPostgres:
+		return postgres.Open(p.DSN())
+	case DialectSQLite:
+		return sqlite.Open(p.DSN())
+	case DialectMySQL, DialectMariaDB, "":
+		return mysql.Open(p.DSN())
+	}
+	panic(fmt.Sprintf("db: unknown dialect: %s", p.Dialect))
+}
+
 func (p *IFiberExConfig) NewDB() *gorm.DB {
 	if p.TestMode != nil && *p.TestMode {
-		p.DBConfig.DBName += "_test"
-	}
-	dsn := fmt.Sprintf(
-		"%s:%s@tcp(%s)/%s?charset=utf8mb4&parseTime=True&loc=Local", // mysql dsn
-		p.DBConfig.User,
-		p.DBConfig.Pass,
-		p.DBConfig.Addr,
-		p.DBConfig.DBName,
-	)
-	db, err := gorm.Open(mysql.Open(dsn), p.DBConfig.Config)
+		p.DBConfig.DBName = p.DBConfig.testDBName()
+	}
+	config := *p.DBConfig.Config
+	if config.Logger == nil {
+		level := logger.Warn
+		if p.DevMode != nil && *p.DevMode {
+			level = logger.Info
+		}
+		config.Logger = &gormLogger{level: level, slow: p.DBConfig.SlowThreshold}
+	}
+	db, err := gorm.Open(p.DBConfig.Dialector(), &config)
 	if err != nil {
 		panic(err)
 	}
+	if p.queryCheck() {
+		if err := db.Use(&queryCheckPlugin{}); err != nil {
+			panic(err)
+		}
+	}
+	if p.CryptoConfig != nil {
+		if err := db.Use(&cryptoPlugin{}); err != nil {
+			panic(err)
+		}
+	}
+	if p.AuditConfig != nil {
+		if err := db.Use(newAuditPlugin(p.AuditConfig)); err != nil {
+			panic(err)
+		}
+	}
+
+	// コネクションプール
+	sqlDB, err := db.DB()
+	if err != nil {
+		panic(err)
+	}
+	sqlDB.SetMaxOpenConns(p.DBConfig.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(p.DBConfig.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(p.DBConfig.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(p.DBConfig.ConnMaxIdleTime)
+
+	// レプリカ 再初期化した場合は前のヘルスチェックを停止する
+	if dbReplicas != nil {
+		dbReplicas.close()
+	}
+	dbReplicas = nil
+	if len(p.DBConfig.Replicas) > 0 {
+		resolver, replicas, err := p.DBConfig.useReplicas(db, p.TestMode != nil && *p.TestMode)
+		if err != nil {
+			panic(err)
+		}
+		resolver.SetMaxOpenConns(p.DBConfig.MaxOpenConns).
+			SetMaxIdleConns(p.DBConfig.MaxIdleConns).
+			SetConnMaxLifetime(p.DBConfig.ConnMaxLifetime).
+			SetConnMaxIdleTime(p.DBConfig.ConnMaxIdleTime)
+		dbReplicas = replicas
+		replicas.start(p.DBConfig.ReplicaCheckInterval)
+	}
 	return db
 }
+
+// contextのloggerへ出力するgormのlogger
+type gormLogger struct {
+	level logger.LogLevel
+	slow  time.Duration
+}
+
+func (p *gormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	return &gormLogger{level: level, slow: p.slow}
+}
+
+func (p *gormLogger) Info(ctx context.Context, msg string, data ...interface{}) {
+	if p.level >= logger.Info {
+		ComponentLoggerFromContext(ctx, LogComponentDB).Info(fmt.Sprintf(msg, data...))
+	}
+}
+
+func (p *gormLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
+	if p.level >= logger.Warn {
+		ComponentLoggerFromContext(ctx, LogComponentDB).Warn(fmt.Sprintf(msg, data...))
+	}
+}
+
+func (p *gormLogger) Error(ctx context.Context, msg string, data ...interface{}) {
+	if p.level >= logger.Error {
+		ComponentLoggerFromContext(ctx, LogComponentDB).Error(fmt.Sprintf(msg, data...))
+	}
+}
+
+func (p *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	if p.level <= logger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	sql, rows := fc()
+	fields := []zap.Field{
+		zap.String("elaps", elapsed.String()),
+		zap.Int64("rows", rows),
+		zap.String("sql", sql),
+		zap.String("caller", utils.FileWithLineNum()),
+	}
+	log := ComponentLoggerFromContext(ctx, LogComponentDB)
+	switch {
+	case err != nil && p.level >= logger.Error && !errors.Is(err, gorm.ErrRecordNotFound):
+		log.Error(err.Error(), fields...)
+	case p.slow > 0 && elapsed > p.slow && p.level >= logger.Warn:
+		log.Warn("db.slow_query", fields...)
+	case p.level >= logger.Info:
+		log.Debug("db.query", fields...)
+	}
+}
+
+// create/query/update/delete/row/rawの処理の前後にコールバックを登録する
+// コールバック名は<name>:before_<操作>と<name>:after_<操作> beforeがnilの場合は後のみ登録する
+func registerAround(db *gorm.DB, name string, before func(operation string) func(*gorm.DB), after func(operation string) func(*gorm.DB)) error {
+	callback := db.Callback()
+	type register func(name string, fn func(*gorm.DB)) error
+	for _, processor := range []struct {
+		operation string
+		before    register
+		after     register
+	}{
+		{"create", callback.Create().Before("gorm:create").Register, callback.Create().After("gorm:create").Register},
+		{"query", callback.Query().Before("gorm:query").Register, callback.Query().After("gorm:query").Register},
+		{"update", callback.Update().Before("gorm:update").Register, callback.Update().After("gorm:update").Register},
+		{"delete", callback.Delete().Before("gorm:delete").Register, callback.Delete().After("gorm:delete").Register},
+		{"row", callback.Row().Before("gorm:row").Register, callback.Row().After("gorm:row").Register},
+		{"raw", callback.Raw().Before("gorm:raw").Register, callback.Raw().After("gorm:raw").Register},
+	} {
+		if before != nil {
+			if err := processor.before(name+":before_"+processor.operation, before(processor.operation)); err != nil {
+				return err
+			}
+		}
+		if err := processor.after(name+":after_"+processor.operation, after(processor.operation)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 操作によらず同じコールバックを登録する
+func anyOperation(fn func(*gorm.DB)) func(operation string) func(*gorm.DB) {
+	return func(string) func(*gorm.DB) {
+		return fn
+	}
+}
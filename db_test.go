@@ -0,0 +1,47 @@
+package gofiber_extend_test
+
+import (
+	"testing"
+	"time"
+
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+)
+
+func TestDSN(t *testing.T) {
+	cases := []struct {
+		name   string
+		config *ext.IDBConfig
+		want   string
+	}{
+		{"mysql", &ext.IDBConfig{User: "root", Pass: "qwerty", DBName: "app"}, "root:qwerty@tcp(db:3306)/app?charset=utf8mb4&loc=Local&parseTime=True"},
+		{"mysql_options", &ext.IDBConfig{
+			Dialect:     ext.DialectMariaDB,
+			User:        "root",
+			Addr:        "maria:3307",
+			DBName:      "app",
+			TLS:         "skip-verify",
+			TimeZone:    "Asia/Tokyo",
+			Timeout:     5 * time.Second,
+			ReadTimeout: 30 * time.Second,
+			Params:      map[string]string{"interpolateParams": "true"},
+		}, "root:@tcp(maria:3307)/app?charset=utf8mb4&interpolateParams=true&loc=Asia%2FTokyo&parseTime=True&readTimeout=30s&timeout=5s&tls=skip-verify"},
+		{"postgres", &ext.IDBConfig{Dialect: ext.DialectPostgres, User: "app", Pass: "p w", DBName: "app"}, "dbname=app host=db password='p w' port=5432 sslmode=disable user=app"},
+		{"postgres_options", &ext.IDBConfig{
+			Dialect:  ext.DialectPostgres,
+			User:     "app",
+			Addr:     "pg:6432",
+			DBName:   "app",
+			TLS:      "verify-full",
+			TimeZone: "UTC",
+			Timeout:  3 * time.Second,
+		}, "TimeZone=UTC connect_timeout=3 dbname=app host=pg port=6432 sslmode=verify-full user=app"},
+		{"sqlite_memory", &ext.IDBConfig{Dialect: ext.DialectSQLite}, "file::memory:?cache=shared"},
+		{"sqlite_file", &ext.IDBConfig{Dialect: ext.DialectSQLite, DBName: "app.db", Params: map[string]string{"_busy_timeout": "5000"}}, "file:app.db?_busy_timeout=5000"},
+		{"dsn", &ext.IDBConfig{Dsn: "raw", User: "root"}, "raw"},
+	}
+	for _, c := range cases {
+		if got := c.config.DSN(); got != c.want {
+			t.Errorf("%s: dsn: %s, want: %s", c.name, got, c.want)
+		}
+	}
+}
@@ -6,12 +6,31 @@ const (
 	E00500 ErrorCode = iota
 	E40001
 	E99999
+	// 既存のコードの値を変えないように以降は末尾に追加する
+	E40101
+	E40301
+	E42901
+	E40901
+	E42201
+	E40401
 )
 
 func (p ErrorCode) Errors() []IError {
 	switch p {
 	case E40001:
 		return []IError{{Code: "E40001", Message: "Validation Error"}}
+	case E40101:
+		return []IError{{Code: "E40101", Message: "Unauthorized"}}
+	case E40301:
+		return []IError{{Code: "E40301", Message: "Forbidden"}}
+	case E40401:
+		return []IError{{Code: "E40401", Message: "Not Found"}}
+	case E40901:
+		return []IError{{Code: "E40901", Message: "Conflict"}}
+	case E42201:
+		return []IError{{Code: "E42201", Message: "Unprocessable Entity"}}
+	case E42901:
+		return []IError{{Code: "E42901", Message: "Too Many Requests"}}
 	case E99999:
 		return []IError{{Code: "E99999", Message: "Undefined Error"}}
 	}
@@ -0,0 +1,465 @@
+package gofiber_extend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jrallison/go-workers"
+	"go.uber.org/zap"
+)
+
+// エラーの発生元
+const (
+	ErrorSourceHttp  = "http"
+	ErrorSourcePanic = "panic"
+	ErrorSourceJob   = "job"
+)
+
+type IErrorReportConfig struct {
+	Dsn         string        // Sentry互換のDSN https://<key>@<host>/<project>
+	FilePath    string        // 指定された場合はJSON Linesで出力する
+	Release     string        // リリースバージョン
+	Environment string        // 環境名
+	RateLimit   int           // 同じfingerprintのエラーをRateWindowの間に送信する上限
+	RateWindow  time.Duration // レート制限の期間
+	Timeout     time.Duration // 送信のタイムアウト
+	Sinks       []IErrorSink  // 追加の送信先
+}
+
+var defaultErrorReportConfig *IErrorReportConfig = &IErrorReportConfig{
+	Environment: "production",
+	RateLimit:   10,
+	RateWindow:  time.Minute,
+	Timeout:     5 * time.Second,
+}
+
+// スタックトレースのフレーム 新しい順
+type IStackFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	InApp    bool   `json:"in_app"`
+}
+
+// エラー発生時のリクエスト マスク済み
+type IErrorRequest struct {
+	Method    string            `json:"method"`
+	Url       string            `json:"url"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	RequestId string            `json:"requestid,omitempty"`
+}
+
+type IErrorEvent struct {
+	EventId     string            `json:"event_id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Level       string            `json:"level"`
+	Type        string            `json:"type"`
+	Message     string            `json:"message"`
+	Fingerprint string            `json:"fingerprint"`
+	Stacktrace  []IStackFrame     `json:"stacktrace,omitempty"`
+	Request     *IErrorRequest    `json:"request,omitempty"`
+	UserId      string            `json:"userid,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	App         string            `json:"app"`
+	Node        string            `json:"node"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// エラーの送信先
+type IErrorSink interface {
+	Send(ctx context.Context, event *IErrorEvent) error
+}
+
+type IErrorReporter struct {
+	config   *IErrorReportConfig
+	app      string
+	node     string
+	sinks    []IErrorSink
+	redactor *logRedactor
+	mutex    sync.Mutex
+	rates    map[string]*errorRate
+	swept    time.Time // ratesから期間が終了したものを削除した時刻
+	wg       sync.WaitGroup
+}
+
+type errorRate struct {
+	start time.Time
+	count int
+}
+
+// DSNとFilePathの指定から送信先を作成する
+func NewErrorReporter(config *IErrorReportConfig, appName string, nodeId string, accessLog *IAccessLogConfig) (*IErrorReporter, error) {
+	rs := &IErrorReporter{
+		config:   config,
+		app:      appName,
+		node:     nodeId,
+		redactor: newLogRedactor(accessLog),
+		rates:    map[string]*errorRate{},
+	}
+	if config.Dsn != "" {
+		sink, err := NewSentrySink(config.Dsn, config.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		rs.sinks = append(rs.sinks, sink)
+	}
+	if config.FilePath != "" {
+		rs.sinks = append(rs.sinks, NewFileErrorSink(config.FilePath))
+	}
+	rs.sinks = append(rs.sinks, config.Sinks...)
+	return rs, nil
+}
+
+// 呼び出し元のスタックトレース skipは呼び出し元から遡るフレーム数
+func stackFrames(skip int) []IStackFrame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	rs := []IStackFrame{}
+	for {
+		frame, more := frames.Next()
+		rs = append(rs, IStackFrame{
+			Function: frame.Function,
+			File:     frame.File,
+			Line:     frame.Line,
+			InApp:    !strings.HasPrefix(frame.Function, "runtime.") && !strings.Contains(frame.File, "/pkg/mod/") && !strings.HasPrefix(frame.File, runtime.GOROOT()),
+		})
+		if !more {
+			break
+		}
+	}
+	return rs
+}
+
+// panicのスタックトレース panic処理のフレームを除く
+func panicFrames() []IStackFrame {
+	frames := stackFrames(1)
+	for i, frame := range frames {
+		if frame.Function == "runtime.gopanic" {
+			return frames[i+1:]
+		}
+	}
+	return frames
+}
+
+// エラーの種類と発生箇所でグルーピングする
+func errorFingerprint(event *IErrorEvent) string {
+	keys := []string{event.Type}
+	for _, frame := range event.Stacktrace {
+		if frame.InApp {
+			keys = append(keys, frame.Function)
+		}
+		if len(keys) > 5 {
+			break
+		}
+	}
+	if len(keys) == 1 {
+		keys = append(keys, event.Message)
+	}
+	hash := sha1.Sum([]byte(strings.Join(keys, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// 同じfingerprintのエラーがRateWindowの間にRateLimitを超えた場合は送信しない
+func (p *IErrorReporter) allow(fingerprint string, now time.Time) bool {
+	if p.config.RateLimit <= 0 {
+		return true
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// 期間が終了したものはRateWindow毎にまとめて削除する
+	if now.Sub(p.swept) >= p.config.RateWindow {
+		for key, rate := range p.rates {
+			if now.Sub(rate.start) >= p.config.RateWindow {
+				delete(p.rates, key)
+			}
+		}
+		p.swept = now
+	}
+	rate, ok := p.rates[fingerprint]
+	if !ok || now.Sub(rate.start) >= p.config.RateWindow {
+		rate = &errorRate{start: now}
+		p.rates[fingerprint] = rate
+	}
+	rate.count++
+	return rate.count <= p.config.RateLimit
+}
+
+// エラーを非同期で送信する
+func (p *IErrorReporter) Capture(event *IErrorEvent) {
+	if event.EventId == "" {
+		event.EventId, _ = randomHex(16)
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	if event.Level == "" {
+		event.Level = "error"
+	}
+	if event.Fingerprint == "" {
+		event.Fingerprint = errorFingerprint(event)
+	}
+	event.Release = p.config.Release
+	event.Environment = p.config.Environment
+	event.App = p.app
+	event.Node = p.node
+	if !p.allow(event.Fingerprint, event.Timestamp) {
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ctx, cancel := context.WithTimeout(background, p.config.Timeout)
+		defer cancel()
+		for _, sink := range p.sinks {
+			if err := sink.Send(ctx, event); err != nil {
+				Log.Warn("error report failed", zap.Error(err), zap.String("event_id", event.EventId))
+			}
+		}
+	}()
+}
+
+// 送信中のエラーを待つ
+func (p *IErrorReporter) Flush(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func errorType(err error) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", err), "*")
+}
+
+// マスクしたリクエスト情報
+func (p *IErrorReporter) request(c *fiber.Ctx) *IErrorRequest {
+	rs := &IErrorRequest{
+		Method:  c.Method(),
+		Url:     c.BaseURL() + c.Path(),
+		Headers: map[string]string{},
+	}
+	if query := string(c.Request().URI().QueryString()); query != "" {
+		rs.Url += "?" + p.redactor.Body(fiber.MIMEApplicationForm, []byte(query))
+	}
+	c.Request().Header.VisitAll(func(key []byte, value []byte) {
+		rs.Headers[string(key)] = p.redactor.Header(string(key), string(value))
+	})
+	contentType := string(c.Request().Header.ContentType())
+	if !p.redactor.skip(c, contentType) {
+		rs.Body = p.redactor.Body(logRequestBody(c))
+	}
+	rs.RequestId, _ = c.Locals("requestid").(string)
+	return rs
+}
+
+// リクエスト中のエラーを送信する 同じリクエストで送信済みの場合は何もしない
+func (p *IFiberEx) ReportError(c *fiber.Ctx, err error) {
+	p.reportError(c, err, ErrorSourceHttp, stackFrames(1))
+}
+
+func (p *IFiberEx) reportError(c *fiber.Ctx, err error, source string, frames []IStackFrame) {
+	if p.Reporter == nil {
+		return
+	}
+	if reported, ok := c.Locals("error_reported").(bool); ok && reported {
+		return
+	}
+	c.Locals("error_reported", true)
+	event := &IErrorEvent{
+		Type:       errorType(err),
+		Message:    err.Error(),
+		Stacktrace: frames,
+		Request:    p.Reporter.request(c),
+		Tags:       map[string]string{"source": source, "route": c.Route().Path},
+	}
+	if source == ErrorSourcePanic {
+		event.Level = "fatal"
+	}
+	if userid, ok := c.Locals("userid").(string); ok && userid != "-" {
+		event.UserId = userid
+	}
+	p.Reporter.Capture(event)
+}
+
+// panicを500エラーに変換して送信する recover.New()の代わり
+func (p *IFiberEx) Recover() func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) (err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				var ok bool
+				if err, ok = e.(error); !ok {
+					err = fmt.Errorf("%v", e)
+				}
+				p.reportError(c, err, ErrorSourcePanic, panicFrames())
+			}
+		}()
+		return c.Next()
+	}
+}
+
+// ジョブのpanicを送信するミドルウェア
+type errorReportJob struct {
+	reporter *IErrorReporter
+}
+
+func (p *errorReportJob) Call(queue string, msg *workers.Msg, next func() bool) bool {
+	defer func() {
+		if e := recover(); e != nil {
+			err, ok := e.(error)
+			if !ok {
+				err = fmt.Errorf("%v", e)
+			}
+			event := &IErrorEvent{
+				Level:      "error",
+				Type:       errorType(err),
+				Message:    err.Error(),
+				Stacktrace: panicFrames(),
+				Tags:       map[string]string{"source": ErrorSourceJob, "queue": queue, "jid": msg.Jid()},
+			}
+			if requestid := msg.Get(jobMetaKey).Get("requestid").MustString(); requestid != "" {
+				event.Tags["requestid"] = requestid
+			}
+			p.reporter.Capture(event)
+			panic(e) // リトライはgo-workersに任せる
+		}
+	}()
+	return next()
+}
+
+// JSON Linesでファイルに出力する
+type IFileErrorSink struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewFileErrorSink(path string) *IFileErrorSink {
+	return &IFileErrorSink{path: path}
+}
+
+func (p *IFileErrorSink) Send(ctx context.Context, event *IErrorEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	file, err := os.OpenFile(p.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(value, '\n'))
+	return err
+}
+
+// Sentryのstore APIに送信する
+type ISentrySink struct {
+	endpoint string
+	key      string
+	client   *http.Client
+}
+
+func NewSentrySink(dsn string, timeout time.Duration) (*ISentrySink, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	project := strings.TrimPrefix(u.Path, "/")
+	if u.User == nil || project == "" {
+		return nil, fmt.Errorf("error report: invalid dsn: %s", dsn)
+	}
+	return &ISentrySink{
+		endpoint: fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		key:      u.User.Username(),
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Sentryのイベント形式
+func sentryEvent(event *IErrorEvent) map[string]interface{} {
+	frames := []map[string]interface{}{}
+	for i := len(event.Stacktrace) - 1; i >= 0; i-- { // Sentryは古い順
+		frame := event.Stacktrace[i]
+		frames = append(frames, map[string]interface{}{
+			"function": frame.Function,
+			"filename": frame.File,
+			"lineno":   frame.Line,
+			"in_app":   frame.InApp,
+		})
+	}
+	rs := map[string]interface{}{
+		"event_id":    event.EventId,
+		"timestamp":   event.Timestamp.UTC().Format(time.RFC3339Nano),
+		"level":       event.Level,
+		"platform":    "go",
+		"logger":      event.App,
+		"server_name": event.Node,
+		"release":     event.Release,
+		"environment": event.Environment,
+		"fingerprint": []string{event.Fingerprint},
+		"tags":        event.Tags,
+		"exception": map[string]interface{}{
+			"values": []map[string]interface{}{{
+				"type":       event.Type,
+				"value":      event.Message,
+				"stacktrace": map[string]interface{}{"frames": frames},
+			}},
+		},
+	}
+	if event.Request != nil {
+		rs["request"] = map[string]interface{}{
+			"method":  event.Request.Method,
+			"url":     event.Request.Url,
+			"headers": event.Request.Headers,
+			"data":    event.Request.Body,
+		}
+		rs["extra"] = map[string]interface{}{"requestid": event.Request.RequestId}
+	}
+	if event.UserId != "" {
+		rs["user"] = map[string]interface{}{"id": event.UserId}
+	}
+	return rs
+}
+
+func (p *ISentrySink) Send(ctx context.Context, event *IErrorEvent) error {
+	value, err := json.Marshal(sentryEvent(event))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.endpoint, bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=gofiber_extend/1.0, sentry_key=%s", p.key))
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("error report: sentry status: %d", res.StatusCode)
+	}
+	return nil
+}
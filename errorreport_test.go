@@ -0,0 +1,135 @@
+package gofiber_extend_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+)
+
+func TestErrorReport(t *testing.T) {
+	// Sentryの代わりのサーバ
+	var mutex sync.Mutex
+	events := []map[string]interface{}{}
+	auth := ""
+	sentry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		event := map[string]interface{}{}
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path == "/api/42/store/" {
+			events = append(events, event)
+		}
+		auth = r.Header.Get("X-Sentry-Auth")
+		w.WriteHeader(200)
+	}))
+	defer sentry.Close()
+	path := filepath.Join(t.TempDir(), "errors.json")
+
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		UseErrorReport: true,
+		ErrorReportConfig: &ext.IErrorReportConfig{
+			Dsn:       strings.Replace(sentry.URL, "http://", "http://publickey@", 1) + "/42",
+			FilePath:  path,
+			Release:   "v1.2.3",
+			RateLimit: 1,
+		},
+	})
+	defer func() { ext.ErrorReporter = nil }()
+	test.Routes(func(app *fiber.App) {
+		app.Post("/panic", func(c *fiber.Ctx) error {
+			panic("boom")
+		})
+		app.Get("/error", func(c *fiber.Ctx) error {
+			return test.Ex.ResultError(c, 500, errors.New("db down"))
+		})
+		app.Get("/bad", func(c *fiber.Ctx) error {
+			return test.Ex.ResultError(c, 400, errors.New("bad request"))
+		})
+	})
+	received := func(i int, path string) func() interface{} {
+		return func() interface{} {
+			test.Ex.Reporter.Flush(time.Second)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if len(events) <= i {
+				return nil
+			}
+			var value interface{} = events[i]
+			for _, key := range strings.Split(path, ".") {
+				switch v := value.(type) {
+				case map[string]interface{}:
+					value = v[key]
+				case []interface{}:
+					value = v[0]
+					if m, ok := value.(map[string]interface{}); ok {
+						value = m[key]
+					}
+				}
+			}
+			return value
+		}
+	}
+	count := func() interface{} {
+		test.Ex.Reporter.Flush(time.Second)
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(events)
+	}
+	test.Run("report", func() {
+		request := &ext.ITestRequest{
+			Method:  "POST",
+			Path:    "/panic",
+			Headers: map[string]string{"Authorization": "Bearer secret-token"},
+			Body:    map[string]interface{}{"name": "foo", "password": "p@ss"},
+		}
+		test.Api("panic", request, 500, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: "boom", Store: received(0, "exception.values.value")},
+			{Method: ext.TestMethodEqual, Want: "fatal", Store: received(0, "level")},
+			{Method: ext.TestMethodEqual, Want: "v1.2.3", Store: received(0, "release")},
+			{Method: ext.TestMethodEqual, Want: "panic", Store: received(0, "tags.source")},
+			{Method: ext.TestMethodEqual, Want: "***", Store: received(0, "request.headers.Authorization")},
+			{Method: ext.TestMethodEqual, Want: `{"name":"foo","password":"***"}`, Store: received(0, "request.data")},
+			{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+				frames, _ := received(0, "exception.values.stacktrace.frames")().([]interface{})
+				if len(frames) == 0 {
+					return false
+				}
+				// 最新のフレームはpanicしたハンドラ
+				return strings.HasSuffix(frames[len(frames)-1].(map[string]interface{})["filename"].(string), "errorreport_test.go")
+			}},
+			{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+				return strings.Contains(auth, "sentry_key=publickey")
+			}},
+		}...)
+		// 同じfingerprintはレート制限される
+		test.Api("panic_limited", request, 500, &ext.ITestCase{Method: ext.TestMethodEqual, Want: 1, Store: count})
+		test.Api("result_error", &ext.ITestRequest{Method: "GET", Path: "/error"}, 500, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: 2, Store: count},
+			{Method: ext.TestMethodEqual, Want: "db down", Store: received(1, "exception.values.value")},
+			{Method: ext.TestMethodEqual, Want: "http", Store: received(1, "tags.source")},
+		}...)
+		test.Api("client_error", &ext.ITestRequest{Method: "GET", Path: "/bad"}, 400, &ext.ITestCase{Method: ext.TestMethodEqual, Want: 2, Store: count})
+		test.It("file")
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(body), "\n"); lines != 2 {
+			t.Errorf("file sink: %d lines", lines)
+		}
+	})
+}
@@ -0,0 +1,358 @@
+package gofiber_extend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ログをelasticsearchに送信する設定 UseESの場合のみ有効
+type ILogESConfig struct {
+	Index         string        // インデックス名 未指定の場合はlogs-<AppName>
+	DateFormat    string        // 日付のサフィックス(Goのフォーマット) "-"の場合は付与しない(ILMのエイリアスに送信する)
+	BatchSize     int           // bulkで送信する件数
+	FlushInterval time.Duration // BatchSizeに満たない場合に送信する間隔
+	BufferSize    int           // 送信待ちの上限 超えた分は破棄する
+	Timeout       time.Duration // bulkのタイムアウト
+	MaxBackoff    time.Duration // 送信失敗時に待機する最大時間
+	FallbackPaths []string      // 送信に失敗したログの出力先
+}
+
+var defaultLogESConfig *ILogESConfig = &ILogESConfig{
+	DateFormat:    "2006.01.02",
+	BatchSize:     500,
+	FlushInterval: time.Second,
+	BufferSize:    10000,
+	Timeout:       10 * time.Second,
+	MaxBackoff:    30 * time.Second,
+	FallbackPaths: []string{"stdout"},
+}
+
+// elasticsearchへのログ送信の統計
+type ILogShipStats struct {
+	Sent    uint64 `json:"sent"`    // 送信済み
+	Failed  uint64 `json:"failed"`  // 送信に失敗しfallbackに出力した
+	Dropped uint64 `json:"dropped"` // バッファが一杯で破棄した
+	Pending int    `json:"pending"` // 送信待ち
+}
+
+type esLogDoc struct {
+	index string
+	body  []byte
+}
+
+// ログをバッファしてbulk APIで送信する
+type esLogShipper struct {
+	config   *ILogESConfig
+	client   *elasticsearch.Client
+	queue    chan *esLogDoc
+	flush    chan chan struct{}
+	stop     chan chan struct{}
+	fallback zapcore.WriteSyncer
+	start    sync.Once
+	started  int32
+	closed   int32
+	sent     uint64
+	failed   uint64
+	dropped  uint64
+}
+
+// 送信中のログ
+var logShipper *esLogShipper
+
+func currentLogShipper() *esLogShipper {
+	logMutex.RLock()
+	defer logMutex.RUnlock()
+	return logShipper
+}
+
+func newESLogShipper(config *ILogESConfig) *esLogShipper {
+	return &esLogShipper{
+		config:   config,
+		queue:    make(chan *esLogDoc, config.BufferSize),
+		flush:    make(chan chan struct{}),
+		stop:     make(chan chan struct{}),
+		fallback: logWriter(background, &sync.WaitGroup{}, config.FallbackPaths, nil),
+	}
+}
+
+// 送信を開始する それまでのログはバッファに溜める
+func (p *esLogShipper) Start(client *elasticsearch.Client) {
+	p.start.Do(func() {
+		p.client = client
+		atomic.StoreInt32(&p.started, 1)
+		go p.run()
+	})
+}
+
+func (p *esLogShipper) index(t time.Time) string {
+	if p.config.DateFormat == "-" {
+		return p.config.Index
+	}
+	return p.config.Index + "-" + t.Format(p.config.DateFormat)
+}
+
+// バッファが一杯の場合は待たずに破棄する Close後はfallbackに出力する
+func (p *esLogShipper) enqueue(doc *esLogDoc) {
+	if atomic.LoadInt32(&p.closed) == 1 {
+		if _, err := p.fallback.Write(doc.body); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+	select {
+	case p.queue <- doc:
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+	}
+}
+
+func (p *esLogShipper) run() {
+	ticker := time.NewTicker(p.config.FlushInterval)
+	defer ticker.Stop()
+	batch := []*esLogDoc{}
+	backoff := time.Duration(0)
+	var retryAt time.Time
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := p.bulk(batch); err != nil {
+			// 失敗したログはfallbackに出力し、しばらく送信を控える
+			p.writeFallback(batch, err)
+			if backoff == 0 {
+				backoff = p.config.FlushInterval
+			} else if backoff *= 2; backoff > p.config.MaxBackoff {
+				backoff = p.config.MaxBackoff
+			}
+			retryAt = time.Now().Add(backoff)
+		} else {
+			backoff = 0
+		}
+		batch = []*esLogDoc{}
+	}
+	for {
+		// 送信を控えている間はバッファから取り出さない(溢れた分は破棄される)
+		queue := p.queue
+		if len(batch) >= p.config.BatchSize || time.Now().Before(retryAt) {
+			queue = nil
+		}
+		select {
+		case doc := <-queue:
+			batch = append(batch, doc)
+			if len(batch) >= p.config.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			if !time.Now().Before(retryAt) {
+				send()
+			}
+		case done := <-p.flush:
+			for len(p.queue) > 0 {
+				batch = append(batch, <-p.queue)
+			}
+			send()
+			close(done)
+		case done := <-p.stop:
+			// 送信を控えている間でも残りをすべて送信する 失敗した分はfallbackに出力される
+			for len(p.queue) > 0 {
+				batch = append(batch, <-p.queue)
+			}
+			send()
+			close(done)
+			return
+		}
+	}
+}
+
+func (p *esLogShipper) bulk(batch []*esLogDoc) error {
+	body := &bytes.Buffer{}
+	for _, doc := range batch {
+		fmt.Fprintf(body, `{"index":{"_index":%q}}`+"\n", doc.index)
+		body.Write(doc.body)
+		if !bytes.HasSuffix(doc.body, []byte("\n")) {
+			body.WriteByte('\n')
+		}
+	}
+	ctx, cancel := context.WithTimeout(background, p.config.Timeout)
+	defer cancel()
+	res, err := p.client.Bulk(body, p.client.Bulk.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("log shipping: bulk: %s", res.Status())
+	}
+	// 一部のドキュメントの失敗は件数のみ記録する
+	result := struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+		} `json:"items"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil && err != io.EOF {
+		return err
+	}
+	failed := 0
+	for _, item := range result.Items {
+		for _, action := range item {
+			if action.Status >= 300 {
+				failed++
+			}
+		}
+	}
+	atomic.AddUint64(&p.failed, uint64(failed))
+	atomic.AddUint64(&p.sent, uint64(len(batch)-failed))
+	return nil
+}
+
+func (p *esLogShipper) writeFallback(batch []*esLogDoc, err error) {
+	atomic.AddUint64(&p.failed, uint64(len(batch)))
+	fmt.Fprintf(p.fallback, "{\"level\":\"warn\",\"msg\":\"log shipping failed\",\"error\":%q,\"count\":%d}\n", err.Error(), len(batch))
+	for _, doc := range batch {
+		if _, err := p.fallback.Write(doc.body); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	_ = p.fallback.Sync()
+}
+
+// バッファのログを送信し終わるまで待つ
+func (p *esLogShipper) Flush(timeout time.Duration) error {
+	if atomic.LoadInt32(&p.started) == 0 || atomic.LoadInt32(&p.closed) == 1 {
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case p.flush <- done:
+	case <-time.After(timeout):
+		return fmt.Errorf("log shipping: flush timeout")
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("log shipping: flush timeout")
+	}
+}
+
+// バッファのログを送信して停止する 以降のログはfallbackに出力する
+// 送信を開始していない場合はバッファのログをfallbackに出力する
+func (p *esLogShipper) Close(timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return nil
+	}
+	var err error
+	if atomic.LoadInt32(&p.started) == 1 {
+		done := make(chan struct{})
+		select {
+		case p.stop <- done:
+			select {
+			case <-done:
+			case <-time.After(timeout):
+				err = fmt.Errorf("log shipping: close timeout")
+			}
+		case <-time.After(timeout):
+			err = fmt.Errorf("log shipping: close timeout")
+		}
+	}
+	// 停止後にバッファに入ったログ
+	batch := []*esLogDoc{}
+	for len(p.queue) > 0 {
+		batch = append(batch, <-p.queue)
+	}
+	if len(batch) > 0 {
+		p.writeFallback(batch, errors.New("log shipping: closed"))
+	}
+	return err
+}
+
+func (p *esLogShipper) Stats() ILogShipStats {
+	return ILogShipStats{
+		Sent:    atomic.LoadUint64(&p.sent),
+		Failed:  atomic.LoadUint64(&p.failed),
+		Dropped: atomic.LoadUint64(&p.dropped),
+		Pending: len(p.queue),
+	}
+}
+
+// elasticsearchへのログ送信を停止する バッファのログを送信し終わるまで待つ
+// サーバの停止後に呼び出す
+func CloseLogShipping() error {
+	shipper := currentLogShipper()
+	if shipper == nil {
+		return nil
+	}
+	return shipper.Close(shipper.config.Timeout)
+}
+
+// elasticsearchへのログ送信の統計 送信していない場合はnil
+func LogShipStats() *ILogShipStats {
+	shipper := currentLogShipper()
+	if shipper == nil {
+		return nil
+	}
+	stats := shipper.Stats()
+	return &stats
+}
+
+// ログをJSONにしてshipperに渡すcore
+type esLogCore struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	shipper *esLogShipper
+}
+
+func newESLogCore(shipper *esLogShipper) zapcore.Core {
+	config := zap.NewProductionEncoderConfig()
+	config.TimeKey = "@timestamp"
+	config.MessageKey = "message"
+	config.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+	return &esLogCore{
+		LevelEnabler: zapcore.DebugLevel, // レベルの判定はlevelCoreで行う
+		encoder:      zapcore.NewJSONEncoder(config),
+		shipper:      shipper,
+	}
+}
+
+func (p *esLogCore) With(fields []zapcore.Field) zapcore.Core {
+	encoder := p.encoder.Clone()
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+	return &esLogCore{LevelEnabler: p.LevelEnabler, encoder: encoder, shipper: p.shipper}
+}
+
+func (p *esLogCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if p.Enabled(entry.Level) {
+		return checked.AddCore(entry, p)
+	}
+	return checked
+}
+
+func (p *esLogCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := p.encoder.EncodeEntry(entry, fields)
+	if err != nil {
+		return err
+	}
+	body := append([]byte{}, buf.Bytes()...)
+	buf.Free()
+	p.shipper.enqueue(&esLogDoc{index: p.shipper.index(entry.Time), body: body})
+	return nil
+}
+
+func (p *esLogCore) Sync() error {
+	return p.shipper.Flush(p.shipper.config.Timeout)
+}
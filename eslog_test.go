@@ -0,0 +1,161 @@
+package gofiber_extend_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+)
+
+func TestLogShipping(t *testing.T) {
+	// elasticsearchの代わりのサーバ
+	var mutex sync.Mutex
+	docs := map[string][]map[string]interface{}{}
+	available := true
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path != "/_bulk" {
+			w.Write([]byte(`{"acknowledged":true}`))
+			return
+		}
+		if !available {
+			w.WriteHeader(500)
+			return
+		}
+		items := []string{}
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+		for scanner.Scan() {
+			action := map[string]map[string]string{}
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				t.Error(err)
+			}
+			scanner.Scan()
+			doc := map[string]interface{}{}
+			if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+				t.Error(err)
+			}
+			index := action["index"]["_index"]
+			docs[index] = append(docs[index], doc)
+			items = append(items, `{"index":{"status":201}}`)
+		}
+		w.Write([]byte(`{"errors":false,"items":[` + strings.Join(items, ",") + `]}`))
+	}))
+	defer es.Close()
+	fallback := filepath.Join(t.TempDir(), "fallback.log")
+
+	ext.Log = nil
+	defer func() { ext.Log = nil }()
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		UseES:    true,
+		ESConfig: &elasticsearch.Config{Addresses: []string{es.URL}},
+		LogConfig: &ext.ILogConfig{
+			OutputPaths: []string{filepath.Join(t.TempDir(), "app.log")},
+			ES: &ext.ILogESConfig{
+				FlushInterval: 10 * time.Millisecond,
+				FallbackPaths: []string{fallback},
+			},
+		},
+	})
+	test.Routes(func(app *fiber.App) {
+		app.Get("/log", func(c *fiber.Ctx) error {
+			test.Ex.Logger(c).Info("shipped")
+			return test.Ex.Result(c, 200, map[string]interface{}{"ok": true})
+		})
+	})
+	index := "logs-app-" + time.Now().Format("2006.01.02")
+	shipped := func(message string) func() interface{} {
+		return func() interface{} {
+			if err := ext.Log.Sync(); err != nil {
+				t.Error(err)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, doc := range docs[index] {
+				if doc["message"] == message {
+					return doc["requestid"]
+				}
+			}
+			return nil
+		}
+	}
+	test.Run("ship", func() {
+		test.Api("request_log", &ext.ITestRequest{
+			Method:  "GET",
+			Path:    "/log",
+			Headers: map[string]string{"X-Request-Id": "req-es"},
+		}, 200, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: "req-es", Store: shipped("shipped")},
+			{Method: ext.TestMethodEqual, Want: "req-es", Store: shipped("api.request")},
+		}...)
+	})
+	test.Run("fallback", func() {
+		mutex.Lock()
+		available = false
+		mutex.Unlock()
+		ext.Log.Info("es unavailable")
+		if err := ext.Log.Sync(); err != nil {
+			t.Error(err)
+		}
+		test.Job("fallback", func() {}, func() {}, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+				body, err := os.ReadFile(fallback)
+				if err != nil {
+					return err
+				}
+				return strings.Contains(string(body), `"message":"es unavailable"`)
+			}},
+			{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+				return ext.LogShipStats().Failed > 0 && ext.LogShipStats().Sent > 0
+			}},
+		}...)
+	})
+	test.Run("close", func() {
+		mutex.Lock()
+		available = true
+		mutex.Unlock()
+		test.Job("close", func() {
+			// Syncせずにバッファに残す
+			ext.Log.Info("before close")
+		}, func() {
+			if err := ext.CloseLogShipping(); err != nil {
+				t.Error(err)
+			}
+			ext.Log.Info("after close")
+		}, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+				mutex.Lock()
+				defer mutex.Unlock()
+				for _, doc := range docs[index] {
+					if doc["message"] == "before close" {
+						return true
+					}
+				}
+				return false
+			}},
+			{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+				body, err := os.ReadFile(fallback)
+				if err != nil {
+					return err
+				}
+				return strings.Contains(string(body), `"message":"after close"`)
+			}},
+			{Method: ext.TestMethodEqual, Want: 0, Store: func() interface{} {
+				return ext.LogShipStats().Pending
+			}},
+		}...)
+	})
+}
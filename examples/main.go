@@ -15,17 +15,17 @@ func Routes(ex *gofiber_extend.IFiberEx) {
 	ctx := context.Background()
 
 	app.Get("/", func(c *fiber.Ctx) error {
-		ex.Log.Debug("test")
+		ex.Logger(c).Debug("test")
 		return ex.Result(c, 200, map[string]interface{}{"status": "ok"})
 	})
 
 	api := app.Group("api/v1")
 	api.Get("/test", func(c *fiber.Ctx) error {
-		ex.Log.Debug("test")
+		ex.Logger(c).Debug("test")
 		return ex.Result(c, 200, map[string]interface{}{"status": "ok"})
 	})
 	api.Post("/test", func(c *fiber.Ctx) error {
-		ex.Log.Debug("test")
+		ex.Logger(c).Debug("test")
 		if err := ex.Redis.Set(ctx, "test_key", "foo", 0).Err(); err != nil {
 			return ex.ResultError(c, 500, err)
 		}
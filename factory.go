@@ -0,0 +1,105 @@
+package gofiber_extend
+
+import (
+	"sync"
+)
+
+// テスト用のモデルを生成する
+// 作成はtest.Ex.DB(Run内ではトランザクション、Subtestでは独立したデータベース)に行うため、終了時に破棄される
+//
+//	users := ext.NewFactory(test, func(seq int, user *User) {
+//		user.Name = fmt.Sprintf("user%d", seq)
+//	}).Trait("admin", func(user *User) { user.Admin = true })
+//	posts := ext.NewFactory(test, func(seq int, post *Post) {
+//		post.Title = fmt.Sprintf("post%d", seq)
+//	}).Association(func(post *Post) {
+//		if post.UserID == 0 {
+//			post.UserID = users.Create().ID
+//		}
+//	})
+//	admin := users.Create("admin")
+type Factory[T any] struct {
+	test         *IFiberExTest
+	mutex        sync.Mutex
+	seq          int
+	defaults     func(seq int, item *T)
+	traits       map[string]func(item *T)
+	associations []func(item *T)
+}
+
+// defaultsには連番(1~)と生成したモデルが渡される
+func NewFactory[T any](test *IFiberExTest, defaults func(seq int, item *T)) *Factory[T] {
+	return &Factory[T]{
+		test:     test,
+		defaults: defaults,
+		traits:   map[string]func(item *T){},
+	}
+}
+
+// 名前を指定して適用する変更を登録する
+func (p *Factory[T]) Trait(name string, fn func(item *T)) *Factory[T] {
+	p.traits[name] = fn
+	return p
+}
+
+// 関連するレコードを設定する処理を登録する Createの場合のみ保存前に実行する
+func (p *Factory[T]) Association(fn func(item *T)) *Factory[T] {
+	p.associations = append(p.associations, fn)
+	return p
+}
+
+// 次の連番
+func (p *Factory[T]) Seq() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.seq++
+	return p.seq
+}
+
+// 保存せずに生成する
+func (p *Factory[T]) Build(traits ...string) *T {
+	return p.BuildWith(nil, traits...)
+}
+
+// traitsの後にfnを適用する
+func (p *Factory[T]) BuildWith(fn func(item *T), traits ...string) *T {
+	item := new(T)
+	if p.defaults != nil {
+		p.defaults(p.Seq(), item)
+	}
+	for _, name := range traits {
+		trait, ok := p.traits[name]
+		if !ok {
+			p.test.t.Fatalf("factory: unknown trait %q for %T", name, item)
+		}
+		trait(item)
+	}
+	if fn != nil {
+		fn(item)
+	}
+	return item
+}
+
+// 生成して保存する
+func (p *Factory[T]) Create(traits ...string) *T {
+	return p.CreateWith(nil, traits...)
+}
+
+func (p *Factory[T]) CreateWith(fn func(item *T), traits ...string) *T {
+	item := p.BuildWith(fn, traits...)
+	for _, association := range p.associations {
+		association(item)
+	}
+	if err := p.test.Ex.DB.Create(item).Error; err != nil {
+		p.test.t.Fatalf("factory: %T: %s", item, err)
+	}
+	return item
+}
+
+func (p *Factory[T]) CreateList(n int, traits ...string) []*T {
+	rs := make([]*T, 0, n)
+	for i := 0; i < n; i++ {
+		rs = append(rs, p.Create(traits...))
+	}
+	return rs
+}
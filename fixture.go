@@ -0,0 +1,275 @@
+package gofiber_extend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// フィクスチャの日時の形式
+const FixtureTimeFormat = "2006-01-02 15:04:05"
+
+// フィクスチャの1レコード
+type fixtureRecord struct {
+	table   string
+	name    string
+	columns []string // 定義順
+	values  map[string]interface{}
+}
+
+// 登録されたフィクスチャ
+type fixtureSet struct {
+	models  map[string]reflect.Type // テーブル名: モデルの型
+	keys    []string                // <テーブル名>.<名前> 定義順
+	records map[string]*fixtureRecord
+}
+
+// YAML/JSONのフィクスチャを登録する Runの開始時にトランザクション内に読み込む
+// トップレベルのキーはテーブル名、その下はレコード名: カラム名(またはフィールド名): 値
+// 文字列の値はtext/templateで展開する
+//
+//	{{ ref "users.alice" }} 他のレコードの主キー(未作成の場合は先に作成する)
+//	{{ name }} レコード名  {{ seq }} 連番  {{ uuid }}
+//	{{ now }} {{ ago "24h" }} {{ later "1h" }} 日時
+func (p *IFiberExTest) Fixtures(paths []string, models ...interface{}) {
+	set := &fixtureSet{models: map[string]reflect.Type{}, records: map[string]*fixtureRecord{}}
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: p.Ex.DB}
+		if err := stmt.Parse(model); err != nil {
+			p.t.Fatal(err)
+		}
+		set.models[stmt.Schema.Table] = stmt.Schema.ModelType
+	}
+	for _, path := range paths {
+		files, err := filepath.Glob(path)
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		if len(files) == 0 {
+			p.t.Fatalf("fixture: %s is not found", path)
+		}
+		for _, file := range files {
+			if err := set.parse(file); err != nil {
+				p.t.Fatal(err)
+			}
+		}
+	}
+	p.fixtures = set
+}
+
+func (p *fixtureSet) parse(file string) error {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	// 定義順を保持するためNodeで読み込む(JSONも読み込める)
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(buf, doc); err != nil {
+		return fmt.Errorf("fixture: %s: %w", file, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	tables := doc.Content[0]
+	if tables.Kind != yaml.MappingNode {
+		return fmt.Errorf("fixture: %s: top level must be a mapping of tables", file)
+	}
+	for i := 0; i+1 < len(tables.Content); i += 2 {
+		table, records := tables.Content[i].Value, tables.Content[i+1]
+		if _, ok := p.models[table]; !ok {
+			return fmt.Errorf("fixture: %s: model for table %q is not registered", file, table)
+		}
+		if records.Kind != yaml.MappingNode {
+			return fmt.Errorf("fixture: %s: %s must be a mapping of records", file, table)
+		}
+		for j := 0; j+1 < len(records.Content); j += 2 {
+			record := &fixtureRecord{table: table, name: records.Content[j].Value, values: map[string]interface{}{}}
+			columns := records.Content[j+1]
+			for k := 0; k+1 < len(columns.Content); k += 2 {
+				var value interface{}
+				if err := columns.Content[k+1].Decode(&value); err != nil {
+					return fmt.Errorf("fixture: %s: %s.%s: %w", file, table, record.name, err)
+				}
+				column := columns.Content[k].Value
+				record.columns = append(record.columns, column)
+				record.values[column] = value
+			}
+			key := table + "." + record.name
+			if _, ok := p.records[key]; ok {
+				return fmt.Errorf("fixture: %s: duplicate record %s", file, key)
+			}
+			p.keys = append(p.keys, key)
+			p.records[key] = record
+		}
+	}
+	return nil
+}
+
+// 1回の読み込み
+type fixtureLoader struct {
+	set     *fixtureSet
+	db      *gorm.DB
+	created map[string]interface{}
+	loading map[string]bool
+	seq     int
+}
+
+func (p *fixtureLoader) load(key string) (interface{}, error) {
+	if model, ok := p.created[key]; ok {
+		return model, nil
+	}
+	record, ok := p.set.records[key]
+	if !ok {
+		return nil, fmt.Errorf("fixture: %s is not found", key)
+	}
+	if p.loading[key] {
+		return nil, fmt.Errorf("fixture: circular reference: %s", key)
+	}
+	p.loading[key] = true
+	defer delete(p.loading, key)
+
+	model := reflect.New(p.set.models[record.table])
+	stmt := &gorm.Statement{DB: p.db}
+	if err := stmt.Parse(model.Interface()); err != nil {
+		return nil, err
+	}
+	for _, column := range record.columns {
+		field := stmt.Schema.LookUpField(column)
+		if field == nil {
+			return nil, fmt.Errorf("fixture: %s: unknown column %q", key, column)
+		}
+		value, err := p.value(record, record.values[column])
+		if err != nil {
+			return nil, fmt.Errorf("fixture: %s.%s: %w", key, column, err)
+		}
+		if err := setFixtureValue(field, model.Elem(), value); err != nil {
+			return nil, fmt.Errorf("fixture: %s.%s: %w", key, column, err)
+		}
+	}
+	if err := p.db.Create(model.Interface()).Error; err != nil {
+		return nil, fmt.Errorf("fixture: %s: %w", key, err)
+	}
+	p.created[key] = model.Interface()
+	return model.Interface(), nil
+}
+
+// 文字列の値をテンプレートとして展開する
+func (p *fixtureLoader) value(record *fixtureRecord, value interface{}) (interface{}, error) {
+	text, ok := value.(string)
+	if !ok || !strings.Contains(text, "{{") {
+		return value, nil
+	}
+	tmpl, err := template.New("").Funcs(template.FuncMap{
+		"ref": func(key string) (interface{}, error) {
+			model, err := p.load(key)
+			if err != nil {
+				return nil, err
+			}
+			stmt := &gorm.Statement{DB: p.db}
+			if err := stmt.Parse(model); err != nil {
+				return nil, err
+			}
+			if stmt.Schema.PrioritizedPrimaryField == nil {
+				return nil, fmt.Errorf("fixture: %s has no primary key", key)
+			}
+			id, _ := stmt.Schema.PrioritizedPrimaryField.ValueOf(background, reflect.ValueOf(model))
+			return id, nil
+		},
+		"name": func() string {
+			return record.name
+		},
+		"seq": func() int {
+			p.seq++
+			return p.seq
+		},
+		"uuid": uuid.NewString,
+		"now": func() string {
+			return time.Now().Format(FixtureTimeFormat)
+		},
+		"ago": func(duration string) (string, error) {
+			d, err := time.ParseDuration(duration)
+			return time.Now().Add(-d).Format(FixtureTimeFormat), err
+		},
+		"later": func(duration string) (string, error) {
+			d, err := time.ParseDuration(duration)
+			return time.Now().Add(d).Format(FixtureTimeFormat), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, nil); err != nil {
+		return nil, err
+	}
+	return buf.String(), nil
+}
+
+// gormの型変換を使用して設定する
+func setFixtureValue(field *schema.Field, rv reflect.Value, value interface{}) error {
+	switch v := value.(type) {
+	case map[string]interface{}, []interface{}:
+		// JSONのカラム等
+		if field.FieldType.Kind() == reflect.String {
+			buf, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			value = string(buf)
+		}
+	case string:
+		if field.IndirectFieldType == reflect.TypeOf(time.Time{}) {
+			if t, err := time.ParseInLocation(FixtureTimeFormat, v, time.Local); err == nil {
+				value = t
+			}
+		}
+	}
+	return field.Set(background, rv, value)
+}
+
+// フィクスチャを読み込む Run内では自動で読み込まれる
+func (p *IFiberExTest) LoadFixtures() {
+	if p.fixtures == nil {
+		return
+	}
+	loader := &fixtureLoader{
+		set:     p.fixtures,
+		db:      p.Ex.DB,
+		created: map[string]interface{}{},
+		loading: map[string]bool{},
+	}
+	for _, key := range p.fixtures.keys {
+		if _, err := loader.load(key); err != nil {
+			p.t.Fatal(err)
+		}
+	}
+	p.fixtureRecords = loader.created
+}
+
+// 読み込んだフィクスチャのレコード <テーブル名>.<名前>
+func (p *IFiberExTest) Fixture(key string) interface{} {
+	model, ok := p.fixtureRecords[key]
+	if !ok {
+		p.t.Fatalf("fixture: %s is not loaded", key)
+	}
+	return model
+}
+
+func FixtureOf[T any](test *IFiberExTest, key string) *T {
+	model, ok := test.Fixture(key).(*T)
+	if !ok {
+		test.t.Fatalf("fixture: %s is not %T", key, new(T))
+	}
+	return model
+}
@@ -0,0 +1,108 @@
+package gofiber_extend_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+)
+
+type fixtureUser struct {
+	ID    uint
+	Name  string
+	Email string
+	Admin bool
+}
+
+type fixturePost struct {
+	ID          uint
+	UserID      uint
+	Title       string
+	Meta        string
+	PublishedAt *time.Time
+}
+
+func TestFixture(t *testing.T) {
+	test := newSQLiteTest(t, ext.IFiberExConfig{})
+	if err := ext.DB.AutoMigrate(&fixtureUser{}, &fixturePost{}); err != nil {
+		t.Fatal(err)
+	}
+	test.Fixtures([]string{"testdata/fixtures/*.json", "testdata/fixtures/*.yml"}, &fixtureUser{}, &fixturePost{})
+	users := ext.NewFactory(test, func(seq int, user *fixtureUser) {
+		user.Name = fmt.Sprintf("user%d", seq)
+		user.Email = fmt.Sprintf("user%d@example.com", seq)
+	}).Trait("admin", func(user *fixtureUser) {
+		user.Admin = true
+	})
+	posts := ext.NewFactory(test, func(seq int, post *fixturePost) {
+		post.Title = fmt.Sprintf("post%d", seq)
+	}).Association(func(post *fixturePost) {
+		if post.UserID == 0 {
+			post.UserID = users.Create().ID
+		}
+	})
+	count := func(model interface{}) func() interface{} {
+		return func() interface{} {
+			var count int64
+			if err := test.Ex.DB.Model(model).Count(&count).Error; err != nil {
+				return err
+			}
+			return int(count)
+		}
+	}
+
+	test.Run("fixtures", func() {
+		test.Job("loaded", func() {}, func() {}, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: 2, Store: count(&fixtureUser{})},
+			{Method: ext.TestMethodEqual, Want: "alice@example.com true", Store: func() interface{} {
+				alice := ext.FixtureOf[fixtureUser](test, "fixture_users.alice")
+				return fmt.Sprintf("%s %v", alice.Email, alice.Admin)
+			}},
+			// 参照先が後に定義されていても先に作成する
+			{Method: ext.TestMethodEqual, Want: "Bob bob1@example.com", Store: func() interface{} {
+				post := ext.FixtureOf[fixturePost](test, "fixture_posts.hello")
+				user := &fixtureUser{}
+				if err := test.Ex.DB.First(user, post.UserID).Error; err != nil {
+					return err
+				}
+				return user.Name + " " + user.Email
+			}},
+			{Method: ext.TestMethodEqual, Want: `{"tags":["a","b"]} true`, Store: func() interface{} {
+				post := &fixturePost{}
+				if err := test.Ex.DB.Where("title = ?", "Hello").First(post).Error; err != nil {
+					return err
+				}
+				return fmt.Sprintf("%s %v", post.Meta, post.PublishedAt != nil && time.Since(*post.PublishedAt) > 47*time.Hour)
+			}},
+		}...)
+		test.Job("factory", func() {}, func() {
+			users.CreateList(2)
+			users.Create("admin")
+			posts.Create()
+			posts.CreateWith(func(post *fixturePost) {
+				post.UserID = ext.FixtureOf[fixtureUser](test, "fixture_users.alice").ID
+			})
+		}, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: 6, Store: count(&fixtureUser{})},
+			{Method: ext.TestMethodEqual, Want: 3, Store: count(&fixturePost{})},
+			{Method: ext.TestMethodEqual, Want: 2, Store: func() interface{} {
+				var count int64
+				test.Ex.DB.Model(&fixtureUser{}).Where("admin = ?", true).Count(&count)
+				return int(count)
+			}},
+		}...)
+		test.Job("build", func() {}, func() {
+			if user := users.Build("admin"); !user.Admin || user.ID != 0 {
+				t.Errorf("build: %+v", user)
+			}
+		}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: 6, Store: count(&fixtureUser{})})
+	})
+	// ロールバックされ、フィクスチャのみから開始する
+	test.Run("reset", func() {
+		test.Job("reloaded", func() {}, func() {}, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: 2, Store: count(&fixtureUser{})},
+			{Method: ext.TestMethodEqual, Want: 1, Store: count(&fixturePost{})},
+		}...)
+	})
+}
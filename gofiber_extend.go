@@ -3,13 +3,14 @@ package gofiber_extend
 import (
 	"context"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/favicon"
-	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/google/uuid"
 	"github.com/imdario/mergo"
@@ -23,19 +24,28 @@ var Log *zap.Logger
 var DB *gorm.DB
 var Redis *redis.Client
 var ES *elasticsearch.Client
+var Metrics *IMetrics
+var Tracing *ITracing
+var ErrorReporter *IErrorReporter
+var Crypto *ICrypto
 var Validator *validator.Validate
 
 var background = context.Background()
 
 type IFiberEx struct {
-	NodeId    string
-	Config    IFiberExConfig
-	App       *fiber.App
-	Log       *zap.Logger
-	DB        *gorm.DB
-	Redis     *redis.Client
-	ES        *elasticsearch.Client
-	Validator *validator.Validate
+	NodeId     string
+	Config     IFiberExConfig
+	App        *fiber.App
+	Log        *zap.Logger
+	DB         *gorm.DB
+	Redis      *redis.Client
+	LocalCache *ILocalCache
+	ES         *elasticsearch.Client
+	Metrics    *IMetrics
+	Tracing    *ITracing
+	Reporter   *IErrorReporter
+	Validator  *validator.Validate
+	logLevel   *logLevelSubscriber
 }
 
 type IFiberExConfig struct {
@@ -53,14 +63,22 @@ type IFiberExConfig struct {
 	ErrorHandler     func(*fiber.Ctx, error) error
 	AppName          *string
 	BodyLimit        *int
+	// ログ
+	LogConfig *ILogConfig
+	// アクセスログ
+	AccessLog *IAccessLogConfig
 	// ページング処理
 	PagePer *int
 	// データベース接続
-	UseDB    bool
-	DBConfig *IDBConfig
+	UseDB         bool
+	DBConfig      *IDBConfig
+	MigrateConfig *IMigrateConfig
+	OutboxConfig  *IOutboxConfig
+	AuditConfig   *IAuditConfig // 指定した場合のみ監査ログを記録する
 	// キャッシュサーバ接続
-	UseRedis     bool
-	RedisOptions *redis.Options
+	UseRedis         bool
+	RedisOptions     *redis.Options
+	LocalCacheConfig *ILocalCacheConfig // 指定した場合のみredisの前段にメモリ上のキャッシュを使用する
 	// elasticsearch接続
 	UseES    bool
 	ESConfig *elasticsearch.Config
@@ -75,14 +93,47 @@ type IFiberExConfig struct {
 	JobDatabase int
 	JobPool     int
 	JobProcess  int
+	// APIキー認証
+	ApiKeyConfig *IApiKeyConfig
+	// メトリクス
+	UseMetrics    bool
+	MetricsConfig *IMetricsConfig
+	// トレース
+	UseTracing    bool
+	TracingConfig *ITracingConfig
+	// エラー通知
+	UseErrorReport    bool
+	ErrorReportConfig *IErrorReportConfig
+	// カラム暗号化・マスク 指定した場合のみ有効
+	CryptoConfig *ICryptoConfig
 }
 
 type IDBConfig struct {
-	Config *gorm.Config
-	User   string
-	Pass   string
-	Addr   string
-	DBName string
+	Config       *gorm.Config
+	Dialect      string // mysql/mariadb/postgres/sqlite
+	Dsn          string // 指定された場合は以下の接続情報を使用しない
+	User         string
+	Pass         string
+	Addr         string            // host:port 未指定の場合はdb:3306(postgresはdb:5432)
+	DBName       string            // sqliteの場合はファイルパス 未指定か:memory:の場合はインメモリ
+	TLS          string            // mysqlはtls(true/skip-verify/登録名) postgresはsslmode
+	TimeZone     string            // 未指定の場合はLocal
+	Timeout      time.Duration     // 接続のタイムアウト
+	ReadTimeout  time.Duration     // mysqlのみ
+	WriteTimeout time.Duration     // mysqlのみ
+	Params       map[string]string // その他のDSNのオプション
+	// コネクションプール
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// 読み込み用のレプリカ 未指定の接続情報はプライマリから引き継ぐ
+	Replicas             []*IDBConfig
+	ReplicaPolicy        string        // random/round_robin
+	ReplicaModels        []interface{} // 指定された場合はこのモデル(テーブル名)のみレプリカを使用する
+	ReplicaCheckInterval time.Duration // レプリカのヘルスチェック間隔
+	SlowThreshold        time.Duration // これより遅いクエリを警告する
+	RepeatThreshold      int           // 1リクエストで同じ形のクエリがこの回数以上実行された場合にN+1として警告する DevMode/TestModeのみ
 }
 
 func String(src string) *string {
@@ -129,11 +180,20 @@ var defaultRedisOptions *redis.Options = &redis.Options{
 }
 
 var defaultDBConfig *IDBConfig = &IDBConfig{
-	User:   "",
-	Pass:   "",
-	Addr:   "db:3306",
-	DBName: "",
-	Config: &gorm.Config{},
+	User:                 "",
+	Pass:                 "",
+	Dialect:              DialectMySQL,
+	Addr:                 "",
+	DBName:               "",
+	Config:               &gorm.Config{},
+	SlowThreshold:        200 * time.Millisecond,
+	RepeatThreshold:      5,
+	MaxOpenConns:         100,
+	MaxIdleConns:         10,
+	ConnMaxLifetime:      time.Hour,
+	ConnMaxIdleTime:      10 * time.Minute,
+	ReplicaPolicy:        ReplicaPolicyRandom,
+	ReplicaCheckInterval: 10 * time.Second,
 }
 
 var defaultESConfig *elasticsearch.Config = &elasticsearch.Config{
@@ -152,18 +212,91 @@ func New(config IFiberExConfig) *IFiberEx {
 	}
 
 	// logger初期化
+	if config.LogConfig == nil {
+		config.LogConfig = &ILogConfig{}
+	}
+	if err := mergo.Merge(config.LogConfig, defaultLogConfig); err != nil {
+		panic(err)
+	}
 	if Log == nil {
-		var logger *zap.Logger
-		var err error
-		if config.DevMode != nil && *config.DevMode {
-			logger, err = zap.NewDevelopment()
-		} else {
-			logger, err = zap.NewProduction()
+		Log = config.NewLogger()
+	}
+
+	// uuid
+	obj, err := uuid.NewRandom()
+	if err != nil {
+		panic(err)
+	}
+	nodeId := obj.String()
+
+	// メトリクス初期化
+	if config.MetricsConfig == nil {
+		config.MetricsConfig = &IMetricsConfig{}
+	}
+	if err := mergo.Merge(config.MetricsConfig, defaultMetricsConfig); err != nil {
+		panic(err)
+	}
+	var metrics *IMetrics
+	if config.UseMetrics {
+		// レジストリはプロセスで共有するため2回目以降のNewでは作り直さない
+		if Metrics == nil {
+			Metrics = NewMetrics(config.MetricsConfig, *config.AppName, nodeId)
 		}
-		if err != nil {
+		metrics = Metrics
+	}
+
+	// トレース初期化
+	if config.TracingConfig == nil {
+		config.TracingConfig = &ITracingConfig{}
+	}
+	if err := mergo.Merge(config.TracingConfig, defaultTracingConfig); err != nil {
+		panic(err)
+	}
+	var tracing *ITracing
+	if config.UseTracing {
+		if Tracing == nil {
+			if Tracing, err = NewTracing(config.TracingConfig, *config.AppName, nodeId); err != nil {
+				panic(err)
+			}
+		}
+		tracing = Tracing
+	}
+
+	// アクセスログ初期化
+	if config.AccessLog == nil {
+		config.AccessLog = &IAccessLogConfig{}
+	}
+	if err := mergo.Merge(config.AccessLog, defaultAccessLogConfig); err != nil {
+		panic(err)
+	}
+
+	// エラー通知初期化
+	if config.ErrorReportConfig == nil {
+		config.ErrorReportConfig = &IErrorReportConfig{}
+	}
+	if err := mergo.Merge(config.ErrorReportConfig, defaultErrorReportConfig); err != nil {
+		panic(err)
+	}
+	var reporter *IErrorReporter
+	if config.UseErrorReport {
+		if ErrorReporter == nil {
+			if ErrorReporter, err = NewErrorReporter(config.ErrorReportConfig, *config.AppName, nodeId, config.AccessLog); err != nil {
+				panic(err)
+			}
+		}
+		reporter = ErrorReporter
+	}
+
+	// カラム暗号化初期化
+	if config.CryptoConfig != nil {
+		if err := mergo.Merge(config.CryptoConfig, defaultCryptoConfig); err != nil {
 			panic(err)
 		}
-		Log = logger
+		if Crypto == nil {
+			if Crypto, err = NewCrypto(config.CryptoConfig); err != nil {
+				panic(err)
+			}
+		}
 	}
 
 	// DB初期化
@@ -174,7 +307,45 @@ func New(config IFiberExConfig) *IFiberEx {
 		if err := mergo.Merge(config.DBConfig, defaultDBConfig); err != nil {
 			panic(err)
 		}
+		if config.AuditConfig != nil {
+			if err := mergo.Merge(config.AuditConfig, defaultAuditConfig); err != nil {
+				panic(err)
+			}
+			if config.AuditConfig.Index == "" {
+				config.AuditConfig.Index = "audit-" + strings.ToLower(*config.AppName)
+			}
+		}
 		DB = config.NewDB()
+		if err := DB.Use(&timingPlugin{}); err != nil {
+			panic(err)
+		}
+		if metrics != nil {
+			if err := metrics.InstrumentDB(DB, config.DBConfig.DBName); err != nil {
+				panic(err)
+			}
+		}
+		if tracing != nil {
+			if err := tracing.InstrumentDB(DB); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if config.UseDB {
+		if config.MigrateConfig == nil {
+			config.MigrateConfig = &IMigrateConfig{}
+		}
+		if err := mergo.Merge(config.MigrateConfig, defaultMigrateConfig); err != nil {
+			panic(err)
+		}
+		if config.MigrateConfig.LockKey == "" {
+			config.MigrateConfig.LockKey = "migrate:" + *config.AppName
+		}
+		if config.OutboxConfig == nil {
+			config.OutboxConfig = &IOutboxConfig{}
+		}
+		if err := mergo.Merge(config.OutboxConfig, defaultOutboxConfig); err != nil {
+			panic(err)
+		}
 	}
 
 	// Redis初期化
@@ -185,7 +356,24 @@ func New(config IFiberExConfig) *IFiberEx {
 		if err := mergo.Merge(config.RedisOptions, defaultRedisOptions); err != nil {
 			panic(err)
 		}
-		Redis = config.NewRedis()
+		hooks := []redis.Hook{&timingRedisHook{}}
+		if metrics != nil {
+			hooks = append(hooks, metrics.RedisHook())
+		}
+		if tracing != nil {
+			hooks = append(hooks, tracing.RedisHook())
+		}
+		Redis = config.NewRedis(hooks...)
+	}
+
+	// メモリ上のキャッシュ初期化 ノード毎に保持する
+	var localCache *ILocalCache
+	if Redis != nil && config.UseRedis && config.LocalCacheConfig != nil {
+		localCache = NewLocalCache(Redis, config.LocalCacheConfig, nodeId)
+		localCache.metrics = metrics
+		if err := localCache.Subscribe(background); err != nil {
+			Log.Error(err.Error())
+		}
 	}
 
 	// ES初期化
@@ -196,8 +384,26 @@ func New(config IFiberExConfig) *IFiberEx {
 		if err := mergo.Merge(config.ESConfig, defaultESConfig); err != nil {
 			panic(err)
 		}
+		config.ESConfig.Transport = newTimingTransport(TimingES, config.ESConfig.Transport)
+		if metrics != nil {
+			config.ESConfig.Transport = metrics.InstrumentTransport(config.ESConfig.Transport)
+		}
+		if tracing != nil {
+			config.ESConfig.Transport = tracing.InstrumentTransport(config.ESConfig.Transport)
+		}
 		ES = config.NewES()
 	}
+	if shipper := currentLogShipper(); shipper != nil && ES != nil {
+		shipper.Start(ES)
+	}
+
+	// APIキー認証初期化
+	if config.ApiKeyConfig == nil {
+		config.ApiKeyConfig = &IApiKeyConfig{}
+	}
+	if err := mergo.Merge(config.ApiKeyConfig, defaultApiKeyConfig); err != nil {
+		panic(err)
+	}
 
 	// Validator初期化
 	Validator = validator.New()
@@ -205,20 +411,35 @@ func New(config IFiberExConfig) *IFiberEx {
 		panic(err)
 	}
 
-	// uuid
-	obj, err := uuid.NewRandom()
-	if err != nil {
-		panic(err)
+	Ex = &IFiberEx{
+		NodeId:     nodeId,
+		Config:     config,
+		Log:        Log,
+		DB:         DB,
+		Redis:      Redis,
+		LocalCache: localCache,
+		ES:         ES,
+		Metrics:    metrics,
+		Tracing:    tracing,
+		Reporter:   reporter,
+		Validator:  Validator,
+	}
+	// 他ノードからのログレベル変更を受信する
+	if Redis != nil && config.UseRedis {
+		if err := Ex.SubscribeLogLevel(background); err != nil {
+			Log.Error(err.Error())
+		}
 	}
 
-	Ex = &IFiberEx{
-		NodeId:    obj.String(),
-		Config:    config,
-		Log:       Log,
-		DB:        DB,
-		Redis:     Redis,
-		ES:        ES,
-		Validator: Validator,
+	// 起動時のマイグレーション 複数ノードで同時に起動してもロックで1台のみ実行する
+	if config.UseDB && config.MigrateConfig.AutoMigrate {
+		migrator, err := Ex.NewMigrator()
+		if err != nil {
+			panic(err)
+		}
+		if _, err := migrator.Up(background); err != nil {
+			panic(err)
+		}
 	}
 	return Ex
 }
@@ -237,14 +458,21 @@ func (p *IFiberEx) NewApp() *fiber.App {
 		BodyLimit:        *p.Config.BodyLimit,
 	})
 
-	app.Use(recover.New())
+	app.Use(p.Recover())
+	if p.Metrics != nil {
+		app.Use(p.Metrics.Middleware())
+		app.Get(p.Config.MetricsConfig.Path, p.Metrics.Handler())
+	}
+	if p.Tracing != nil {
+		app.Use(p.Tracing.Middleware())
+	}
 	app.Use(p.MetaMiddleware())
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: *p.Config.CorsOrigin,
 		AllowHeaders: *p.Config.CorsHeaders,
 	}))
 	app.Use(requestid.New())
-	app.Use(zapLogger(p.Log))
+	app.Use(zapLogger(ComponentLog(LogComponentHttp), p.Config.AccessLog, p.Config.LogConfig))
 	if p.Config.IconFile != nil && p.Config.IconUrl != nil {
 		app.Use(favicon.New(favicon.Config{
 			File: *p.Config.IconFile,
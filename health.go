@@ -0,0 +1,80 @@
+package gofiber_extend
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	ReadinessOk       = "ok"
+	ReadinessDegraded = "degraded" // レプリカが停止しているがプライマリで処理できる
+	ReadinessError    = "error"
+)
+
+type IReadiness struct {
+	Status   string            `json:"status"`
+	Checks   map[string]string `json:"checks"`
+	Replicas []IReplicaStatus  `json:"replicas,omitempty"`
+}
+
+// 使用しているDB/Redis/ESへの疎通を確認する
+func (p *IFiberEx) CheckReadiness(ctx context.Context) *IReadiness {
+	rs := &IReadiness{Status: ReadinessOk, Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			rs.Status = ReadinessError
+			rs.Checks[name] = err.Error()
+			return
+		}
+		rs.Checks[name] = ReadinessOk
+	}
+	if p.Config.UseDB && DB != nil {
+		sqlDB, err := DB.DB()
+		if err == nil {
+			err = sqlDB.PingContext(ctx)
+		}
+		check("db", err)
+	}
+	if p.Config.UseRedis && p.Redis != nil {
+		check("redis", p.Redis.Ping(ctx).Err())
+	}
+	if p.Config.UseES && p.ES != nil {
+		res, err := p.ES.Ping(p.ES.Ping.WithContext(ctx))
+		if err == nil {
+			res.Body.Close()
+			if res.IsError() {
+				err = fiber.NewError(res.StatusCode, res.Status())
+			}
+		}
+		check("es", err)
+	}
+	if dbReplicas != nil {
+		rs.Replicas = dbReplicas.statuses()
+		for _, replica := range rs.Replicas {
+			if !replica.Healthy && rs.Status == ReadinessOk {
+				rs.Status = ReadinessDegraded
+			}
+		}
+	}
+	return rs
+}
+
+// readinessのハンドラ 停止している依存先がある場合は503
+// レプリカのみ停止している場合はdegradedとして200を返す
+func (p *IFiberEx) Readiness(timeout ...time.Duration) func(*fiber.Ctx) error {
+	limit := 3 * time.Second
+	if len(timeout) > 0 {
+		limit = timeout[0]
+	}
+	return func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), limit)
+		defer cancel()
+		rs := p.CheckReadiness(ctx)
+		if rs.Status == ReadinessError {
+			return p.Result(c, 503, rs)
+		}
+		return p.Result(c, 200, rs)
+	}
+}
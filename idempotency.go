@@ -0,0 +1,148 @@
+package gofiber_extend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/imdario/mergo"
+	"golang.org/x/exp/slices"
+)
+
+type IIdempotencyConfig struct {
+	Header      string        // 冪等キーのヘッダ名
+	Methods     []string      // 対象とするメソッド
+	TTL         time.Duration // レスポンスの保持期間
+	LockTimeout time.Duration // 処理中ロックの最大保持期間
+	Prefix      string        // redisキーのプレフィックス
+}
+
+var defaultIdempotencyConfig *IIdempotencyConfig = &IIdempotencyConfig{
+	Header:      "Idempotency-Key",
+	Methods:     []string{fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete},
+	TTL:         24 * time.Hour,
+	LockTimeout: 30 * time.Second,
+	Prefix:      "idempotency:",
+}
+
+// 保存されたレスポンス
+type IIdempotencyRecord struct {
+	Fingerprint string            `json:"fingerprint"`
+	Status      int               `json:"status"`
+	Headers     map[string]string `json:"headers"`
+	Body        []byte            `json:"body"`
+}
+
+// 再送時に保存済みのレスポンスを返却したことを示すヘッダ
+const IdempotencyReplayedHeader = "Idempotent-Replayed"
+
+// 保存しないレスポンスヘッダ
+var idempotencySkipHeaders = []string{
+	fiber.HeaderDate,
+	fiber.HeaderServer,
+	fiber.HeaderContentLength,
+	fiber.HeaderConnection,
+}
+
+func idempotencyFingerprint(c *fiber.Ctx) string {
+	sum := sha256.New()
+	sum.Write([]byte(c.Method()))
+	sum.Write([]byte("\n"))
+	sum.Write([]byte(c.OriginalURL()))
+	sum.Write([]byte("\n"))
+	sum.Write(c.Body())
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// Idempotency-Keyヘッダによる重複リクエストの抑止
+// 同じキーのリクエストには最初のレスポンスを再送する
+func (p *IFiberEx) IdempotencyMiddleware(config ...IIdempotencyConfig) func(*fiber.Ctx) error {
+	conf := IIdempotencyConfig{}
+	if len(config) > 0 {
+		conf = config[0]
+	}
+	if err := mergo.Merge(&conf, defaultIdempotencyConfig); err != nil {
+		panic(err)
+	}
+	return func(c *fiber.Ctx) error {
+		key := c.Get(conf.Header)
+		if key == "" || !slices.Contains(conf.Methods, c.Method()) {
+			return c.Next()
+		}
+		userid, _ := c.Locals("userid").(string)
+		recordKey := conf.Prefix + userid + ":" + key
+		lockKey := recordKey + ":lock"
+		fingerprint := idempotencyFingerprint(c)
+
+		// 保存済みのレスポンスを返す
+		replay := func() (bool, error) {
+			record := &IIdempotencyRecord{}
+			if err := p.GetRedisJson(record, recordKey); err != nil {
+				return true, p.ResultError(c, 500, err, E99999.Errors()...)
+			}
+			if record.Fingerprint == "" {
+				return false, nil
+			}
+			if record.Fingerprint != fingerprint {
+				return true, p.ResultError(c, 422, fmt.Errorf("idempotency key reused: %s", key), E42201.Errors()...)
+			}
+			for name, value := range record.Headers {
+				c.Set(name, value)
+			}
+			c.Set(IdempotencyReplayedHeader, "true")
+			return true, c.Status(record.Status).Send(record.Body)
+		}
+		if done, err := replay(); done || err != nil {
+			return err
+		}
+
+		// 処理中のリクエストをロック 他のリクエストのロックを解除しないようにリクエスト毎の値を設定する
+		token, err := randomHex(16)
+		if err != nil {
+			return p.ResultError(c, 500, err, E99999.Errors()...)
+		}
+		ok, err := p.Redis.SetNX(background, lockKey, token, conf.LockTimeout).Result()
+		if err != nil {
+			return p.ResultError(c, 500, err, E99999.Errors()...)
+		}
+		if !ok {
+			return p.ResultError(c, 409, fmt.Errorf("idempotency key in progress: %s", key), E40901.Errors()...)
+		}
+		defer func() {
+			if err := redisUnlockScript.Run(background, p.Redis, []string{lockKey}, token).Err(); err != nil {
+				p.Log.Error(err.Error())
+			}
+		}()
+		// 確認からロックまでの間に完了したリクエストのレスポンス
+		if done, err := replay(); done || err != nil {
+			return err
+		}
+
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		// サーバエラーは再試行できるように保存しない
+		status := c.Response().StatusCode()
+		if status >= 500 {
+			return nil
+		}
+		record := &IIdempotencyRecord{
+			Fingerprint: fingerprint,
+			Status:      status,
+			Headers:     map[string]string{},
+			Body:        c.Response().Body(),
+		}
+		c.Response().Header.VisitAll(func(name []byte, value []byte) {
+			if !slices.Contains(idempotencySkipHeaders, string(name)) {
+				record.Headers[string(name)] = string(value)
+			}
+		})
+		if err := p.SetRedisJson(recordKey, record, conf.TTL); err != nil {
+			p.Log.Error(err.Error())
+		}
+		return nil
+	}
+}
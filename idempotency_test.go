@@ -0,0 +1,107 @@
+package gofiber_extend_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestIdempotency(t *testing.T) {
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		DevMode:      ext.Bool(true),
+		UseRedis:     true,
+		RedisOptions: &redis.Options{},
+	})
+	count := 0
+	test.Routes(func(app *fiber.App) {
+		app.Post("/orders", test.Ex.IdempotencyMiddleware(), func(c *fiber.Ctx) error {
+			count++
+			return test.Ex.Result(c, 201, map[string]interface{}{"count": count})
+		})
+		// 処理中にロックが期限切れになり、他のリクエストがロックを取得した場合
+		app.Post("/expired", test.Ex.IdempotencyMiddleware(), func(c *fiber.Ctx) error {
+			if err := test.Redis.Set("idempotency:-:expired-1:lock", "other"); err != nil {
+				return err
+			}
+			return test.Ex.Result(c, 201, map[string]interface{}{})
+		})
+	})
+	test.Run("idempotency_key", func() {
+		headers := map[string]string{"Idempotency-Key": "order-1"}
+		body := map[string]interface{}{"item": 1}
+		test.Api("first", &ext.ITestRequest{Method: "POST", Path: "/orders", Headers: headers, Body: body}, 201, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.result.count`,
+			Want:   float64(1),
+		})
+		test.Api("replay", &ext.ITestRequest{Method: "POST", Path: "/orders", Headers: headers, Body: body}, 201, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.result.count`,
+			Want:   float64(1),
+		})
+		test.Api("other_body", &ext.ITestRequest{Method: "POST", Path: "/orders", Headers: headers, Body: map[string]interface{}{"item": 2}}, 422, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.error[0].code`,
+			Want:   "E42201",
+		})
+		test.Api("other_key", &ext.ITestRequest{Method: "POST", Path: "/orders", Headers: map[string]string{"Idempotency-Key": "order-2"}, Body: body}, 201, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.result.count`,
+			Want:   float64(2),
+		})
+	})
+	test.Run("lock", func() {
+		if err := test.Redis.Set("idempotency:-:order-3:lock", "other"); err != nil {
+			t.Fatal(err)
+		}
+		test.Api("in_progress", &ext.ITestRequest{Method: "POST", Path: "/orders", Headers: map[string]string{"Idempotency-Key": "order-3"}, Body: map[string]interface{}{"item": 3}}, 409, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.error[0].code`,
+			Want:   "E40901",
+		})
+		test.Api("expired", &ext.ITestRequest{Method: "POST", Path: "/expired", Headers: map[string]string{"Idempotency-Key": "expired-1"}}, 201, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Want:   "other",
+			Store: func() interface{} {
+				value, _ := test.Redis.Get("idempotency:-:expired-1:lock")
+				return value
+			},
+		})
+	})
+	test.Run("redis_error", func() {
+		// 保存済みのレスポンスを確認できない場合は処理しない
+		test.Ex.Redis.AddHook(failGetHook{})
+		calls := count
+		test.Api("unavailable", &ext.ITestRequest{Method: "POST", Path: "/orders", Headers: map[string]string{"Idempotency-Key": "order-4"}, Body: map[string]interface{}{"item": 4}}, 500, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Path: `$.error[0].code`, Want: "E99999"},
+			{Method: ext.TestMethodEqual, Want: calls, Store: func() interface{} {
+				return count
+			}},
+		}...)
+	})
+}
+
+// GETのみ失敗させる
+type failGetHook struct{}
+
+func (failGetHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (failGetHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == "get" {
+			cmd.SetErr(errors.New("unavailable"))
+			return cmd.Err()
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (failGetHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
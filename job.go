@@ -2,11 +2,13 @@ package gofiber_extend
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
 	"github.com/bamzi/jobrunner"
 	"github.com/jrallison/go-workers"
+	"go.opentelemetry.io/otel/codes"
 	"go.uber.org/zap"
 )
 
@@ -23,15 +25,52 @@ type IJob struct {
 type jobInfo struct{}
 
 func (p jobInfo) Call(queue string, msg *workers.Msg, next func() bool) bool {
+	// エンキュー時のtrace contextを引き継ぐ
+	ctx, span := startJobSpan(queue, msg)
+	jobContexts.Store(msg.Jid(), ctx)
+	defer func() {
+		jobContexts.Delete(msg.Jid())
+		if e := recover(); e != nil {
+			span.SetStatus(codes.Error, fmt.Sprint(e))
+			span.End()
+			panic(e)
+		}
+		span.End()
+	}()
+	log := JobLogger(msg).With(zap.String("jid", msg.Jid()))
 	// 初期化
-	Log.Info(fmt.Sprintf("job start: %s", queue), zap.Any("msg", msg))
+	log.Info(fmt.Sprintf("job start: %s", queue), zap.Any("msg", msg))
 	// 処理
 	ok := next()
 	// 終了処理
-	Log.Info(fmt.Sprintf("job finish: %s", queue), zap.Any("msg", msg))
+	log.Info(fmt.Sprintf("job finish: %s", queue), zap.Any("msg", msg))
 	return ok
 }
 
+// エンキュー時のcontextから引き継いだ情報
+const jobMetaKey = "meta"
+
+// エンキュー時のリクエストIDを付与したlogger
+func JobLogger(msg *workers.Msg) *zap.Logger {
+	if requestid := msg.Get(jobMetaKey).Get("requestid").MustString(); requestid != "" {
+		return ComponentLog(LogComponentJob).With(zap.String("requestid", requestid))
+	}
+	return ComponentLog(LogComponentJob)
+}
+
+// ジョブの処理内でDBやRedisに渡すcontext ジョブのspanを持つ
+func JobContext(msg *workers.Msg) context.Context {
+	ctx := context.Background()
+	if value, ok := jobContexts.Load(msg.Jid()); ok {
+		ctx = value.(context.Context)
+	}
+	if requestid := msg.Get(jobMetaKey).Get("requestid").MustString(); requestid != "" {
+		ctx = ContextWithRequestId(ctx, requestid)
+		ctx = ContextWithLogFields(ctx, zap.String("requestid", requestid))
+	}
+	return ctx
+}
+
 func (p IJob) Run() {
 	if Ex.checkCronNode() { // cronはシングルノードで動作するようにチェックする
 		Log.Info("scheduled job start", zap.Any("job", p))
@@ -51,6 +90,12 @@ func (p *IFiberEx) NewJob(jobs ...*IJob) {
 		"process":  fmt.Sprintf("%d", p.Config.JobProcess),
 	})
 	workers.Middleware.Append(&jobInfo{})
+	if p.Metrics != nil {
+		p.Metrics.InstrumentJob()
+	}
+	if p.Reporter != nil {
+		workers.Middleware.Append(&errorReportJob{reporter: p.Reporter})
+	}
 
 	// cron実行のためのnode登録
 	if err := Redis.Set(context.Background(), cronActiveNodeKey, p.NodeId, time.Duration(0)).Err(); err != nil {
@@ -68,29 +113,125 @@ func (p *IFiberEx) NewJob(jobs ...*IJob) {
 	}
 }
 
+// workers.Runの終了 JobStopで待つ
+var jobRunning chan struct{}
+
 func (p *IFiberEx) JobRun(jobs ...IJob) {
-	go workers.Run()
+	workers.Start() // JobStopが開始前に呼ばれても停止できるように同期で開始する
+	done := make(chan struct{})
+	jobRunning = done
+	go func() {
+		defer close(done)
+		workers.Run()
+	}()
+}
+
+// ジョブの実行とcronを停止し、登録したジョブを破棄する
+// 再度NewJobとJobRunで開始できる
+func (p *IFiberEx) JobStop() {
+	if jobrunner.MainCron != nil {
+		jobrunner.MainCron.Stop()
+	}
+	workers.Quit()
+	if jobRunning != nil {
+		<-jobRunning
+		jobRunning = nil
+	}
+	if err := workers.ResetManagers(); err != nil {
+		p.Log.Error(err.Error())
+	}
+}
+
+// go-workersのメッセージにcontextの情報を追加したもの
+type jobEnqueueData struct {
+	workers.EnqueueData
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// workers.EnqueueWithOptionsと同じ形式でメタ情報を付与してエンキューする
+func (p *IFiberEx) jobEnqueue(ctx context.Context, queue string, class string, args interface{}, at float64) (string, error) {
+	data, err := newJobEnqueueData(ctx, queue, class, args, at)
+	if err != nil {
+		return "", err
+	}
+	return data.Jid, jobPush(data)
+}
+
+func newJobEnqueueData(ctx context.Context, queue string, class string, args interface{}, at float64) (*jobEnqueueData, error) {
+	jid, err := randomHex(12)
+	if err != nil {
+		return nil, err
+	}
+	data := &jobEnqueueData{
+		EnqueueData: workers.EnqueueData{
+			Queue:          queue,
+			Class:          class,
+			Args:           args,
+			Jid:            jid,
+			EnqueueOptions: workers.EnqueueOptions{At: at},
+		},
+		Meta: map[string]string{},
+	}
+	if requestid := RequestIdFromContext(ctx); requestid != "" {
+		data.Meta["requestid"] = requestid
+	}
+	injectJobTrace(ctx, data.Meta)
+	return data, nil
+}
+
+func jobPush(data *jobEnqueueData) error {
+	now := float64(time.Now().UnixNano()) / workers.NanoSecondPrecision
+	data.EnqueuedAt = now
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	conn := workers.Config.Pool.Get()
+	defer conn.Close()
+	if now < data.At {
+		_, err := conn.Do("zadd", workers.Config.Namespace+workers.SCHEDULED_JOBS_KEY, data.At, value)
+		return err
+	}
+	if _, err := conn.Do("sadd", workers.Config.Namespace+"queues", data.Queue); err != nil {
+		return err
+	}
+	_, err = conn.Do("rpush", workers.Config.Namespace+"queue:"+data.Queue, value)
+	return err
 }
 
 func (p *IFiberEx) JobEnqueue(queue string, class string, args interface{}) error {
-	if _, err := workers.Enqueue(queue, class, args); err != nil {
-		p.Log.Error(err.Error(), zap.String("name", queue), zap.String("class", class), zap.Any("args", args))
+	return p.JobEnqueueContext(background, queue, class, args)
+}
+
+func (p *IFiberEx) JobEnqueueIn(queue string, class string, in float64, args interface{}) error {
+	return p.JobEnqueueInContext(background, queue, class, in, args)
+}
+
+func (p *IFiberEx) JobEnqueueAt(queue string, class string, at time.Time, args interface{}) error {
+	return p.JobEnqueueAtContext(background, queue, class, at, args)
+}
+
+// contextのリクエストIDを引き継いでエンキューする
+func (p *IFiberEx) JobEnqueueContext(ctx context.Context, queue string, class string, args interface{}) error {
+	if _, err := p.jobEnqueue(ctx, queue, class, args, float64(time.Now().UnixNano())/workers.NanoSecondPrecision); err != nil {
+		ComponentLoggerFromContext(ctx, LogComponentJob).Error(err.Error(), zap.String("name", queue), zap.String("class", class), zap.Any("args", args))
 		return err
 	}
 	return nil
 }
 
-func (p *IFiberEx) JobEnqueueIn(queue string, class string, in float64, args interface{}) error {
-	if _, err := workers.EnqueueIn(queue, class, in, args); err != nil {
-		p.Log.Error(err.Error(), zap.String("name", queue), zap.String("class", class), zap.Float64("in", in), zap.Any("args", args))
+func (p *IFiberEx) JobEnqueueInContext(ctx context.Context, queue string, class string, in float64, args interface{}) error {
+	if _, err := p.jobEnqueue(ctx, queue, class, args, float64(time.Now().UnixNano())/workers.NanoSecondPrecision+in); err != nil {
+		ComponentLoggerFromContext(ctx, LogComponentJob).Error(err.Error(), zap.String("name", queue), zap.String("class", class), zap.Float64("in", in), zap.Any("args", args))
 		return err
 	}
 	return nil
 }
 
-func (p *IFiberEx) JobEnqueueAt(queue string, class string, at time.Time, args interface{}) error {
-	if _, err := workers.EnqueueAt(queue, class, at, args); err != nil {
-		p.Log.Error(err.Error(), zap.String("name", queue), zap.String("class", class), zap.String("at", at.String()), zap.Any("args", args))
+func (p *IFiberEx) JobEnqueueAtContext(ctx context.Context, queue string, class string, at time.Time, args interface{}) error {
+	if _, err := p.jobEnqueue(ctx, queue, class, args, float64(at.UnixNano())/workers.NanoSecondPrecision); err != nil {
+		ComponentLoggerFromContext(ctx, LogComponentJob).Error(err.Error(), zap.String("name", queue), zap.String("class", class), zap.String("at", at.String()), zap.Any("args", args))
 		return err
 	}
 	return nil
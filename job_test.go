@@ -99,3 +99,44 @@ func TestSchedule(t *testing.T) {
 		})
 	})
 }
+
+func TestJobContext(t *testing.T) {
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		DevMode:      ext.Bool(true),
+		UseRedis:     true,
+		RedisOptions: &redis.Options{},
+		JobDatabase:  0,
+	})
+	job3 := &ext.IJob{
+		Name: "test_context",
+		Proc: func(msg *workers.Msg) {
+			ctx := ext.JobContext(msg)
+			if err := test.Ex.Redis.Set(ctx, "test_job_3", ext.RequestIdFromContext(ctx), time.Duration(1*time.Hour)).Err(); err != nil {
+				ext.JobLogger(msg).Error(err.Error())
+			}
+		},
+		Concurrency: 1,
+		Class:       "test_class",
+	}
+	test.Ex.NewJob(job3)
+	test.Ex.JobRun()
+	test.Run("enqueue_context", func() {
+		test.Job("test_request_id", func() {}, func() {
+			ctx := ext.ContextWithRequestId(context.TODO(), "req-job")
+			if err := test.Ex.JobEnqueueContext(ctx, job3.Name, job3.Class, nil); err != nil {
+				t.Error(err)
+			}
+		}, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Want:   "req-job",
+			Store: func() interface{} {
+				time.Sleep(time.Second * 1) // 非同期処理のためsleepを入れる
+				value, err := test.Redis.Get("test_job_3")
+				if err != nil {
+					t.Error(err)
+				}
+				return value
+			},
+		})
+	})
+}
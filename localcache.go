@@ -0,0 +1,295 @@
+package gofiber_extend
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/imdario/mergo"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type ILocalCacheConfig struct {
+	MaxEntries int           // 保持する最大件数
+	MaxBytes   int           // 保持する最大サイズ(キーと値のバイト数)
+	TTL        time.Duration // 保持期間 無効化の通知を受信できなかった場合もこの期間で読み直す
+	Channel    string        // 無効化を通知するredisのチャンネル
+}
+
+var defaultLocalCacheConfig *ILocalCacheConfig = &ILocalCacheConfig{
+	MaxEntries: 10000,
+	MaxBytes:   64 << 20,
+	TTL:        time.Minute,
+	Channel:    "cache:invalidate",
+}
+
+// 他ノードへの無効化の通知
+type ILocalCacheInvalidation struct {
+	NodeId string   `json:"node_id"`
+	Keys   []string `json:"keys"`
+}
+
+type localCacheEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func (p *localCacheEntry) size() int {
+	return len(p.key) + len(p.value)
+}
+
+// redisの前段のメモリ上のLRUキャッシュ
+// 更新・削除はpub/subで全ノードに通知し、各ノードのキャッシュを無効化する
+type ILocalCache struct {
+	redis      *redis.Client
+	config     *ILocalCacheConfig
+	nodeId     string
+	metrics    *IMetrics
+	mutex      sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List // 先頭が最近使用したもの
+	size       int
+	generation int64 // 無効化の度に増やす 読み込み中に無効化された値を保持しないようにする
+	// 購読の停止
+	cancels    []context.CancelFunc
+	subscribed sync.WaitGroup
+}
+
+// 他ノードの無効化を受信するにはSubscribeを呼び出す New()ではLocalCacheConfigを指定すると呼び出される
+func NewLocalCache(client *redis.Client, config *ILocalCacheConfig, nodeId string) *ILocalCache {
+	if err := mergo.Merge(config, defaultLocalCacheConfig); err != nil {
+		panic(err)
+	}
+	return &ILocalCache{
+		redis:   client,
+		config:  config,
+		nodeId:  nodeId,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+func (p *ILocalCache) get(key string) ([]byte, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	elem, ok := p.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*localCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		p.remove(elem)
+		return nil, false
+	}
+	p.lru.MoveToFront(elem)
+	return entry.value, true
+}
+
+// generationが取得時から変わっていない場合のみ保持する
+func (p *ILocalCache) set(key string, value []byte, ttl time.Duration, generation int64) {
+	if ttl <= 0 || ttl > p.config.TTL {
+		ttl = p.config.TTL
+	}
+	entry := &localCacheEntry{key: key, value: value, expiresAt: time.Now().Add(ttl)}
+	if entry.size() > p.config.MaxBytes {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if atomic.LoadInt64(&p.generation) != generation {
+		return
+	}
+	if elem, ok := p.entries[key]; ok {
+		p.remove(elem)
+	}
+	p.entries[key] = p.lru.PushFront(entry)
+	p.size += entry.size()
+	for len(p.entries) > p.config.MaxEntries || p.size > p.config.MaxBytes {
+		p.remove(p.lru.Back())
+		if p.metrics != nil {
+			p.metrics.CacheEvicted("size")
+		}
+	}
+}
+
+// mutexを取得して呼び出す
+func (p *ILocalCache) remove(elem *list.Element) {
+	entry := p.lru.Remove(elem).(*localCacheEntry)
+	delete(p.entries, entry.key)
+	p.size -= entry.size()
+}
+
+// このノードのキャッシュを削除する
+func (p *ILocalCache) evict(keys ...string) {
+	atomic.AddInt64(&p.generation, 1)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, key := range keys {
+		if elem, ok := p.entries[key]; ok {
+			p.remove(elem)
+			if p.metrics != nil {
+				p.metrics.CacheEvicted("invalidate")
+			}
+		}
+	}
+}
+
+func (p *ILocalCache) observe(tier string, hit bool) {
+	if p.metrics != nil {
+		p.metrics.CacheRequest(tier, hit)
+	}
+}
+
+// 保持している件数
+func (p *ILocalCache) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.entries)
+}
+
+// json型から変換して取得 メモリにない場合はredisから取得して保持する
+// 存在しない場合はrsを変更せずnilを返す
+func (p *ILocalCache) GetJson(ctx context.Context, rs interface{}, key string) error {
+	if value, ok := p.get(key); ok {
+		p.observe("local", true)
+		return json.Unmarshal(value, rs)
+	}
+	p.observe("local", false)
+	generation := atomic.LoadInt64(&p.generation)
+	pipe := p.redis.Pipeline()
+	get := pipe.Get(ctx, key)
+	ttl := pipe.PTTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return err
+	}
+	if get.Err() == redis.Nil {
+		p.observe("redis", false)
+		return nil
+	}
+	p.observe("redis", true)
+	value, _ := get.Bytes()
+	p.set(key, value, ttl.Val(), generation)
+	return json.Unmarshal(value, rs)
+}
+
+// json型に変換してredisに保存し、他ノードのキャッシュを無効化する
+func (p *ILocalCache) SetJson(ctx context.Context, key string, src interface{}, expire time.Duration) error {
+	value, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	if err := p.redis.Set(ctx, key, value, expire).Err(); err != nil {
+		return err
+	}
+	p.evict(key)
+	p.set(key, value, expire, atomic.LoadInt64(&p.generation))
+	return p.publish(ctx, key)
+}
+
+// redisから削除し、全ノードのキャッシュを無効化する
+func (p *ILocalCache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := p.redis.Del(ctx, keys...).Err(); err != nil {
+		return err
+	}
+	p.evict(keys...)
+	return p.publish(ctx, keys...)
+}
+
+// 全ノードのキャッシュを無効化する SetRedisJson等でredisを直接更新した場合に使用する
+func (p *ILocalCache) Invalidate(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	p.evict(keys...)
+	return p.publish(ctx, keys...)
+}
+
+func (p *ILocalCache) publish(ctx context.Context, keys ...string) error {
+	value, err := json.Marshal(&ILocalCacheInvalidation{NodeId: p.nodeId, Keys: keys})
+	if err != nil {
+		return err
+	}
+	return p.redis.Publish(ctx, p.config.Channel, value).Err()
+}
+
+// 他ノードからの無効化を受信する 購読の完了を待って返す
+// ctxの終了またはCloseで購読を停止する
+func (p *ILocalCache) Subscribe(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	p.mutex.Lock()
+	p.cancels = append(p.cancels, cancel)
+	p.mutex.Unlock()
+	sub := p.redis.Subscribe(ctx, p.config.Channel)
+	_, err := sub.Receive(ctx)
+	p.subscribed.Add(1)
+	go func() {
+		defer p.subscribed.Done()
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			var msg *redis.Message
+			select {
+			case <-ctx.Done():
+				return
+			case received, ok := <-ch:
+				if !ok {
+					return
+				}
+				msg = received
+			}
+			invalidation := &ILocalCacheInvalidation{}
+			if err := json.Unmarshal([]byte(msg.Payload), invalidation); err != nil {
+				ComponentLog(LogComponentRedis).Error(err.Error(), zap.String("channel", msg.Channel))
+				continue
+			}
+			if invalidation.NodeId == p.nodeId {
+				continue
+			}
+			p.evict(invalidation.Keys...)
+		}
+	}()
+	return err
+}
+
+// 購読を停止し、受信処理の終了を待つ
+func (p *ILocalCache) Close() {
+	p.mutex.Lock()
+	cancels := p.cancels
+	p.cancels = nil
+	p.mutex.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+	p.subscribed.Wait()
+}
+
+// LocalCacheConfigを指定した場合はメモリ上のキャッシュを経由してredisから取得する
+func (p *IFiberEx) GetCachedJson(rs interface{}, key string) error {
+	if p.LocalCache == nil {
+		return p.GetRedisJson(rs, key)
+	}
+	return p.LocalCache.GetJson(background, rs, key)
+}
+
+// LocalCacheConfigを指定した場合は全ノードのメモリ上のキャッシュを無効化する
+func (p *IFiberEx) SetCachedJson(key string, src interface{}, expire time.Duration) error {
+	if p.LocalCache == nil {
+		return p.SetRedisJson(key, src, expire)
+	}
+	return p.LocalCache.SetJson(background, key, src, expire)
+}
+
+func (p *IFiberEx) DeleteCachedJson(keys ...string) error {
+	if p.LocalCache == nil {
+		return p.Redis.Del(background, keys...).Err()
+	}
+	return p.LocalCache.Delete(background, keys...)
+}
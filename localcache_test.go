@@ -0,0 +1,163 @@
+package gofiber_extend_test
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"github.com/redis/go-redis/v9"
+)
+
+type localCacheValue struct {
+	Name string `json:"name"`
+}
+
+func TestLocalCache(t *testing.T) {
+	ext.Metrics = nil
+	defer func() { ext.Metrics = nil }()
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		UseRedis:         true,
+		RedisOptions:     &redis.Options{},
+		UseMetrics:       true,
+		LocalCacheConfig: &ext.ILocalCacheConfig{MaxEntries: 2},
+	})
+	ctx := context.Background()
+	// 別のノード
+	other := ext.NewLocalCache(test.Ex.Redis, &ext.ILocalCacheConfig{}, "other")
+	if err := other.Subscribe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(other.Close)
+	get := func(cache *ext.ILocalCache, key string) func() interface{} {
+		return func() interface{} {
+			value := &localCacheValue{}
+			if err := cache.GetJson(ctx, value, key); err != nil {
+				return err
+			}
+			return value.Name
+		}
+	}
+	// pub/subの受信を待つ
+	wait := func(cache *ext.ILocalCache, n int) func() interface{} {
+		return func() interface{} {
+			for i := 0; i < 100 && cache.Len() != n; i++ {
+				time.Sleep(5 * time.Millisecond)
+			}
+			return cache.Len()
+		}
+	}
+	metrics := func(pattern string) func() interface{} {
+		return func() interface{} {
+			res, err := test.App.Test(httptest.NewRequest("GET", "/metrics", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return regexp.MustCompile(pattern).Match(body)
+		}
+	}
+
+	test.Run("local", func() {
+		test.Job("set", func() {}, func() {
+			if err := test.Ex.SetCachedJson("config:a", &localCacheValue{Name: "a"}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			// redisを直接変更してもメモリ上の値を返す
+			if err := test.Ex.SetRedisJson("config:a", &localCacheValue{Name: "changed"}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: "a", Store: get(test.Ex.LocalCache, "config:a")},
+			{Method: ext.TestMethodEqual, Want: "changed", Store: get(other, "config:a")},
+			{Method: ext.TestMethodEqual, Want: "", Store: get(test.Ex.LocalCache, "config:none")},
+			{Method: ext.TestMethodEqual, Want: true, Store: metrics(`app_cache_requests_total\{[^}]*result="hit",tier="local"\} 1\n`)},
+			{Method: ext.TestMethodEqual, Want: true, Store: metrics(`app_cache_requests_total\{[^}]*result="miss",tier="redis"\} 1\n`)},
+		}...)
+	})
+	test.Run("invalidate", func() {
+		test.Job("other_node", func() {
+			if err := test.Ex.SetRedisJson("config:b", &localCacheValue{Name: "old"}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if name := get(other, "config:b")(); name != "old" {
+				t.Fatalf("other: %v", name)
+			}
+		}, func() {
+			if err := test.Ex.SetCachedJson("config:b", &localCacheValue{Name: "new"}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}, []*ext.ITestCase{
+			// config:aのみ残る
+			{Method: ext.TestMethodEqual, Want: 1, Store: wait(other, 1)},
+			{Method: ext.TestMethodEqual, Want: "new", Store: get(other, "config:b")},
+			// 自ノードの通知では削除しない
+			{Method: ext.TestMethodEqual, Want: "new", Store: func() interface{} {
+				time.Sleep(20 * time.Millisecond)
+				if err := test.Ex.Redis.Del(ctx, "config:b").Err(); err != nil {
+					return err
+				}
+				return get(test.Ex.LocalCache, "config:b")()
+			}},
+		}...)
+		test.Job("delete", func() {}, func() {
+			if err := other.Delete(ctx, "config:b"); err != nil {
+				t.Fatal(err)
+			}
+		}, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: 1, Store: wait(test.Ex.LocalCache, 1)},
+			{Method: ext.TestMethodEqual, Want: "", Store: get(test.Ex.LocalCache, "config:b")},
+		}...)
+	})
+	test.Run("size", func() {
+		test.Job("lru", func() {}, func() {
+			for _, key := range []string{"config:c", "config:d", "config:e"} {
+				if err := test.Ex.SetCachedJson(key, &localCacheValue{Name: key}, time.Minute); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := test.Ex.SetRedisJson("config:c", &localCacheValue{Name: "changed"}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: 2, Store: func() interface{} {
+				return test.Ex.LocalCache.Len()
+			}},
+			// 古いものから削除されるためredisから取得する
+			{Method: ext.TestMethodEqual, Want: "changed", Store: get(test.Ex.LocalCache, "config:c")},
+			{Method: ext.TestMethodEqual, Want: true, Store: metrics(`app_cache_evictions_total\{[^}]*reason="size"\} [1-9]`)},
+		}...)
+	})
+	test.Run("close", func() {
+		// 購読を停止すると無効化を受信しない
+		subscribers := func() interface{} {
+			for i := 0; i < 100 && test.Redis.PubSubNumSub("cache:invalidate")["cache:invalidate"] != 1; i++ {
+				time.Sleep(5 * time.Millisecond)
+			}
+			return test.Redis.PubSubNumSub("cache:invalidate")["cache:invalidate"]
+		}
+		test.Job("unsubscribe", func() {
+			if err := test.Ex.SetRedisJson("config:f", &localCacheValue{Name: "old"}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if name := get(other, "config:f")(); name != "old" {
+				t.Fatalf("other: %v", name)
+			}
+		}, func() {
+			other.Close()
+			if err := test.Ex.SetCachedJson("config:f", &localCacheValue{Name: "new"}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: 1, Store: subscribers},
+			{Method: ext.TestMethodEqual, Want: "old", Store: get(other, "config:f")},
+		}...)
+	})
+}
@@ -1,14 +1,515 @@
 package gofiber_extend
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/imdario/mergo"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func zapLogger(logger *zap.Logger) func(c *fiber.Ctx) error {
+const (
+	LogComponentHttp  = "http"
+	LogComponentDB    = "db"
+	LogComponentRedis = "redis"
+	LogComponentJob   = "job"
+	LogComponentMail  = "mail"
+)
+
+const (
+	AccessFormatZap      = "zap"      // api.requestとして構造化ログを出力する
+	AccessFormatCombined = "combined" // Apache combined形式
+)
+
+type ILogConfig struct {
+	Level             string            // debug/info/warn/error 未指定の場合はDevModeで切り替え
+	Levels            map[string]string // コンポーネント毎のレベル http/db/redis/job/mail
+	Encoding          string            // console/json 未指定の場合はDevModeで切り替え
+	OutputPaths       []string          // stdout/stderr/ファイルパス
+	AccessFormat      string            // アクセスログの形式
+	AccessOutputPaths []string          // combined形式の出力先 未指定の場合はOutputPaths
+	Rotation          *ILogRotation     // ファイル出力時のローテーション
+	Sampling          *ILogSampling     // 同一メッセージの間引き
+	SampleRoutes      map[string]int    // ルート(テンプレート)毎にN件に1件だけアクセスログを出力する
+	LevelTTL          time.Duration     // 実行時に変更したレベルを戻すまでの時間
+	LevelChannel      string            // レベル変更を通知するredisのチャンネル
+	ES                *ILogESConfig     // elasticsearchへの送信 UseESの場合のみ
+}
+
+type ILogRotation struct {
+	MaxSize    int           // ローテーションするサイズ(MB)
+	MaxAge     int           // 保持日数
+	MaxBackups int           // 保持世代数
+	Compress   bool          // gzip圧縮
+	Interval   time.Duration // 時間でのローテーション間隔
+}
+
+type ILogSampling struct {
+	Tick       time.Duration
+	Initial    int // Tick内で最初に出力する件数
+	Thereafter int // 以降はN件に1件出力する
+}
+
+var defaultLogConfig *ILogConfig = &ILogConfig{
+	OutputPaths:  []string{"stderr"},
+	AccessFormat: AccessFormatZap,
+	LevelTTL:     10 * time.Minute,
+	LevelChannel: "log:level",
+}
+
+// コンポーネント毎のlogger
+var logComponents = map[string]*zap.Logger{}
+
+// combined形式のアクセスログの出力先
+var accessLog *zap.Logger
+
+// 時間でのローテーションを停止する NewLoggerで置き換えた場合に前のものを停止する
+var logRotationCancel func()
+
+// ctxの終了でローテーションを停止する 停止したらrunningを減らす
+func logWriter(ctx context.Context, running *sync.WaitGroup, paths []string, rotation *ILogRotation) zapcore.WriteSyncer {
+	writers := []zapcore.WriteSyncer{}
+	for _, path := range paths {
+		if rotation == nil || path == "stdout" || path == "stderr" {
+			writer, _, err := zap.Open(path)
+			if err != nil {
+				panic(err)
+			}
+			writers = append(writers, writer)
+			continue
+		}
+		file := &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    rotation.MaxSize,
+			MaxAge:     rotation.MaxAge,
+			MaxBackups: rotation.MaxBackups,
+			Compress:   rotation.Compress,
+			LocalTime:  true,
+		}
+		if rotation.Interval > 0 {
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				ticker := time.NewTicker(rotation.Interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+						if err := file.Rotate(); err != nil {
+							fmt.Fprintln(os.Stderr, err)
+						}
+					}
+				}
+			}()
+		}
+		writers = append(writers, zapcore.AddSync(file))
+	}
+	return zapcore.Lock(zapcore.NewMultiWriteSyncer(writers...))
+}
+
+func parseLogLevel(text string) zapcore.Level {
+	level, err := zapcore.ParseLevel(text)
+	if err != nil {
+		panic(err)
+	}
+	return level
+}
+
+// loggerの初期化
+func (p *IFiberExConfig) NewLogger() *zap.Logger {
+	conf := p.LogConfig
+	dev := p.DevMode != nil && *p.DevMode
+	// 作成中は実行中のloggerから参照されないようにローカルで組み立て、最後に置き換える
+	components := map[string]*zap.Logger{}
+	levels := map[string]zap.AtomicLevel{}
+	defaults := map[string]zapcore.Level{}
+	var access *zap.Logger
+	var shipper *esLogShipper
+	rotation, cancelRotation := context.WithCancel(background)
+	var rotating sync.WaitGroup
+	// 実行中のローテーションの終了を待つ
+	cancel := func() {
+		cancelRotation()
+		rotating.Wait()
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	options := []zap.Option{zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel)}
+	if dev {
+		encoderConfig = zap.NewDevelopmentEncoderConfig()
+		options = []zap.Option{zap.AddCaller(), zap.AddStacktrace(zapcore.WarnLevel), zap.Development()}
+	}
+	if conf.Level == "" {
+		conf.Level = "info"
+		if dev {
+			conf.Level = "debug"
+		}
+	}
+	if conf.Encoding == "" {
+		conf.Encoding = "json"
+		if dev {
+			conf.Encoding = "console"
+		}
+	}
+	var encoder zapcore.Encoder
+	switch conf.Encoding {
+	case "console":
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	}
+	writer := logWriter(rotation, &rotating, conf.OutputPaths, conf.Rotation)
+	if conf.ES != nil && p.UseES {
+		if err := mergo.Merge(conf.ES, defaultLogESConfig); err != nil {
+			panic(err)
+		}
+		if conf.ES.Index == "" {
+			conf.ES.Index = "logs-" + strings.ToLower(*p.AppName)
+		}
+		shipper = newESLogShipper(conf.ES) // ESの初期化後に送信を開始する
+	}
+
+	// レベルの判定はlevelCoreで行う
+	newLogger := func(name string, level zapcore.Level) *zap.Logger {
+		core := zapcore.NewCore(encoder, writer, zapcore.DebugLevel)
+		if shipper != nil {
+			core = zapcore.NewTee(core, newESLogCore(shipper))
+		}
+		if conf.Sampling != nil {
+			core = zapcore.NewSamplerWithOptions(core, conf.Sampling.Tick, conf.Sampling.Initial, conf.Sampling.Thereafter)
+		}
+		atomicLevel := zap.NewAtomicLevelAt(level)
+		levels[name] = atomicLevel
+		defaults[name] = level
+		return zap.New(newLevelCore(core, name, atomicLevel), options...)
+	}
+	for name, level := range conf.Levels {
+		components[name] = newLogger(name, parseLogLevel(level)).Named(name)
+	}
+
+	if conf.AccessFormat == AccessFormatCombined {
+		paths := conf.AccessOutputPaths
+		if len(paths) == 0 {
+			paths = conf.OutputPaths
+		}
+		accessEncoder := zapcore.NewConsoleEncoder(zapcore.EncoderConfig{
+			MessageKey: "msg",
+			LineEnding: zapcore.DefaultLineEnding,
+		})
+		access = zap.New(zapcore.NewCore(accessEncoder, logWriter(rotation, &rotating, paths, conf.Rotation), zapcore.DebugLevel))
+	}
+	logger := newLogger("", parseLogLevel(conf.Level))
+
+	logMutex.Lock()
+	if logRotationCancel != nil {
+		logRotationCancel()
+	}
+	previous := logShipper
+	logComponents, logLevels, logDefaults = components, levels, defaults
+	accessLog, logShipper, logRotationCancel = access, shipper, cancel
+	logMutex.Unlock()
+	// 置き換えた送信は残りを送信して停止する
+	if previous != nil {
+		if err := previous.Close(previous.config.Timeout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	return logger
+}
+
+// コンポーネント毎のlogger レベルの指定がない場合は共通のlogger
+func ComponentLog(name string) *zap.Logger {
+	logMutex.RLock()
+	logger, ok := logComponents[name]
+	logMutex.RUnlock()
+	if ok {
+		return logger
+	}
+	return Log.Named(name)
+}
+
+// combined形式のアクセスログの出力先 設定していない場合はnil
+func combinedAccessLog() *zap.Logger {
+	logMutex.RLock()
+	defer logMutex.RUnlock()
+	return accessLog
+}
+
+type IAccessLogConfig struct {
+	RedactFields     []string // マスクするJSON/フォームのフィールド名(大文字小文字を区別しない)
+	RedactHeaders    []string // マスクするヘッダ名
+	RedactPatterns   []string // マスクする正規表現
+	SkipCardNumbers  bool     // クレジットカード番号(Luhnで検証)をマスクしない
+	Mask             string   // マスク後の文字列
+	MaxBodySize      int      // ログに出力するbodyの最大バイト数
+	SkipContentTypes []string // bodyを出力しないContent-Type(前方一致)
+	SkipPaths        []string // bodyを出力しないパス
+	LogHeaders       bool     // リクエストとレスポンスのヘッダを出力する
+	LogResponseBody  bool     // レスポンスbodyを出力する
+}
+
+var defaultAccessLogConfig *IAccessLogConfig = &IAccessLogConfig{
+	RedactFields: []string{
+		"password", "password_confirmation", "secret", "token", "access_token", "refresh_token",
+		"authorization", "card_number", "cvv", "cvc",
+	},
+	RedactHeaders: []string{
+		fiber.HeaderAuthorization, fiber.HeaderCookie, fiber.HeaderSetCookie, ApiKeySignatureHeader,
+	},
+	Mask:        "***",
+	MaxBodySize: 4 * 1024,
+	SkipContentTypes: []string{
+		fiber.MIMEMultipartForm, fiber.MIMEOctetStream, "image/", "audio/", "video/",
+	},
+}
+
+// ルート単位でbodyのログ出力を抑止する
+func (p *IFiberEx) SkipBodyLog() func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		c.Locals("skip_body_log", true)
+		return c.Next()
+	}
+}
+
+// クレジットカード番号の候補 Luhnのチェックディジットが正しいものだけをマスクする
+var cardNumberPattern = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+
+// 切り詰めた位置で番号などが途切れないよう多めに残してマスクする
+const redactBodyMargin = 64
+
+type logRedactor struct {
+	config      *IAccessLogConfig
+	fields      map[string]bool
+	headers     map[string]bool
+	patterns    []*regexp.Regexp
+	fieldValues *regexp.Regexp // 解析できないJSONのフィールド
+}
+
+func newLogRedactor(config *IAccessLogConfig) *logRedactor {
+	rs := &logRedactor{
+		config:  config,
+		fields:  map[string]bool{},
+		headers: map[string]bool{},
+	}
+	names := []string{}
+	for _, field := range config.RedactFields {
+		rs.fields[strings.ToLower(field)] = true
+		names = append(names, regexp.QuoteMeta(field))
+	}
+	if len(names) > 0 {
+		rs.fieldValues = regexp.MustCompile(`(?i)("(?:` + strings.Join(names, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]+)`)
+	}
+	for _, header := range config.RedactHeaders {
+		rs.headers[strings.ToLower(header)] = true
+	}
+	for _, pattern := range config.RedactPatterns {
+		rs.patterns = append(rs.patterns, regexp.MustCompile(pattern))
+	}
+	return rs
+}
+
+// bodyを出力するか
+func (p *logRedactor) skip(c *fiber.Ctx, contentType string) bool {
+	if skip, ok := c.Locals("skip_body_log").(bool); ok && skip {
+		return true
+	}
+	for _, path := range p.config.SkipPaths {
+		if c.Path() == path {
+			return true
+		}
+	}
+	for _, prefix := range p.config.SkipContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *logRedactor) value(src interface{}) interface{} {
+	switch values := src.(type) {
+	case map[string]interface{}:
+		for key, value := range values {
+			if p.fields[strings.ToLower(key)] {
+				values[key] = p.config.Mask
+			} else {
+				values[key] = p.value(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range values {
+			values[i] = p.value(value)
+		}
+	}
+	return src
+}
+
+// Luhnのチェックディジットを検証する
+func luhn(digits string) bool {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		n := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			if n *= 2; n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return sum%10 == 0
+}
+
+// 文字の途中で切れないようにlimitバイト以内に切り詰める
+func truncateString(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	for limit > 0 && !utf8.RuneStart(text[limit]) {
+		limit--
+	}
+	return text[:limit]
+}
+
+// マスクと切り詰めを行う
+// MaxBodySizeを超えるbodyは先頭だけをマスクする
+func (p *logRedactor) Body(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	limit := p.config.MaxBodySize
+	text := string(body)
+	if limit > 0 {
+		text = truncateString(text, limit+redactBodyMargin)
+	}
+	rest := len(body) - len(text)
+	trimmed := strings.TrimSpace(text)
+	switch {
+	case strings.Contains(contentType, "json") || strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "["):
+		var src interface{}
+		if err := json.Unmarshal([]byte(text), &src); err == nil {
+			if rs, err := json.Marshal(p.value(src)); err == nil {
+				text = string(rs)
+			}
+		} else if p.fieldValues != nil {
+			// 切り詰めたJSONはフィールド名で値をマスクする
+			text = p.fieldValues.ReplaceAllString(text, `${1}"`+p.config.Mask+`"`)
+		}
+	case strings.HasPrefix(contentType, fiber.MIMEApplicationForm):
+		if values, err := url.ParseQuery(text); err == nil {
+			for key := range values {
+				if p.fields[strings.ToLower(key)] {
+					values[key] = []string{p.config.Mask}
+				}
+			}
+			text = values.Encode()
+		}
+	}
+	for _, pattern := range p.patterns {
+		text = pattern.ReplaceAllString(text, p.config.Mask)
+	}
+	if !p.config.SkipCardNumbers {
+		text = cardNumberPattern.ReplaceAllStringFunc(text, func(value string) string {
+			if luhn(strings.NewReplacer(" ", "", "-", "").Replace(value)) {
+				return p.config.Mask
+			}
+			return value
+		})
+	}
+	if limit > 0 && (len(text) > limit || rest > 0) {
+		head := truncateString(text, limit)
+		text = fmt.Sprintf("%s...(truncated %d bytes)", head, len(text)-len(head)+rest)
+	}
+	return text
+}
+
+// ログに出力するリクエストのbody パラメータをマスクした場合はそのJSONを返す
+func logRequestBody(c *fiber.Ctx) (string, []byte) {
+	if masked, ok := c.Locals("log_request_body").([]byte); ok {
+		return fiber.MIMEApplicationJSON, masked
+	}
+	return string(c.Request().Header.ContentType()), c.Request().Body()
+}
+
+func (p *logRedactor) Header(name string, value string) string {
+	if p.headers[strings.ToLower(name)] {
+		return p.config.Mask
+	}
+	return value
+}
+
+func (p *IFiberEx) logFields(c *fiber.Ctx) []zap.Field {
+	requestid, _ := c.Locals("requestid").(string)
+	userid, _ := c.Locals("userid").(string)
+	return []zap.Field{
+		zap.String("requestid", requestid),
+		zap.String("userid", userid),
+		zap.String("method", c.Method()),
+		zap.String("path", c.Path()),
+		zap.String("route", c.Route().Path),
+		zap.String("node", p.NodeId),
+	}
+}
+
+// リクエスト情報を付与したlogger
+func (p *IFiberEx) Logger(c *fiber.Ctx) *zap.Logger {
+	return ComponentLog(LogComponentHttp).With(p.logFields(c)...)
+}
+
+// Apache combined形式
+func combinedLog(c *fiber.Ctx, start time.Time) string {
+	userid, _ := c.Locals("userid").(string)
+	if userid == "" {
+		userid = "-"
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %d "%s" "%s"`,
+		c.IP(),
+		userid,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		c.Method(),
+		c.OriginalURL(),
+		string(c.Request().Header.Protocol()),
+		c.Response().StatusCode(),
+		len(c.Response().Body()),
+		c.Get(fiber.HeaderReferer, "-"),
+		c.Get(fiber.HeaderUserAgent, "-"),
+	)
+}
+
+func zapLogger(logger *zap.Logger, config *IAccessLogConfig, logConfig *ILogConfig) func(c *fiber.Ctx) error {
+	redactor := newLogRedactor(config)
+	type sampleRate struct {
+		counter uint64
+		rate    uint64
+	}
+	rates := map[string]*sampleRate{}
+	for route, rate := range logConfig.SampleRoutes {
+		if rate < 1 {
+			panic(fmt.Sprintf("log: SampleRoutes must be 1 or more: %s: %d", route, rate))
+		}
+		rates[route] = &sampleRate{rate: uint64(rate)}
+	}
+	// 高頻度のルートは間引く エラーは常に出力する
+	sampled := func(c *fiber.Ctx) bool {
+		rate, ok := rates[c.Route().Path]
+		if !ok || c.Response().StatusCode() >= 500 {
+			return true
+		}
+		return (atomic.AddUint64(&rate.counter, 1)-1)%rate.rate == 0
+	}
 	return func(c *fiber.Ctx) error {
 		start := time.Now().Local()
 		chainErr := c.Next()
@@ -17,6 +518,20 @@ func zapLogger(logger *zap.Logger) func(c *fiber.Ctx) error {
 		}
 		stop := time.Now().Local()
 
+		if !sampled(c) {
+			return nil
+		}
+		if access := combinedAccessLog(); logConfig.AccessFormat == AccessFormatCombined && access != nil {
+			access.Info(combinedLog(c, start))
+			return nil
+		}
+
+		requestType := string(c.Request().Header.ContentType())
+		body := ""
+		if !redactor.skip(c, requestType) {
+			body = redactor.Body(logRequestBody(c))
+		}
+
 		fields := []zap.Field{
 			zap.Int("pid", os.Getpid()),
 			zap.String("elaps", stop.Sub(start).String()),
@@ -26,7 +541,30 @@ func zapLogger(logger *zap.Logger) func(c *fiber.Ctx) error {
 			zap.Int("status", c.Response().StatusCode()),
 			zap.String("method", c.Method()),
 			zap.String("path", c.Path()),
-			zap.String("body", string(c.Request().Body())),
+			zap.String("body", body),
+		}
+		if config.LogHeaders {
+			headers := map[string]string{}
+			c.Request().Header.VisitAll(func(key []byte, value []byte) {
+				headers[string(key)] = redactor.Header(string(key), string(value))
+			})
+			responseHeaders := map[string]string{}
+			c.Response().Header.VisitAll(func(key []byte, value []byte) {
+				responseHeaders[string(key)] = redactor.Header(string(key), string(value))
+			})
+			fields = append(fields, zap.Any("headers", headers), zap.Any("response_headers", responseHeaders))
+		}
+		if config.LogResponseBody {
+			responseType := string(c.Response().Header.ContentType())
+			response := ""
+			if !redactor.skip(c, responseType) {
+				body := c.Response().Body()
+				if masked, ok := c.Locals("log_response_body").([]byte); ok {
+					body = masked
+				}
+				response = redactor.Body(responseType, body)
+			}
+			fields = append(fields, zap.String("response", response))
 		}
 
 		if chainErr != nil {
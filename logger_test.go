@@ -0,0 +1,312 @@
+package gofiber_extend_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAccessLogRedaction(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	ext.Log = zap.New(core)
+	defer func() { ext.Log = nil }()
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		AccessLog: &ext.IAccessLogConfig{
+			MaxBodySize:     64,
+			LogHeaders:      true,
+			LogResponseBody: true,
+		},
+	})
+	test.Routes(func(app *fiber.App) {
+		app.Post("/login", func(c *fiber.Ctx) error {
+			c.Cookie(&fiber.Cookie{Name: "session", Value: "secret-session"})
+			return test.Ex.Result(c, 200, map[string]interface{}{"token": "secret-token"})
+		})
+		app.Post("/upload", test.Ex.SkipBodyLog(), func(c *fiber.Ctx) error {
+			return test.Ex.Result(c, 200, map[string]interface{}{"status": "ok"})
+		})
+	})
+	accessLog := func() map[string]interface{} {
+		entries := logs.FilterMessage("api.request").AllUntimed()
+		return entries[len(entries)-1].ContextMap()
+	}
+	test.Run("redaction", func() {
+		test.Api("login", &ext.ITestRequest{
+			Method:  "POST",
+			Path:    "/login",
+			Headers: map[string]string{"Authorization": "Bearer abc"},
+			Body:    map[string]interface{}{"user": "foo", "password": "qwerty", "card": "4111 1111 1111 1111"},
+		}, 200, []*ext.ITestCase{
+			{
+				Method: ext.TestMethodEqual,
+				Want:   `{"card":"***","password":"***","user":"foo"}`,
+				Store: func() interface{} {
+					return accessLog()["body"]
+				},
+			},
+			{
+				Method: ext.TestMethodEqual,
+				Want:   "***",
+				Store: func() interface{} {
+					return accessLog()["headers"].(map[string]string)["Authorization"]
+				},
+			},
+			{
+				Method: ext.TestMethodEqual,
+				Want:   "***",
+				Store: func() interface{} {
+					return accessLog()["response_headers"].(map[string]string)["Set-Cookie"]
+				},
+			},
+			{
+				Method: ext.TestMethodEqual,
+				Want:   false,
+				Store: func() interface{} {
+					return strings.Contains(accessLog()["response"].(string), "secret-token")
+				},
+			},
+		}...)
+		test.Api("truncate", &ext.ITestRequest{
+			Method: "POST",
+			Path:   "/login",
+			Body:   strings.Repeat("a", 100),
+		}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Want:   strings.Repeat("a", 64) + "...(truncated 36 bytes)",
+			Store: func() interface{} {
+				return accessLog()["body"]
+			},
+		})
+		// 文字の途中で切らない
+		test.Api("truncate_multibyte", &ext.ITestRequest{
+			Method: "POST",
+			Path:   "/login",
+			Body:   strings.Repeat("あ", 30),
+		}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Want:   strings.Repeat("あ", 21) + "...(truncated 27 bytes)",
+			Store: func() interface{} {
+				return accessLog()["body"]
+			},
+		})
+		// 切り詰めたJSONもフィールドをマスクする
+		test.Api("truncate_json", &ext.ITestRequest{
+			Method: "POST",
+			Path:   "/login",
+			Body:   `{"password": "qwerty", "data": "` + strings.Repeat("a", 100) + `"}`,
+		}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Want:   `{"password": "***", "data": "` + strings.Repeat("a", 35) + "...(truncated 67 bytes)",
+			Store: func() interface{} {
+				return accessLog()["body"]
+			},
+		})
+		// Luhnで検証できない数字はカード番号として扱わない
+		test.Api("timestamp", &ext.ITestRequest{
+			Method: "POST",
+			Path:   "/login",
+			Body:   map[string]interface{}{"ts": 1792416460806},
+		}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Want:   `{"ts":1792416460806}`,
+			Store: func() interface{} {
+				return accessLog()["body"]
+			},
+		})
+		test.Api("skip", &ext.ITestRequest{
+			Method: "POST",
+			Path:   "/upload",
+			Body:   map[string]interface{}{"file": "data"},
+		}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Want:   "",
+			Store: func() interface{} {
+				return accessLog()["body"]
+			},
+		})
+	})
+}
+
+func TestRequestLogger(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	ext.Log = zap.New(core)
+	defer func() { ext.Log = nil }()
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		UseRedis:     true,
+		RedisOptions: &redis.Options{},
+	})
+	test.Routes(func(app *fiber.App) {
+		app.Get("/", func(c *fiber.Ctx) error {
+			test.Ex.Logger(c).Info("handler")
+			if err := test.Ex.Redis.Set(test.Ex.Context(c), "key", "value", 0).Err(); err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			return test.Ex.Result(c, 200, map[string]interface{}{"status": "ok"})
+		})
+	})
+	requestid := func(message string) interface{} {
+		entries := logs.FilterMessage(message).AllUntimed()
+		if len(entries) == 0 {
+			return nil
+		}
+		return entries[0].ContextMap()["requestid"]
+	}
+	test.Run("correlation", func() {
+		test.Api("request", &ext.ITestRequest{Method: "GET", Path: "/", Headers: map[string]string{"X-Request-Id": "req-1"}}, 200, []*ext.ITestCase{
+			{
+				Method: ext.TestMethodEqual,
+				Want:   "req-1",
+				Store: func() interface{} {
+					return requestid("handler")
+				},
+			},
+			{
+				Method: ext.TestMethodEqual,
+				Want:   "req-1",
+				Store: func() interface{} {
+					return requestid("redis.command")
+				},
+			},
+		}...)
+	})
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	ext.Log = zap.New(core)
+	defer func() { ext.Log = nil }()
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		LogConfig: &ext.ILogConfig{SampleRoutes: map[string]int{"/sampled/:id": 2}},
+	})
+	test.Routes(func(app *fiber.App) {
+		app.Get("/sampled/:id", func(c *fiber.Ctx) error {
+			return test.Ex.Result(c, 200, map[string]interface{}{"status": "ok"})
+		})
+	})
+	test.Run("sampling", func() {
+		for _, id := range []string{"1", "2", "3", "4"} {
+			test.Api("request", &ext.ITestRequest{Method: "GET", Path: "/sampled/" + id}, 200)
+		}
+		test.Job("count", func() {}, func() {}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: 2, Store: func() interface{} {
+			return logs.FilterMessage("api.request").Len()
+		}})
+	})
+
+	// 0以下は設定の誤りとして起動時にエラーにする
+	func() {
+		defer func() {
+			if rs := recover(); rs != "log: SampleRoutes must be 1 or more: /sampled/:id: 0" {
+				t.Errorf("zero: %v", rs)
+			}
+		}()
+		ext.NewTest(t, ext.IFiberExConfig{
+			LogConfig: &ext.ILogConfig{SampleRoutes: map[string]int{"/sampled/:id": 0}},
+		})
+	}()
+}
+
+func TestLogConfig(t *testing.T) {
+	dir := t.TempDir()
+	ext.Log = nil
+	defer func() { ext.Log = nil }()
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		LogConfig: &ext.ILogConfig{
+			Level:             "info",
+			Levels:            map[string]string{ext.LogComponentMail: "error"},
+			Encoding:          "json",
+			OutputPaths:       []string{filepath.Join(dir, "app.log")},
+			AccessFormat:      ext.AccessFormatCombined,
+			AccessOutputPaths: []string{filepath.Join(dir, "access.log")},
+			Rotation:          &ext.ILogRotation{MaxSize: 1},
+		},
+	})
+	test.Routes(func(app *fiber.App) {
+		app.Get("/", func(c *fiber.Ctx) error {
+			ext.ComponentLog(ext.LogComponentMail).Info("mail.info")
+			ext.ComponentLog(ext.LogComponentMail).Error("mail.error")
+			return test.Ex.Result(c, 200, map[string]interface{}{"status": "ok"})
+		})
+	})
+	read := func(name string) string {
+		rs, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+		}
+		return string(rs)
+	}
+	test.Run("output", func() {
+		test.Api("combined", &ext.ITestRequest{Method: "GET", Path: "/"}, 200, []*ext.ITestCase{
+			{
+				Method: ext.TestMethodMatches,
+				Want:   `^\S+ - - \[[^\]]+\] "GET / HTTP/1.1" 200 \d+ "-" "-"\n$`,
+				Store: func() interface{} {
+					return read("access.log")
+				},
+			},
+			{
+				Method: ext.TestMethodEqual,
+				Want:   false,
+				Store: func() interface{} {
+					return strings.Contains(read("app.log"), "mail.info")
+				},
+			},
+			{
+				Method: ext.TestMethodEqual,
+				Want:   true,
+				Store: func() interface{} {
+					return strings.Contains(read("app.log"), "mail.error")
+				},
+			},
+		}...)
+	})
+	test.Run("reload", func() {
+		rotated := func() int {
+			files, err := filepath.Glob(filepath.Join(dir, "rotate-*.log"))
+			if err != nil {
+				t.Error(err)
+			}
+			return len(files)
+		}
+		test.Job("rotation_stop", func() {}, func() {
+			config := &ext.IFiberExConfig{LogConfig: &ext.ILogConfig{
+				OutputPaths: []string{filepath.Join(dir, "rotate.log")},
+				Rotation:    &ext.ILogRotation{Interval: 10 * time.Millisecond},
+			}}
+			config.NewLogger().Info("rotate")
+			time.Sleep(50 * time.Millisecond)
+			// 置き換えると前のローテーションは停止する
+			(&ext.IFiberExConfig{LogConfig: &ext.ILogConfig{OutputPaths: []string{filepath.Join(dir, "app.log")}}}).NewLogger()
+		}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+			before := rotated()
+			time.Sleep(50 * time.Millisecond)
+			return before > 0 && rotated() == before
+		}})
+		test.Job("concurrent", func() {}, func() {
+			// 再初期化中もComponentLogを参照できる
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 10; i++ {
+					(&ext.IFiberExConfig{LogConfig: &ext.ILogConfig{
+						Levels:      map[string]string{ext.LogComponentMail: "error"},
+						OutputPaths: []string{filepath.Join(dir, "app.log")},
+					}}).NewLogger()
+				}
+			}()
+			for i := 0; i < 10; i++ {
+				test.Api("combined", &ext.ITestRequest{Method: "GET", Path: "/"}, 200)
+			}
+			<-done
+		}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: "error", Store: func() interface{} {
+			return ext.LogLevels()[ext.LogComponentMail]
+		}})
+	})
+}
@@ -0,0 +1,276 @@
+package gofiber_extend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ログレベルの変更内容
+type ILogLevelChange struct {
+	Level     string    `json:"level" validate:"required,oneof=debug info warn error"`
+	Component string    `json:"component,omitempty"` // 未指定の場合は共通のlogger
+	Route     string    `json:"route,omitempty"`     // 指定された場合はこのルート(/users/:idなどの定義)のリクエストのみ
+	UserId    string    `json:"userid,omitempty"`    // 指定された場合はこのユーザのリクエストのみ
+	TTL       int       `json:"ttl,omitempty"`       // 元のレベルに戻すまでの秒数
+	NodeId    string    `json:"node_id,omitempty"`   // 変更したノード
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (p *ILogLevelChange) scoped() bool {
+	return p.Route != "" || p.UserId != ""
+}
+
+// ルート/ユーザ単位のレベル変更
+type logOverride struct {
+	level     zapcore.Level
+	component string
+	route     string
+	userid    string
+	expiresAt time.Time
+}
+
+func (p *logOverride) match(component string, route string, userid string, now time.Time) bool {
+	if now.After(p.expiresAt) {
+		return false
+	}
+	if p.component != "" && p.component != component {
+		return false
+	}
+	if p.route != "" && p.route != route {
+		return false
+	}
+	if p.userid != "" && p.userid != userid {
+		return false
+	}
+	return true
+}
+
+var (
+	logLevels    = map[string]zap.AtomicLevel{} // コンポーネント毎のレベル 共通のloggerは""
+	logDefaults  = map[string]zapcore.Level{}   // 設定ファイルのレベル
+	logOverrides atomic.Value                   // []*logOverride
+	logReverts   = map[string]*time.Timer{}     // レベルを戻すタイマー
+	logMutex     sync.RWMutex                   // logLevels/logDefaultsとlogger.goのloggerを保護する
+)
+
+func activeLogOverrides() []*logOverride {
+	if rs, ok := logOverrides.Load().([]*logOverride); ok {
+		return rs
+	}
+	return nil
+}
+
+// AtomicLevelとルート/ユーザ単位の変更で出力を判定するcore
+type levelCore struct {
+	zapcore.Core
+	name   string
+	level  zap.AtomicLevel
+	route  string
+	userid string
+}
+
+func newLevelCore(core zapcore.Core, name string, level zap.AtomicLevel) *levelCore {
+	return &levelCore{Core: core, name: name, level: level}
+}
+
+func (p *levelCore) Enabled(level zapcore.Level) bool {
+	if p.level.Enabled(level) {
+		return true
+	}
+	now := time.Now()
+	for _, override := range activeLogOverrides() {
+		if override.match(p.name, p.route, p.userid, now) && level >= override.level {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	rs := &levelCore{Core: p.Core.With(fields), name: p.name, level: p.level, route: p.route, userid: p.userid}
+	for _, field := range fields {
+		switch field.Key {
+		case "route":
+			rs.route = field.String
+		case "userid":
+			rs.userid = field.String
+		}
+	}
+	return rs
+}
+
+func (p *levelCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !p.Enabled(entry.Level) {
+		return checked
+	}
+	return p.Core.Check(entry, checked)
+}
+
+// 現在のログレベル
+func LogLevels() map[string]string {
+	logMutex.RLock()
+	defer logMutex.RUnlock()
+	rs := map[string]string{}
+	for name, level := range logLevels {
+		rs[name] = level.String()
+	}
+	return rs
+}
+
+// このノードのログレベルを変更する TTL経過後に元のレベルに戻す
+func SetLogLevel(change *ILogLevelChange) error {
+	level, err := zapcore.ParseLevel(change.Level)
+	if err != nil {
+		return err
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	atomicLevel, ok := logLevels[change.Component]
+	if !ok {
+		return fmt.Errorf("log level: unknown component: %s", change.Component)
+	}
+	defaultLevel := logDefaults[change.Component]
+
+	ttl := time.Until(change.ExpiresAt)
+	if ttl <= 0 {
+		return fmt.Errorf("log level: expired: %s", change.ExpiresAt)
+	}
+	if change.scoped() {
+		now := time.Now()
+		overrides := []*logOverride{}
+		for _, override := range activeLogOverrides() {
+			if override.expiresAt.After(now) {
+				overrides = append(overrides, override)
+			}
+		}
+		logOverrides.Store(append(overrides, &logOverride{
+			level:     level,
+			component: change.Component,
+			route:     change.Route,
+			userid:    change.UserId,
+			expiresAt: change.ExpiresAt,
+		}))
+		return nil
+	}
+
+	atomicLevel.SetLevel(level)
+	if timer, ok := logReverts[change.Component]; ok {
+		timer.Stop()
+	}
+	logReverts[change.Component] = time.AfterFunc(ttl, func() {
+		atomicLevel.SetLevel(defaultLevel)
+	})
+	return nil
+}
+
+// 全ノードのログレベルを変更する
+func (p *IFiberEx) ChangeLogLevel(change *ILogLevelChange) error {
+	if change.TTL <= 0 {
+		change.TTL = int(p.Config.LogConfig.LevelTTL / time.Second)
+	}
+	change.NodeId = p.NodeId
+	change.ExpiresAt = time.Now().Add(time.Duration(change.TTL) * time.Second)
+	if err := SetLogLevel(change); err != nil {
+		return err
+	}
+	if p.Redis == nil {
+		return nil
+	}
+	value, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	return p.Redis.Publish(background, p.Config.LogConfig.LevelChannel, value).Err()
+}
+
+// ログレベル変更の購読
+type logLevelSubscriber struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// 他ノードからのログレベル変更を受信する
+// Newでredisを使用する場合に開始する ctxのキャンセルかLogLevelStopで停止する
+func (p *IFiberEx) SubscribeLogLevel(ctx context.Context) error {
+	p.LogLevelStop()
+	ctx, cancel := context.WithCancel(ctx)
+	sub := p.Redis.Subscribe(ctx, p.Config.LogConfig.LevelChannel)
+	_, err := sub.Receive(ctx)
+	subscriber := &logLevelSubscriber{cancel: cancel, done: make(chan struct{})}
+	p.logLevel = subscriber
+	go func() {
+		defer close(subscriber.done)
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			var msg *redis.Message
+			select {
+			case <-ctx.Done():
+				return
+			case received, ok := <-ch:
+				if !ok {
+					return
+				}
+				msg = received
+			}
+			change := &ILogLevelChange{}
+			if err := json.Unmarshal([]byte(msg.Payload), change); err != nil {
+				p.Log.Error(err.Error())
+				continue
+			}
+			if change.NodeId == p.NodeId {
+				continue
+			}
+			if err := SetLogLevel(change); err != nil {
+				p.Log.Error(err.Error(), zap.Any("change", change))
+			}
+		}
+	}()
+	return err
+}
+
+// ログレベル変更の受信を停止する
+func (p *IFiberEx) LogLevelStop() {
+	if p.logLevel == nil {
+		return
+	}
+	p.logLevel.cancel()
+	<-p.logLevel.done
+	p.logLevel = nil
+}
+
+// ログレベル変更用の管理画面API
+// authには認証を行うハンドラ(ApiKeyMiddlewareなど)を指定する
+func (p *IFiberEx) LogLevelAdmin(router fiber.Router, auth ...fiber.Handler) {
+	if len(auth) == 0 {
+		panic("log level admin: auth handler is required")
+	}
+	get := append(append([]fiber.Handler{}, auth...), func(c *fiber.Ctx) error {
+		return p.Result(c, 200, map[string]interface{}{"levels": LogLevels()})
+	})
+	put := append(append([]fiber.Handler{}, auth...), func(c *fiber.Ctx) error {
+		change := &ILogLevelChange{}
+		if err := c.BodyParser(change); err != nil {
+			return p.ResultError(c, 400, err, E40001.Errors()...)
+		}
+		if errors := p.Validation(change); len(errors) > 0 {
+			return p.ResultError(c, 400, fmt.Errorf("validation error: %+v", errors), errors...)
+		}
+		if err := p.ChangeLogLevel(change); err != nil {
+			return p.ResultError(c, 400, err, E40001.Errors()...)
+		}
+		p.Logger(c).Warn("log level changed", zap.Any("change", change))
+		return p.Result(c, 200, change)
+	})
+	router.Get("/log/level", get...)
+	router.Put("/log/level", put...)
+}
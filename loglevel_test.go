@@ -0,0 +1,119 @@
+package gofiber_extend_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLogLevel(t *testing.T) {
+	dir := t.TempDir()
+	ext.Log = nil
+	defer func() { ext.Log = nil }()
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		UseRedis:     true,
+		RedisOptions: &redis.Options{},
+		LogConfig: &ext.ILogConfig{
+			Level:       "info",
+			Encoding:    "json",
+			OutputPaths: []string{filepath.Join(dir, "app.log")},
+		},
+	})
+	test.Routes(func(app *fiber.App) {
+		test.Ex.LogLevelAdmin(app.Group("/admin"), func(c *fiber.Ctx) error {
+			if c.Get("Authorization") != "Bearer admin" {
+				return test.Ex.ResultError(c, 401, fiber.ErrUnauthorized, ext.E40101.Errors()...)
+			}
+			return c.Next()
+		})
+		app.Get("/debug/:name", func(c *fiber.Ctx) error {
+			test.Ex.Logger(c).Debug("debug." + c.Params("name"))
+			return test.Ex.Result(c, 200, map[string]interface{}{"status": "ok"})
+		})
+		app.Get("/other/:name", func(c *fiber.Ctx) error {
+			test.Ex.Logger(c).Debug("other." + c.Params("name"))
+			return test.Ex.Result(c, 200, map[string]interface{}{"status": "ok"})
+		})
+	})
+	logged := func(message string) func() interface{} {
+		return func() interface{} {
+			rs, err := os.ReadFile(filepath.Join(dir, "app.log"))
+			if err != nil {
+				t.Error(err)
+			}
+			return strings.Contains(string(rs), message)
+		}
+	}
+	// pub/subの受信とTTLの経過を待つ
+	waitLevel := func(want string) {
+		for deadline := time.Now().Add(2 * time.Second); ext.LogLevels()[""] != want && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	admin := map[string]string{"Authorization": "Bearer admin"}
+	test.Run("scoped", func() {
+		test.Api("unauthorized", &ext.ITestRequest{Method: "PUT", Path: "/admin/log/level", Body: map[string]interface{}{"level": "debug"}}, 401)
+		test.Api("invalid", &ext.ITestRequest{Method: "PUT", Path: "/admin/log/level", Headers: admin, Body: map[string]interface{}{"level": "verbose"}}, 400)
+		test.Api("change", &ext.ITestRequest{Method: "PUT", Path: "/admin/log/level", Headers: admin, Body: map[string]interface{}{"level": "debug", "route": "/debug/:name", "ttl": 60}}, 200)
+		test.Api("route_a", &ext.ITestRequest{Method: "GET", Path: "/debug/a"}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Want:   true,
+			Store:  logged("debug.a"),
+		})
+		// パスではなくルートの定義で判定する
+		test.Api("route_b", &ext.ITestRequest{Method: "GET", Path: "/debug/b"}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Want:   true,
+			Store:  logged("debug.b"),
+		})
+		test.Api("other_route", &ext.ITestRequest{Method: "GET", Path: "/other/a"}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Want:   false,
+			Store:  logged("other.a"),
+		})
+	})
+	test.Run("broadcast", func() {
+		change := &ext.ILogLevelChange{Level: "debug", NodeId: "other", ExpiresAt: time.Now().Add(500 * time.Millisecond)}
+		value, err := json.Marshal(change)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// LogLevelAdminを使用しなくてもNewで購読している
+		if n := test.Redis.PubSubNumSub("log:level")["log:level"]; n != 1 {
+			t.Fatalf("subscribers: %d", n)
+		}
+		test.Redis.Publish("log:level", string(value))
+		waitLevel("debug")
+		test.Api("changed", &ext.ITestRequest{Method: "GET", Path: "/admin/log/level", Headers: admin}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.result.levels[""]`,
+			Want:   "debug",
+		})
+		waitLevel("info") // TTL経過後は元に戻る
+		test.Api("reverted", &ext.ITestRequest{Method: "GET", Path: "/admin/log/level", Headers: admin}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.result.levels[""]`,
+			Want:   "info",
+		})
+	})
+	test.Run("stop", func() {
+		test.Ex.LogLevelStop()
+		// 接続の切断はminiredisで非同期に処理される
+		n := 0
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if n = test.Redis.PubSubNumSub("log:level")["log:level"]; n == 0 {
+				break
+			}
+		}
+		if n != 0 {
+			t.Errorf("subscribers: %d", n)
+		}
+	})
+}
@@ -0,0 +1,330 @@
+package gofiber_extend
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// マスクのルールを指定するタグ mask:"email"
+// 暗号化したカラム(gorm:"serializer:encrypt")は未指定の場合allになる
+const MaskTag = "mask"
+
+// マスクのルール
+const (
+	MaskAll   = "all"   // すべて
+	MaskEmail = "email" // ローカル部の先頭1文字とドメインを残す
+	MaskPhone = "phone" // 末尾4文字を残す
+	MaskLast4 = "last4"
+)
+
+var maskRules sync.Map
+
+// マスクのルールを追加する
+func RegisterMaskRule(name string, fn func(string) string) {
+	maskRules.Store(name, fn)
+}
+
+func maskLast(value string, n int) string {
+	runes := []rune(value)
+	if len(runes) <= n {
+		return strings.Repeat("*", len(runes))
+	}
+	return strings.Repeat("*", len(runes)-n) + string(runes[len(runes)-n:])
+}
+
+func init() {
+	RegisterMaskRule(MaskEmail, func(value string) string {
+		local, domain, ok := strings.Cut(value, "@")
+		if !ok || local == "" {
+			return maskLast(value, 0)
+		}
+		return string([]rune(local)[:1]) + "***@" + domain
+	})
+	RegisterMaskRule(MaskPhone, func(value string) string {
+		return maskLast(value, 4)
+	})
+	RegisterMaskRule(MaskLast4, func(value string) string {
+		return maskLast(value, 4)
+	})
+}
+
+// マスクするフィールドのルール
+func maskRule(field reflect.StructField) string {
+	if rule := field.Tag.Get(MaskTag); rule != "" {
+		return rule
+	}
+	for _, setting := range strings.Split(field.Tag.Get("gorm"), ";") {
+		name, value, _ := strings.Cut(setting, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "serializer") && strings.EqualFold(strings.TrimSpace(value), EncryptSerializer) {
+			return MaskAll
+		}
+	}
+	return ""
+}
+
+// 型にマスクするフィールドが含まれるか
+var maskableTypes sync.Map
+
+func maskable(t reflect.Type) bool {
+	if rs, ok := maskableTypes.Load(t); ok {
+		return rs.(bool)
+	}
+	rs := maskableType(t, map[reflect.Type]bool{})
+	maskableTypes.Store(t, rs)
+	return rs
+}
+
+// 判定中の型はvisitedに格納し、再帰した場合はfalseとする
+// 判定中の型に依存するためfalseの結果は保存しない
+func maskableType(t reflect.Type, visited map[reflect.Type]bool) bool {
+	if rs, ok := maskableTypes.Load(t); ok {
+		return rs.(bool)
+	}
+	if visited[t] {
+		return false
+	}
+	visited[t] = true
+	rs := false
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		rs = maskableType(t.Elem(), visited)
+	case reflect.Interface:
+		rs = true
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if maskRule(field) != "" || maskableType(field.Type, visited) {
+				rs = true
+				break
+			}
+		}
+	}
+	if rs {
+		maskableTypes.Store(t, rs)
+	}
+	return rs
+}
+
+type masker struct {
+	mask string
+}
+
+func newMasker() *masker {
+	if Crypto != nil {
+		return &masker{mask: Crypto.config.Mask}
+	}
+	return &masker{mask: defaultCryptoConfig.Mask}
+}
+
+func (p *masker) apply(rule string, value string) string {
+	if value == "" {
+		return value
+	}
+	if fn, ok := maskRules.Load(rule); ok && rule != MaskAll {
+		return fn.(func(string) string)(value)
+	}
+	return p.mask
+}
+
+// マスクした値を返す 変更しない場合はfalse
+func (p *masker) value(v reflect.Value, depth int) (reflect.Value, bool) {
+	if depth > 32 || !v.IsValid() || !maskable(v.Type()) {
+		return v, false
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v, false
+		}
+		elem, changed := p.value(v.Elem(), depth+1)
+		if !changed {
+			return v, false
+		}
+		rs := reflect.New(v.Type().Elem())
+		rs.Elem().Set(elem)
+		return rs, true
+	case reflect.Interface:
+		if v.IsNil() {
+			return v, false
+		}
+		elem, changed := p.value(v.Elem(), depth+1)
+		if !changed {
+			return v, false
+		}
+		rs := reflect.New(v.Type()).Elem()
+		rs.Set(elem)
+		return rs, true
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return v, false
+		}
+		var rs reflect.Value
+		for i := 0; i < v.Len(); i++ {
+			elem, changed := p.value(v.Index(i), depth+1)
+			if !changed {
+				continue
+			}
+			if !rs.IsValid() {
+				if v.Kind() == reflect.Slice {
+					rs = reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+				} else {
+					rs = reflect.New(v.Type()).Elem()
+				}
+				reflect.Copy(rs, v)
+			}
+			rs.Index(i).Set(elem)
+		}
+		return rs, rs.IsValid()
+	case reflect.Map:
+		if v.IsNil() {
+			return v, false
+		}
+		var rs reflect.Value
+		iter := v.MapRange()
+		for iter.Next() {
+			if _, changed := p.value(iter.Value(), depth+1); changed {
+				rs = reflect.MakeMapWithSize(v.Type(), v.Len())
+				break
+			}
+		}
+		if !rs.IsValid() {
+			return v, false
+		}
+		iter = v.MapRange()
+		for iter.Next() {
+			elem, _ := p.value(iter.Value(), depth+1)
+			rs.SetMapIndex(iter.Key(), elem)
+		}
+		return rs, true
+	case reflect.Struct:
+		rs := reflect.New(v.Type()).Elem()
+		rs.Set(v)
+		changed := false
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			value := rs.Field(i)
+			if rule := maskRule(field); rule != "" {
+				switch {
+				case value.Kind() == reflect.String && value.String() != "":
+					value.SetString(p.apply(rule, value.String()))
+					changed = true
+				case value.Kind() == reflect.Ptr && !value.IsNil() && value.Elem().Kind() == reflect.String:
+					masked := reflect.New(value.Type().Elem())
+					masked.Elem().SetString(p.apply(rule, value.Elem().String()))
+					value.Set(masked)
+					changed = true
+				}
+				continue
+			}
+			if elem, ok := p.value(value, depth+1); ok {
+				value.Set(elem)
+				changed = true
+			}
+		}
+		if !changed {
+			return v, false
+		}
+		return rs, true
+	}
+	return v, false
+}
+
+// mask/暗号化したフィールドをマスクしたコピーを返す 元の値は変更しない
+func Mask(v interface{}) interface{} {
+	rs, _ := maskValue(v)
+	return rs
+}
+
+// マスクしたコピーを返す 変更しない場合はfalse
+func maskValue(v interface{}) (interface{}, bool) {
+	rs, changed := newMasker().value(reflect.ValueOf(v), 0)
+	if !changed {
+		return v, false
+	}
+	return rs.Interface(), true
+}
+
+// マスクした値をログに出力する
+func MaskedField(key string, v interface{}) zap.Field {
+	return zap.Any(key, Mask(v))
+}
+
+// マスクせずに返すか
+func (p *IFiberEx) Unmasked(c *fiber.Ctx) bool {
+	conf := p.Config.CryptoConfig
+	if conf == nil {
+		return true
+	}
+	if conf.Unmask != nil {
+		return conf.Unmask(c)
+	}
+	key, ok := c.Locals("apikey").(*IApiKey)
+	return ok && conf.UnmaskScope != "" && key.HasScopes(conf.UnmaskScope)
+}
+
+// パラメータにマスクするフィールドがある場合はアクセスログとエラー通知にマスクしたbodyを出力する
+func (p *IFiberEx) maskRequest(c *fiber.Ctx, params interface{}) {
+	if len(c.Request().Body()) == 0 {
+		return
+	}
+	masked, changed := maskValue(params)
+	if !changed {
+		return
+	}
+	if rs, err := json.Marshal(masked); err == nil {
+		c.Locals("log_request_body", rs)
+	}
+}
+
+// JSONの値をルールでマスクしてアクセスログとエラー通知に出力する rulesはJSONの名前とルール
+func (p *IFiberEx) maskRequestJson(c *fiber.Ctx, body map[string]json.RawMessage, rules map[string]string) {
+	masker := newMasker()
+	masked := map[string]json.RawMessage{}
+	changed := false
+	for name, value := range body {
+		masked[name] = value
+		var text string
+		if rule, ok := rules[name]; ok && json.Unmarshal(value, &text) == nil && text != "" {
+			if rs, err := json.Marshal(masker.apply(rule, text)); err == nil {
+				masked[name] = rs
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	if rs, err := json.Marshal(masked); err == nil {
+		c.Locals("log_request_body", rs)
+	}
+}
+
+// 権限がない場合はマスクしたレスポンスを返す
+// 権限がある場合もアクセスログにはマスクしたレスポンスを出力する
+func (p *IFiberEx) maskResponse(c *fiber.Ctx, body *IResponse) *IResponse {
+	if p.Config.CryptoConfig == nil {
+		return body
+	}
+	masked, ok := Mask(body).(*IResponse)
+	if !ok || masked == body {
+		return body
+	}
+	if !p.Unmasked(c) {
+		return masked
+	}
+	if rs, err := json.Marshal(masked); err == nil {
+		c.Locals("log_response_body", rs)
+	}
+	return body
+}
@@ -0,0 +1,347 @@
+package gofiber_extend
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jrallison/go-workers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+	"gorm.io/gorm"
+)
+
+type IMetricsConfig struct {
+	Path      string    // メトリクスを公開するパス
+	Namespace string    // メトリクス名のプレフィックス
+	Buckets   []float64 // 所要時間のヒストグラムのバケット(秒)
+}
+
+var defaultMetricsConfig *IMetricsConfig = &IMetricsConfig{
+	Path:      "/metrics",
+	Namespace: "app",
+	Buckets:   prometheus.DefBuckets,
+}
+
+type IMetrics struct {
+	Registry      *prometheus.Registry
+	constLabels   prometheus.Labels
+	namespace     string
+	httpRequests  *prometheus.CounterVec
+	httpDuration  *prometheus.HistogramVec
+	dbDuration    *prometheus.HistogramVec
+	redisDuration *prometheus.HistogramVec
+	esDuration    *prometheus.HistogramVec
+	jobProcessed  *prometheus.CounterVec
+	jobFailed     *prometheus.CounterVec
+	jobDuration   *prometheus.HistogramVec
+	mailSent      *prometheus.CounterVec
+	cacheRequests *prometheus.CounterVec
+	cacheEvicted  *prometheus.CounterVec
+	dbStats       map[string]prometheus.Collector // DB名ごとのコネクションプールの統計
+	dbMutex       sync.Mutex
+}
+
+// AppNameとNodeIdを共通のラベルとしてメトリクスを初期化する
+// Newではプロセスで1つだけ作成するためラベルは最初のNewのAppNameとNodeIdになる
+func NewMetrics(config *IMetricsConfig, appName string, nodeId string) *IMetrics {
+	labels := prometheus.Labels{"app": appName, "node": nodeId}
+	histogram := func(subsystem string, name string, help string, keys ...string) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			Buckets:     config.Buckets,
+			ConstLabels: labels,
+		}, keys)
+	}
+	counter := func(subsystem string, name string, help string, keys ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: labels,
+		}, keys)
+	}
+	rs := &IMetrics{
+		Registry:      prometheus.NewRegistry(),
+		constLabels:   labels,
+		namespace:     config.Namespace,
+		httpRequests:  counter("http", "requests_total", "Number of HTTP requests.", "method", "route", "status"),
+		httpDuration:  histogram("http", "request_duration_seconds", "HTTP request latency.", "method", "route", "status"),
+		dbDuration:    histogram("db", "query_duration_seconds", "Database query latency.", "operation", "table"),
+		redisDuration: histogram("redis", "command_duration_seconds", "Redis command latency.", "command", "status"),
+		esDuration:    histogram("es", "request_duration_seconds", "Elasticsearch request latency.", "method", "status"),
+		jobProcessed:  counter("job", "processed_total", "Number of processed jobs.", "queue"),
+		jobFailed:     counter("job", "failed_total", "Number of failed jobs.", "queue"),
+		jobDuration:   histogram("job", "duration_seconds", "Job processing time.", "queue"),
+		mailSent:      counter("mail", "sent_total", "Number of sent mails.", "result"),
+		cacheRequests: counter("cache", "requests_total", "Number of cache lookups.", "tier", "result"),
+		cacheEvicted:  counter("cache", "evictions_total", "Number of evicted local cache entries.", "reason"),
+		dbStats:       map[string]prometheus.Collector{},
+	}
+	rs.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		rs.httpRequests,
+		rs.httpDuration,
+		rs.dbDuration,
+		rs.redisDuration,
+		rs.esDuration,
+		rs.jobProcessed,
+		rs.jobFailed,
+		rs.jobDuration,
+		rs.mailSent,
+		rs.cacheRequests,
+		rs.cacheEvicted,
+	)
+	return rs
+}
+
+// /metricsのハンドラ
+func (p *IMetrics) Handler() func(*fiber.Ctx) error {
+	handler := fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(p.Registry, promhttp.HandlerOpts{}))
+	return func(c *fiber.Ctx) error {
+		handler(c.Context())
+		return nil
+	}
+}
+
+// HTTPリクエストの計測 ルートはテンプレートで集計する
+func (p *IMetrics) Middleware() func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		status := c.Response().StatusCode()
+		if err != nil {
+			if e, ok := err.(*fiber.Error); ok {
+				status = e.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+		}
+		labels := []string{c.Method(), c.Route().Path, strconv.Itoa(status)}
+		p.httpRequests.WithLabelValues(labels...).Inc()
+		p.httpDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// gormのコールバックでクエリを計測するプラグイン
+type metricsPlugin struct {
+	metrics *IMetrics
+}
+
+const metricsStartKey = "metrics:start"
+
+func (p *metricsPlugin) Name() string {
+	return "metrics"
+}
+
+func (p *metricsPlugin) Initialize(db *gorm.DB) error {
+	before := func(db *gorm.DB) {
+		db.InstanceSet(metricsStartKey, time.Now())
+	}
+	after := func(operation string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			if start, ok := db.InstanceGet(metricsStartKey); ok {
+				p.metrics.dbDuration.WithLabelValues(operation, db.Statement.Table).Observe(time.Since(start.(time.Time)).Seconds())
+			}
+		}
+	}
+	return registerAround(db, "metrics", anyOperation(before), after)
+}
+
+// クエリの計測とコネクションプールの統計を登録する
+// 同じ名前のDBを作り直した場合は古い統計を外して新しいコネクションプールに差し替える
+func (p *IMetrics) InstrumentDB(db *gorm.DB, name string) error {
+	if err := db.Use(&metricsPlugin{metrics: p}); err != nil {
+		return err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	registerer := prometheus.WrapRegistererWith(p.constLabels, p.Registry)
+	collector := collectors.NewDBStatsCollector(sqlDB, name)
+	p.dbMutex.Lock()
+	defer p.dbMutex.Unlock()
+	if old, ok := p.dbStats[name]; ok {
+		registerer.Unregister(old)
+	}
+	if err := registerer.Register(collector); err != nil {
+		return err
+	}
+	p.dbStats[name] = collector
+	return nil
+}
+
+// redisのコマンドを計測するhook
+type metricsRedisHook struct {
+	metrics *IMetrics
+}
+
+func (p *metricsRedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (p *metricsRedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		p.metrics.redisDuration.WithLabelValues(cmd.Name(), redisStatus(err)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (p *metricsRedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		p.metrics.redisDuration.WithLabelValues("pipeline", redisStatus(err)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func redisStatus(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case err == redis.Nil:
+		return "nil"
+	}
+	return "error"
+}
+
+// NewRedisに渡す 使用中のクライアントに追加すると接続と競合する
+func (p *IMetrics) RedisHook() redis.Hook {
+	return &metricsRedisHook{metrics: p}
+}
+
+// elasticsearchのリクエストを計測するTransport
+type metricsTransport struct {
+	metrics *IMetrics
+	next    http.RoundTripper
+}
+
+func (p *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := p.next.RoundTrip(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+	}
+	p.metrics.esDuration.WithLabelValues(req.Method, status).Observe(time.Since(start).Seconds())
+	return res, err
+}
+
+func (p *IMetrics) InstrumentTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &metricsTransport{metrics: p, next: next}
+}
+
+// ジョブの処理数と所要時間を計測するミドルウェア
+type metricsJob struct {
+	metrics *IMetrics
+}
+
+func (p *metricsJob) Call(queue string, msg *workers.Msg, next func() bool) (ok bool) {
+	start := time.Now()
+	defer func() {
+		p.metrics.jobDuration.WithLabelValues(queue).Observe(time.Since(start).Seconds())
+		if e := recover(); e != nil {
+			p.metrics.jobFailed.WithLabelValues(queue).Inc()
+			panic(e) // リトライはgo-workersに任せる
+		}
+		p.metrics.jobProcessed.WithLabelValues(queue).Inc()
+	}()
+	return next()
+}
+
+// go-workersのキューの滞留数
+type metricsQueue struct {
+	depth     *prometheus.Desc
+	retry     *prometheus.Desc
+	scheduled *prometheus.Desc
+}
+
+func newMetricsQueue(namespace string, labels prometheus.Labels) *metricsQueue {
+	return &metricsQueue{
+		depth:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "job", "queue_depth"), "Number of enqueued jobs.", []string{"queue"}, labels),
+		retry:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "job", "retry_depth"), "Number of jobs waiting for retry.", nil, labels),
+		scheduled: prometheus.NewDesc(prometheus.BuildFQName(namespace, "job", "scheduled_depth"), "Number of scheduled jobs.", nil, labels),
+	}
+}
+
+func (p *metricsQueue) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.depth
+	ch <- p.retry
+	ch <- p.scheduled
+}
+
+func (p *metricsQueue) Collect(ch chan<- prometheus.Metric) {
+	if workers.Config == nil {
+		return
+	}
+	conn := workers.Config.Pool.Get()
+	defer conn.Close()
+	namespace := workers.Config.Namespace
+	queues, err := redigo.Strings(conn.Do("smembers", namespace+"queues"))
+	if err != nil {
+		return
+	}
+	for _, queue := range queues {
+		if depth, err := redigo.Int(conn.Do("llen", namespace+"queue:"+queue)); err == nil {
+			ch <- prometheus.MustNewConstMetric(p.depth, prometheus.GaugeValue, float64(depth), queue)
+		}
+	}
+	if depth, err := redigo.Int(conn.Do("zcard", namespace+workers.RETRY_KEY)); err == nil {
+		ch <- prometheus.MustNewConstMetric(p.retry, prometheus.GaugeValue, float64(depth))
+	}
+	if depth, err := redigo.Int(conn.Do("zcard", namespace+workers.SCHEDULED_JOBS_KEY)); err == nil {
+		ch <- prometheus.MustNewConstMetric(p.scheduled, prometheus.GaugeValue, float64(depth))
+	}
+}
+
+func (p *IMetrics) InstrumentJob() {
+	workers.Middleware.Append(&metricsJob{metrics: p})
+	if err := p.Registry.Register(newMetricsQueue(p.namespace, p.constLabels)); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			panic(err)
+		}
+	}
+}
+
+// メール送信結果
+func (p *IMetrics) MailSent(err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	p.mailSent.WithLabelValues(result).Inc()
+}
+
+// キャッシュの参照結果 tierはlocal/redis
+func (p *IMetrics) CacheRequest(tier string, hit bool) {
+	result := "hit"
+	if !hit {
+		result = "miss"
+	}
+	p.cacheRequests.WithLabelValues(tier, result).Inc()
+}
+
+// メモリ上のキャッシュの削除 reasonはsize/invalidate
+func (p *IMetrics) CacheEvicted(reason string) {
+	p.cacheEvicted.WithLabelValues(reason).Inc()
+}
@@ -0,0 +1,97 @@
+package gofiber_extend_test
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMetrics(t *testing.T) {
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		UseRedis:     true,
+		RedisOptions: &redis.Options{},
+		UseMetrics:   true,
+	})
+	test.Routes(func(app *fiber.App) {
+		app.Get("/users/:id", func(c *fiber.Ctx) error {
+			if err := test.Ex.Redis.Get(context.TODO(), "user:"+c.Params("id")).Err(); err != nil && err != redis.Nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			return test.Ex.Result(c, 200, map[string]interface{}{"id": c.Params("id")})
+		})
+	})
+	metrics := func(want string) func() interface{} {
+		return func() interface{} {
+			res, err := test.App.Test(httptest.NewRequest("GET", "/metrics", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return strings.Contains(string(body), want)
+		}
+	}
+	test.Run("metrics", func() {
+		test.Api("request", &ext.ITestRequest{Method: "GET", Path: "/users/1"}, 200, []*ext.ITestCase{
+			{
+				Method: ext.TestMethodEqual,
+				Want:   true,
+				Store:  metrics(`app_http_requests_total{app="App",method="GET",node="` + test.Ex.NodeId + `",route="/users/:id",status="200"} 1`),
+			},
+			{
+				Method: ext.TestMethodEqual,
+				Want:   true,
+				Store:  metrics(`app_redis_command_duration_seconds_count{app="App",command="get",node="` + test.Ex.NodeId + `",status="nil"} 1`),
+			},
+		}...)
+	})
+}
+
+func TestMetricsNewTwice(t *testing.T) {
+	ext.Metrics = nil
+	defer func() { ext.Metrics = nil }()
+	dbName := filepath.Join(t.TempDir(), "test.db")
+	first := newSQLiteTest(t, ext.IFiberExConfig{
+		UseMetrics:    true,
+		MetricsConfig: &ext.IMetricsConfig{},
+		DBConfig:      &ext.IDBConfig{DBName: dbName},
+	})
+	// DBを作り直してもメトリクスは共有したまま統計を差し替える
+	second := newSQLiteTest(t, ext.IFiberExConfig{
+		UseMetrics:    true,
+		MetricsConfig: &ext.IMetricsConfig{},
+		DBConfig:      &ext.IDBConfig{DBName: dbName},
+	})
+	if first.Ex.Metrics != second.Ex.Metrics {
+		t.Fatal("metrics is not shared")
+	}
+	if err := second.Ex.DB.Exec("SELECT 1").Error; err != nil {
+		t.Fatal(err)
+	}
+	res, err := second.App.Test(httptest.NewRequest("GET", "/metrics", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := strings.Count(string(body), "go_sql_max_open_connections{"); count != 1 {
+		t.Errorf("db stats: %d want 1", count)
+	}
+	// ラベルは最初のNewのNodeIdのまま
+	if want := `node="` + first.Ex.NodeId + `"} 1`; !strings.Contains(string(body), want) {
+		t.Errorf("db stats: %s not found", want)
+	}
+}
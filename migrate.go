@@ -0,0 +1,559 @@
+package gofiber_extend
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// マイグレーションのロック方法
+const (
+	MigrateLockRedis = "redis" // redisのSETNX
+	MigrateLockDB    = "db"    // mysqlのGET_LOCK/postgresのpg_advisory_lock(sqliteはロックしない)
+	MigrateLockNone  = "none"
+)
+
+// マイグレーションの設定 UseDBの場合のみ有効
+type IMigrateConfig struct {
+	FS          fs.FS         // SQLファイルの読み込み元(embed.FS等) 未指定の場合はDirをディスクから読み込む
+	Dir         string        // SQLファイルのディレクトリ <version>_<name>.up.sql/<version>_<name>.down.sql
+	Migrations  []*IMigration // Goの関数によるマイグレーション
+	Table       string        // 適用済みのバージョンを記録するテーブル
+	Lock        string        // redis/db/none 未指定の場合はUseRedisならredis、それ以外はdb
+	LockKey     string        // 未指定の場合はmigrate:<AppName>
+	LockTimeout time.Duration // redisのロックの有効期限
+	LockWait    time.Duration // ロックの取得を待つ時間
+	AutoMigrate bool          // 起動時に未適用のマイグレーションを実行する
+	DryRun      bool          // 実行せずに内容をOutputに出力する
+	Output      io.Writer     // DryRunとステータスの出力先 未指定の場合はstdout
+}
+
+var defaultMigrateConfig *IMigrateConfig = &IMigrateConfig{
+	Dir:         "migrations",
+	Table:       "schema_migrations",
+	LockTimeout: 10 * time.Minute,
+	LockWait:    5 * time.Minute,
+}
+
+// SQLにこの行を含む場合は文に分割せず、1回で実行する
+// sqliteのトリガー等、分割できない文に使用する
+const MigrateNoSplit = "-- migrate:no-split"
+
+// マイグレーション UpSQL/DownSQLとUp/Downのどちらかを指定する
+type IMigration struct {
+	Version int64
+	Name    string
+	UpSQL   string
+	DownSQL string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+func (p *IMigration) hasDown() bool {
+	return p.Down != nil || p.DownSQL != ""
+}
+
+// マイグレーションの適用状況
+type IMigrationStatus struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	Missing   bool       `json:"missing,omitempty"` // 適用済みだがマイグレーションが存在しない
+}
+
+// 適用済みのバージョン
+type schemaMigration struct {
+	Version   int64  `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"size:255"`
+	AppliedAt time.Time
+}
+
+type IMigrator struct {
+	config     *IMigrateConfig
+	db         *gorm.DB
+	redis      *redis.Client
+	dialect    string
+	nodeId     string
+	migrations []*IMigration
+}
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+func (p *IFiberEx) NewMigrator() (*IMigrator, error) {
+	if p.DB == nil {
+		return nil, fmt.Errorf("migrate: database is not configured")
+	}
+	conf := p.Config.MigrateConfig
+	if conf == nil {
+		conf = &IMigrateConfig{}
+	}
+	migrator := &IMigrator{
+		config:  conf,
+		db:      UsePrimary(p.DB), // 適用状況はレプリカではなくプライマリで確認する
+		dialect: p.Config.DBConfig.Dialect,
+		nodeId:  p.NodeId,
+	}
+	if p.Config.UseRedis {
+		migrator.redis = p.Redis
+	}
+	migrations, err := conf.load()
+	if err != nil {
+		return nil, err
+	}
+	migrator.migrations = migrations
+	return migrator, nil
+}
+
+// SQLファイルとGoの関数をバージョン順に並べる
+func (p *IMigrateConfig) load() ([]*IMigration, error) {
+	versions := map[int64]*IMigration{}
+	for _, migration := range p.Migrations {
+		if _, ok := versions[migration.Version]; ok {
+			return nil, fmt.Errorf("migrate: duplicate version %d", migration.Version)
+		}
+		versions[migration.Version] = migration
+	}
+	fsys, dir := p.FS, p.Dir
+	if fsys == nil {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			dir = ""
+		} else {
+			fsys, dir = os.DirFS(dir), "."
+		}
+	}
+	if fsys != nil && dir != "" {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			match := migrationFile.FindStringSubmatch(entry.Name())
+			if entry.IsDir() || match == nil {
+				continue
+			}
+			version, err := strconv.ParseInt(match[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			body, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			migration, ok := versions[version]
+			if !ok {
+				migration = &IMigration{Version: version, Name: match[2]}
+				versions[version] = migration
+			} else if migration.Name != match[2] || migration.Up != nil {
+				return nil, fmt.Errorf("migrate: duplicate version %d", version)
+			}
+			if match[3] == "up" {
+				migration.UpSQL = string(body)
+			} else {
+				migration.DownSQL = string(body)
+			}
+		}
+	}
+	rs := []*IMigration{}
+	for _, migration := range versions {
+		if migration.Up == nil && migration.UpSQL == "" {
+			return nil, fmt.Errorf("migrate: %d_%s has no up migration", migration.Version, migration.Name)
+		}
+		rs = append(rs, migration)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Version < rs[j].Version })
+	return rs, nil
+}
+
+func (p *IMigrator) output() io.Writer {
+	if p.config.Output != nil {
+		return p.config.Output
+	}
+	return os.Stdout
+}
+
+func (p *IMigrator) table() *gorm.DB {
+	return p.db.Table(p.config.Table)
+}
+
+func (p *IMigrator) applied(ctx context.Context) (map[int64]*schemaMigration, error) {
+	rs := map[int64]*schemaMigration{}
+	if p.config.DryRun && !p.db.WithContext(ctx).Migrator().HasTable(p.config.Table) {
+		return rs, nil // DryRunではテーブルを作成しない
+	}
+	if err := p.table().WithContext(ctx).AutoMigrate(&schemaMigration{}); err != nil {
+		return nil, err
+	}
+	records := []*schemaMigration{}
+	if err := p.table().WithContext(ctx).Order("version").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		rs[record.Version] = record
+	}
+	return rs, nil
+}
+
+// 適用状況の一覧
+func (p *IMigrator) Status(ctx context.Context) ([]IMigrationStatus, error) {
+	applied, err := p.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rs := []IMigrationStatus{}
+	for _, migration := range p.migrations {
+		status := IMigrationStatus{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			status.Applied, status.AppliedAt = true, &record.AppliedAt
+			delete(applied, migration.Version)
+		}
+		rs = append(rs, status)
+	}
+	for _, record := range applied {
+		record := record
+		rs = append(rs, IMigrationStatus{Version: record.Version, Name: record.Name, Applied: true, AppliedAt: &record.AppliedAt, Missing: true})
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Version < rs[j].Version })
+	return rs, nil
+}
+
+// 適用状況をOutputに出力する
+func (p *IMigrator) PrintStatus(ctx context.Context) error {
+	statuses, err := p.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		state := "pending"
+		if status.Missing {
+			state = "missing"
+		} else if status.Applied {
+			state = "applied " + status.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(p.output(), "%d\t%s\t%s\n", status.Version, status.Name, state)
+	}
+	return nil
+}
+
+// 未適用のマイグレーションをすべて実行する 実行したものを返す
+func (p *IMigrator) Up(ctx context.Context) ([]*IMigration, error) {
+	rs := []*IMigration{}
+	err := p.withLock(ctx, func() error {
+		applied, err := p.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range p.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := p.run(ctx, migration, true); err != nil {
+				return err
+			}
+			rs = append(rs, migration)
+		}
+		return nil
+	})
+	return rs, err
+}
+
+// 適用済みのマイグレーションを新しいものからsteps件戻す
+func (p *IMigrator) Down(ctx context.Context, steps int) ([]*IMigration, error) {
+	rs := []*IMigration{}
+	err := p.withLock(ctx, func() error {
+		applied, err := p.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for i := len(p.migrations) - 1; i >= 0 && len(rs) < steps; i-- {
+			migration := p.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if !migration.hasDown() {
+				return fmt.Errorf("migrate: %d_%s has no down migration", migration.Version, migration.Name)
+			}
+			if err := p.run(ctx, migration, false); err != nil {
+				return err
+			}
+			rs = append(rs, migration)
+		}
+		return nil
+	})
+	return rs, err
+}
+
+// 1件のマイグレーションをトランザクション内で実行して記録する
+// mysqlのDDLは暗黙的にコミットされるため、失敗した場合は途中までの変更が残る
+func (p *IMigrator) run(ctx context.Context, migration *IMigration, up bool) error {
+	direction, script, fn := "down", migration.DownSQL, migration.Down
+	if up {
+		direction, script, fn = "up", migration.UpSQL, migration.Up
+	}
+	if p.config.DryRun {
+		fmt.Fprintf(p.output(), "-- %d_%s.%s\n", migration.Version, migration.Name, direction)
+		if fn != nil {
+			fmt.Fprintln(p.output(), "-- (go function)")
+		}
+		for _, statement := range p.statements(script) {
+			fmt.Fprintf(p.output(), "%s;\n", statement)
+		}
+		return nil
+	}
+	begin := time.Now()
+	err := p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if fn != nil {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+		for _, statement := range p.statements(script) {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		if !up {
+			return tx.Table(p.config.Table).Delete(&schemaMigration{}, migration.Version).Error
+		}
+		return tx.Table(p.config.Table).Create(&schemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("migrate: %d_%s.%s: %w", migration.Version, migration.Name, direction, err)
+	}
+	ComponentLog(LogComponentDB).Info("db.migrate",
+		zap.Int64("version", migration.Version),
+		zap.String("name", migration.Name),
+		zap.String("direction", direction),
+		zap.Duration("elaps", time.Since(begin)),
+	)
+	return nil
+}
+
+// SQLを文に分割する mysqlは引用符内のバックスラッシュをエスケープとして扱う
+func (p *IMigrator) statements(script string) []string {
+	for _, line := range strings.Split(script, "\n") {
+		if strings.TrimSpace(line) == MigrateNoSplit {
+			if statement := strings.TrimRight(strings.TrimSpace(script), "; \t\r\n"); statement != "" {
+				return []string{statement}
+			}
+			return []string{}
+		}
+	}
+	return splitStatements(script, p.dialect == DialectMySQL || p.dialect == DialectMariaDB)
+}
+
+var dollarQuote = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
+
+// SQLを文毎に分割する 引用符・コメント・postgresの$$で囲まれた範囲の;は区切りとみなさない
+// 行末までのコメントは出力しない 区切り文字はASCIIのためバイト単位で走査する
+func splitStatements(script string, backslash bool) []string {
+	rs := []string{}
+	current := strings.Builder{}
+	flush := func() {
+		if statement := strings.TrimSpace(current.String()); statement != "" {
+			rs = append(rs, statement)
+		}
+		current.Reset()
+	}
+	// endまでをそのまま出力する 見つからない場合は末尾まで
+	skip := func(i int, start int, end string) int {
+		n := strings.Index(script[start:], end)
+		if n < 0 {
+			current.WriteString(script[i:])
+			return len(script)
+		}
+		current.WriteString(script[i : start+n+len(end)])
+		return start + n + len(end)
+	}
+	var quote byte
+	for i := 0; i < len(script); {
+		c := script[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && backslash && i+1 < len(script) {
+				current.WriteString(script[i : i+2])
+				i += 2
+				continue
+			}
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case strings.HasPrefix(script[i:], "--"):
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+			continue
+		case strings.HasPrefix(script[i:], "/*"):
+			// ブロックコメントはオプティマイザヒント等のため出力する
+			i = skip(i, i+2, "*/")
+			continue
+		case c == '$':
+			// $$または$tag$から同じタグまで
+			if tag := dollarQuote.FindString(script[i:]); tag != "" {
+				i = skip(i, i+len(tag), tag)
+				continue
+			}
+		case c == ';':
+			flush()
+			i++
+			continue
+		}
+		current.WriteByte(c)
+		i++
+	}
+	flush()
+	return rs
+}
+
+// ロックを取得してfnを実行する
+func (p *IMigrator) withLock(ctx context.Context, fn func() error) error {
+	if p.config.DryRun {
+		return fn()
+	}
+	method := p.config.Lock
+	if method == "" {
+		method = MigrateLockDB
+		if p.redis != nil {
+			method = MigrateLockRedis
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.config.LockWait)
+	defer cancel()
+	var unlock func()
+	var err error
+	switch method {
+	case MigrateLockRedis:
+		unlock, err = p.lockRedis(ctx)
+	case MigrateLockDB:
+		unlock, err = p.lockDB(ctx)
+	case MigrateLockNone:
+		unlock = func() {}
+	default:
+		err = fmt.Errorf("migrate: unknown lock %q", method)
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn()
+}
+
+func (p *IMigrator) lockRedis(ctx context.Context) (func(), error) {
+	if p.redis == nil {
+		return nil, fmt.Errorf("migrate: redis is not configured")
+	}
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	token := p.nodeId + ":" + hex.EncodeToString(buf)
+	for {
+		ok, err := p.redis.SetNX(ctx, p.config.LockKey, token, p.config.LockTimeout).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("migrate: lock timeout: %w", ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	return func() {
+		if err := redisUnlockScript.Run(background, p.redis, []string{p.config.LockKey}, token).Err(); err != nil {
+			ComponentLog(LogComponentDB).Warn("db.migrate_unlock", zap.Error(err))
+		}
+	}, nil
+}
+
+// セッション単位のロックのため専用の接続を確保する
+func (p *IMigrator) lockDB(ctx context.Context) (func(), error) {
+	var lock, unlock string
+	switch p.dialect {
+	case DialectMySQL, DialectMariaDB:
+		lock, unlock = "SELECT GET_LOCK(?, ?)", "SELECT RELEASE_LOCK(?)"
+	case DialectPostgres:
+		lock, unlock = "SELECT pg_advisory_lock(hashtext($1))", "SELECT pg_advisory_unlock(hashtext($1))"
+	default:
+		// sqliteは書き込みが直列化されるためロックしない
+		return func() {}, nil
+	}
+	sqlDB, err := p.db.DB()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var row *sql.Row
+	if p.dialect == DialectPostgres {
+		row = conn.QueryRowContext(ctx, lock, p.config.LockKey)
+	} else {
+		wait := int(p.config.LockWait / time.Second)
+		row = conn.QueryRowContext(ctx, lock, p.config.LockKey, wait)
+	}
+	var result sql.NullInt64
+	if err := row.Scan(&result); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("migrate: lock: %w", err)
+	}
+	if p.dialect != DialectPostgres && result.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("migrate: lock timeout")
+	}
+	return func() {
+		if _, err := conn.ExecContext(background, unlock, p.config.LockKey); err != nil {
+			ComponentLog(LogComponentDB).Warn("db.migrate_unlock", zap.Error(err))
+		}
+		conn.Close()
+	}, nil
+}
+
+// マイグレーションのコマンド up/down [steps]/status
+// 例: `app migrate up` `app migrate down 1`
+func (p *IFiberEx) MigrateCommand(args []string) error {
+	migrator, err := p.NewMigrator()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		args = []string{"status"}
+	}
+	switch args[0] {
+	case "up":
+		_, err = migrator.Up(background)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil {
+				return err
+			}
+		}
+		_, err = migrator.Down(background, steps)
+	case "status":
+		err = migrator.PrintStatus(background)
+	default:
+		err = fmt.Errorf("migrate: unknown command %q", args[0])
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+package gofiber_extend_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"gorm.io/gorm"
+)
+
+func TestMigrate(t *testing.T) {
+	files := fstest.MapFS{
+		"db/0001_create_users.up.sql":   {Data: []byte("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT); -- users;\nINSERT INTO users (name) VALUES ('a;b');\n")},
+		"db/0001_create_users.down.sql": {Data: []byte("DROP TABLE users;")},
+		"db/0002_add_email.up.sql":      {Data: []byte("ALTER TABLE users ADD COLUMN email TEXT;")},
+		"db/README.md":                  {Data: []byte("ignored")},
+	}
+	output := &bytes.Buffer{}
+	test := newSQLiteTest(t, ext.IFiberExConfig{
+		UseRedis: true,
+		MigrateConfig: &ext.IMigrateConfig{
+			FS:  files,
+			Dir: "db",
+			Migrations: []*ext.IMigration{{
+				Version: 3,
+				Name:    "index_email",
+				Up: func(tx *gorm.DB) error {
+					return tx.Exec("CREATE INDEX idx_users_email ON users (email)").Error
+				},
+				Down: func(tx *gorm.DB) error {
+					return tx.Exec("DROP INDEX idx_users_email").Error
+				},
+			}},
+			LockWait: time.Second,
+			Output:   output,
+		},
+	})
+	ctx := context.Background()
+	migrator, err := test.Ex.NewMigrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := func() interface{} {
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		rs := []string{}
+		for _, status := range statuses {
+			if status.Applied {
+				rs = append(rs, status.Name)
+			}
+		}
+		return strings.Join(rs, ",")
+	}
+
+	test.Job("test_mode", func() {}, func() {}, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: "create_users,add_email,index_email", Store: applied},
+		{Method: ext.TestMethodEqual, Want: "a;b", Store: func() interface{} {
+			name := ""
+			ext.DB.Raw("SELECT name FROM users").Scan(&name)
+			return name
+		}},
+		{Method: ext.TestMethodEqual, Want: false, Store: func() interface{} {
+			return test.Redis.Exists("migrate:App") // ロックが解放されている
+		}},
+	}...)
+
+	test.Job("down", func() {}, func() {
+		if _, err := migrator.Down(ctx, 1); err != nil {
+			t.Error(err)
+		}
+	}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: "create_users,add_email", Store: applied})
+
+	test.Job("dry_run", func() {
+		test.Ex.Config.MigrateConfig.DryRun = true
+	}, func() {
+		defer func() { test.Ex.Config.MigrateConfig.DryRun = false }()
+		if _, err := migrator.Up(ctx); err != nil {
+			t.Error(err)
+		}
+	}, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: "create_users,add_email", Store: applied},
+		{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+			return strings.Contains(output.String(), "-- 3_index_email.up")
+		}},
+	}...)
+
+	test.Job("locked", func() {
+		if err := test.Redis.Set("migrate:App", "other"); err != nil {
+			t.Fatal(err)
+		}
+	}, func() {
+		defer test.Redis.Del("migrate:App")
+		if _, err := migrator.Up(ctx); err == nil {
+			t.Error("migrate while locked")
+		}
+	}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: "create_users,add_email", Store: applied})
+
+	test.Job("up", func() {}, func() {
+		if _, err := migrator.Up(ctx); err != nil {
+			t.Error(err)
+		}
+		if err := migrator.PrintStatus(ctx); err != nil {
+			t.Error(err)
+		}
+	}, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: "create_users,add_email,index_email", Store: applied},
+		{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+			return strings.Contains(output.String(), "3\tindex_email\tapplied")
+		}},
+	}...)
+
+	test.Job("split", func() {
+		output.Reset()
+		test.Ex.Config.MigrateConfig.FS = fstest.MapFS{
+			"db/0010_function.up.sql": {Data: []byte("CREATE FUNCTION f() RETURNS int AS $body$ SELECT ';'; $body$ LANGUAGE sql;\n/* a; 'b */ SELECT $$;$$;")},
+			"db/0011_trigger.up.sql":  {Data: []byte("-- migrate:no-split\nCREATE TRIGGER t AFTER INSERT ON users BEGIN\n  SELECT 1;\nEND;\n")},
+		}
+		test.Ex.Config.MigrateConfig.DryRun = true
+	}, func() {
+		defer func() {
+			test.Ex.Config.MigrateConfig.FS = files
+			test.Ex.Config.MigrateConfig.DryRun = false
+		}()
+		migrator, err := test.Ex.NewMigrator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := migrator.Up(ctx); err != nil {
+			t.Error(err)
+		}
+	}, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+			return strings.Contains(output.String(), "CREATE FUNCTION f() RETURNS int AS $body$ SELECT ';'; $body$ LANGUAGE sql;\n/* a; 'b */ SELECT $$;$$;\n")
+		}},
+		// 分割しない
+		{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+			return strings.Contains(output.String(), "-- migrate:no-split\nCREATE TRIGGER t AFTER INSERT ON users BEGIN\n  SELECT 1;\nEND;\n")
+		}},
+	}...)
+	// mysqlは引用符内のバックスラッシュをエスケープとして扱う
+	test.Job("split_mysql", func() {
+		output.Reset()
+		test.Ex.Config.MigrateConfig.FS = fstest.MapFS{
+			"db/0010_escape.up.sql": {Data: []byte(`INSERT INTO t VALUES ('it\'s; ok', "a\\");SELECT 1;`)},
+		}
+		test.Ex.Config.MigrateConfig.DryRun = true
+		test.Ex.Config.DBConfig.Dialect = ext.DialectMySQL
+	}, func() {
+		defer func() {
+			test.Ex.Config.MigrateConfig.FS = files
+			test.Ex.Config.MigrateConfig.DryRun = false
+			test.Ex.Config.DBConfig.Dialect = ext.DialectSQLite
+		}()
+		migrator, err := test.Ex.NewMigrator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := migrator.Up(ctx); err != nil {
+			t.Error(err)
+		}
+	}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: true, Store: func() interface{} {
+		return strings.Contains(output.String(), "INSERT INTO t VALUES ('it\\'s; ok', \"a\\\\\");\nSELECT 1;\n")
+	}})
+}
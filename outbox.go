@@ -0,0 +1,375 @@
+package gofiber_extend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jrallison/go-workers"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// outboxの種類
+const (
+	OutboxKindJob   = "job"
+	OutboxKindEvent = "event"
+)
+
+// outboxの設定
+type IOutboxConfig struct {
+	Interval    time.Duration // 未配送のoutboxを確認する間隔
+	BatchSize   int           // 1回に配送する件数
+	Backoff     time.Duration // 配送失敗時の再送間隔(失敗する毎に倍にする)
+	MaxBackoff  time.Duration // 再送間隔の上限
+	Retention   time.Duration // 配送済みのoutboxを削除するまでの時間
+	LockKey     string        // 複数ノードで同時に配送しないためのredisのキー
+	LockTimeout time.Duration // 配送中は1件毎に延長する
+	EventBus    IEventBus     // イベントの配送先 未指定の場合はredis streamを使用する
+}
+
+var defaultOutboxConfig *IOutboxConfig = &IOutboxConfig{
+	Interval:    time.Second,
+	BatchSize:   100,
+	Backoff:     time.Second,
+	MaxBackoff:  5 * time.Minute,
+	Retention:   24 * time.Hour,
+	LockKey:     "outbox:relay",
+	LockTimeout: time.Minute,
+}
+
+// トランザクション内で書き込み、コミット後にrelayが配送する
+// 同じAggregateKeyのものは作成順に配送する
+type IOutbox struct {
+	ID           uint64     `gorm:"primaryKey" json:"id"`
+	Kind         string     `gorm:"size:16" json:"kind"`                 // job/event
+	AggregateKey string     `gorm:"size:191;index" json:"aggregate_key"` // 配送順を保証する単位 空の場合は保証しない
+	Destination  string     `gorm:"size:255" json:"destination"`         // ジョブのキューまたはイベントのトピック
+	Class        string     `gorm:"size:255" json:"class"`               // ジョブのクラス
+	Jid          string     `gorm:"size:32" json:"jid"`                  // 再送しても同じjidを使用する
+	Payload      string     `gorm:"type:text" json:"payload"`            // JSON
+	Meta         string     `gorm:"size:1024" json:"meta"`               // リクエストIDとtrace context
+	Attempts     int        `json:"attempts"`                            // 配送に失敗した回数
+	LastError    string     `gorm:"size:1024" json:"last_error"`         // 最後の配送エラー
+	NextAt       *time.Time `json:"next_at,omitempty"`                   // 再送する日時
+	DeliveredAt  *time.Time `gorm:"index" json:"delivered_at,omitempty"` // 配送日時
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+func (IOutbox) TableName() string {
+	return "outbox"
+}
+
+func (p *IFiberEx) MigrateOutbox() error {
+	return UsePrimary(p.DB).AutoMigrate(&IOutbox{})
+}
+
+// 配送するイベント
+type IOutboxEvent struct {
+	Id      uint64 // outboxのID 重複して配送された場合の判定に使用する
+	Topic   string
+	Key     string            // AggregateKey
+	Payload []byte            // JSON
+	Meta    map[string]string // リクエストIDとtrace context
+}
+
+// イベントの配送先
+type IEventBus interface {
+	Publish(ctx context.Context, event *IOutboxEvent) error
+}
+
+// redis streamにイベントを追加する
+type IRedisEventBus struct {
+	Client *redis.Client
+	Prefix string // streamのキーは<Prefix><Topic>
+	MaxLen int64  // streamの最大長(概算) 0の場合は制限しない
+}
+
+func NewRedisEventBus(client *redis.Client) *IRedisEventBus {
+	return &IRedisEventBus{Client: client, Prefix: "events:"}
+}
+
+func (p *IRedisEventBus) Publish(ctx context.Context, event *IOutboxEvent) error {
+	meta, err := json.Marshal(event.Meta)
+	if err != nil {
+		return err
+	}
+	return p.Client.XAdd(ctx, &redis.XAddArgs{
+		Stream: p.Prefix + event.Topic,
+		MaxLen: p.MaxLen,
+		Approx: p.MaxLen > 0,
+		Values: map[string]interface{}{
+			"id":      event.Id,
+			"key":     event.Key,
+			"payload": string(event.Payload),
+			"meta":    string(meta),
+		},
+	}).Err()
+}
+
+func outboxMeta(ctx context.Context) (string, error) {
+	meta := map[string]string{}
+	if requestid := RequestIdFromContext(ctx); requestid != "" {
+		meta["requestid"] = requestid
+	}
+	injectJobTrace(ctx, meta)
+	rs, err := json.Marshal(meta)
+	return string(rs), err
+}
+
+// トランザクション内でジョブをoutboxに書き込む
+// txにはTx(c)等のトランザクションを渡す コミットされた場合のみエンキューされる
+func (p *IFiberEx) OutboxJob(tx *gorm.DB, key string, queue string, class string, args interface{}) error {
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	jid, err := randomHex(12)
+	if err != nil {
+		return err
+	}
+	meta, err := outboxMeta(tx.Statement.Context)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&IOutbox{
+		Kind:         OutboxKindJob,
+		AggregateKey: key,
+		Destination:  queue,
+		Class:        class,
+		Jid:          jid,
+		Payload:      string(payload),
+		Meta:         meta,
+	}).Error
+}
+
+// トランザクション内でイベントをoutboxに書き込む
+func (p *IFiberEx) OutboxEvent(tx *gorm.DB, key string, topic string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	meta, err := outboxMeta(tx.Statement.Context)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&IOutbox{
+		Kind:         OutboxKindEvent,
+		AggregateKey: key,
+		Destination:  topic,
+		Payload:      string(body),
+		Meta:         meta,
+	}).Error
+}
+
+// outboxを配送する 配送後に記録するため、少なくとも1回は配送される(重複する場合がある)
+type IOutboxRelay struct {
+	config *IOutboxConfig
+	db     *gorm.DB
+	redis  *redis.Client
+	nodeId string
+	bus    IEventBus
+	now    func() time.Time
+}
+
+func (p *IFiberEx) NewOutboxRelay() *IOutboxRelay {
+	conf := p.Config.OutboxConfig
+	if conf == nil {
+		conf = defaultOutboxConfig
+	}
+	relay := &IOutboxRelay{
+		config: conf,
+		db:     UsePrimary(p.DB),
+		nodeId: p.NodeId,
+		bus:    conf.EventBus,
+		now:    time.Now,
+	}
+	if p.Config.UseRedis {
+		relay.redis = p.Redis
+		if relay.bus == nil {
+			relay.bus = NewRedisEventBus(p.Redis)
+		}
+	}
+	return relay
+}
+
+// Intervalごとに配送と配送済みの削除を行う ctxが終了するまで戻らない
+func (p *IOutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := p.RelayOnce(ctx); err != nil {
+			ComponentLog(LogComponentJob).Error("outbox.relay", zap.Error(err))
+		}
+		if err := p.Cleanup(ctx); err != nil {
+			ComponentLog(LogComponentJob).Error("outbox.cleanup", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 未配送のoutboxを作成順に配送する 配送した件数を返す
+// 同じAggregateKeyの前のものが再送待ちの場合は配送しない
+func (p *IOutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	lock, ok, err := p.lock(ctx)
+	if err != nil || !ok {
+		return 0, err
+	}
+	defer lock.unlock()
+	now := p.now()
+	// 再送待ちのものと、同じAggregateKeyで前に再送待ちのものがあるものは取得しない
+	// 1つのAggregateKeyが再送待ちでも他のAggregateKeyを配送できるようにする
+	rows := []*IOutbox{}
+	if err := p.db.WithContext(ctx).
+		Where("delivered_at IS NULL AND (next_at IS NULL OR next_at <= ?)", now).
+		Where("aggregate_key = '' OR NOT EXISTS (SELECT 1 FROM outbox AS waiting"+
+			" WHERE waiting.aggregate_key = outbox.aggregate_key AND waiting.id < outbox.id AND waiting.delivered_at IS NULL AND waiting.next_at > ?)", now).
+		Order("id").Limit(p.config.BatchSize).Find(&rows).Error; err != nil {
+		return 0, err
+	}
+	blocked := map[string]bool{}
+	delivered := 0
+	for _, row := range rows {
+		if row.AggregateKey != "" && blocked[row.AggregateKey] {
+			continue
+		}
+		if err := lock.extend(ctx); err != nil {
+			return delivered, err
+		}
+		if err := p.deliver(ctx, row); err != nil {
+			blocked[row.AggregateKey] = true
+			if err := p.retry(ctx, row, err); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		if err := p.db.WithContext(ctx).Model(row).Update("delivered_at", now).Error; err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+func (p *IOutboxRelay) deliver(ctx context.Context, row *IOutbox) error {
+	meta := map[string]string{}
+	if row.Meta != "" {
+		if err := json.Unmarshal([]byte(row.Meta), &meta); err != nil {
+			return err
+		}
+	}
+	switch row.Kind {
+	case OutboxKindJob:
+		return jobPush(&jobEnqueueData{
+			EnqueueData: workers.EnqueueData{
+				Queue: row.Destination,
+				Class: row.Class,
+				Args:  json.RawMessage(row.Payload),
+				Jid:   row.Jid,
+			},
+			Meta: meta,
+		})
+	case OutboxKindEvent:
+		if p.bus == nil {
+			return fmt.Errorf("outbox: event bus is not configured")
+		}
+		return p.bus.Publish(ctx, &IOutboxEvent{
+			Id:      row.ID,
+			Topic:   row.Destination,
+			Key:     row.AggregateKey,
+			Payload: []byte(row.Payload),
+			Meta:    meta,
+		})
+	}
+	return fmt.Errorf("outbox: unknown kind %q", row.Kind)
+}
+
+// 失敗回数に応じて再送を遅らせる
+func (p *IOutboxRelay) retry(ctx context.Context, row *IOutbox, cause error) error {
+	backoff := p.config.Backoff << row.Attempts
+	if backoff <= 0 || backoff > p.config.MaxBackoff {
+		backoff = p.config.MaxBackoff
+	}
+	next := p.now().Add(backoff)
+	message := cause.Error()
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	ComponentLog(LogComponentJob).Warn("outbox.deliver_failed",
+		zap.Uint64("id", row.ID),
+		zap.String("kind", row.Kind),
+		zap.String("destination", row.Destination),
+		zap.Int("attempts", row.Attempts+1),
+		zap.Error(cause),
+	)
+	return p.db.WithContext(ctx).Model(row).Updates(map[string]interface{}{
+		"attempts":   row.Attempts + 1,
+		"last_error": message,
+		"next_at":    next,
+	}).Error
+}
+
+// Retentionを過ぎた配送済みのoutboxを削除する
+func (p *IOutboxRelay) Cleanup(ctx context.Context) error {
+	return p.db.WithContext(ctx).Where("delivered_at < ?", p.now().Add(-p.config.Retention)).Delete(&IOutbox{}).Error
+}
+
+// 配送中のロック redisを使用しない場合は何もしない
+type outboxLock struct {
+	redis   *redis.Client
+	key     string
+	token   string
+	timeout time.Duration
+}
+
+// 有効期限を延長する 他のノードに取得された場合はエラー
+func (p *outboxLock) extend(ctx context.Context) error {
+	if p.redis == nil {
+		return nil
+	}
+	ok, err := redisExtendScript.Run(ctx, p.redis, []string{p.key}, p.token, p.timeout.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return fmt.Errorf("outbox: lock lost: %s", p.key)
+	}
+	return nil
+}
+
+func (p *outboxLock) unlock() {
+	if p.redis == nil {
+		return
+	}
+	if err := redisUnlockScript.Run(background, p.redis, []string{p.key}, p.token).Err(); err != nil {
+		ComponentLog(LogComponentJob).Warn("outbox.unlock", zap.Error(err))
+	}
+}
+
+// redisを使用している場合は1ノードのみ配送する
+func (p *IOutboxRelay) lock(ctx context.Context) (*outboxLock, bool, error) {
+	if p.redis == nil {
+		return &outboxLock{}, true, nil
+	}
+	token, err := randomHex(8)
+	if err != nil {
+		return nil, false, err
+	}
+	lock := &outboxLock{redis: p.redis, key: p.config.LockKey, token: p.nodeId + ":" + token, timeout: p.config.LockTimeout}
+	ok, err := p.redis.SetNX(ctx, lock.key, lock.token, lock.timeout).Result()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return lock, true, nil
+}
+
+// 配送を開始する
+func (p *IFiberEx) OutboxRun(ctx context.Context) {
+	go p.NewOutboxRelay().Run(ctx)
+}
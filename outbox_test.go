@@ -0,0 +1,216 @@
+package gofiber_extend_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jrallison/go-workers"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"gorm.io/gorm"
+)
+
+// 指定されたトピックの配送に1回失敗するイベントバス
+type testEventBus struct {
+	mutex     sync.Mutex
+	fail      map[string]bool
+	topics    []string
+	onPublish func() // 配送時に呼び出す
+}
+
+func (p *testEventBus) Publish(ctx context.Context, event *ext.IOutboxEvent) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.onPublish != nil {
+		p.onPublish()
+	}
+	if p.fail[event.Topic] {
+		delete(p.fail, event.Topic)
+		return fmt.Errorf("publish failed")
+	}
+	p.topics = append(p.topics, event.Topic)
+	return nil
+}
+
+func (p *testEventBus) published() interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return strings.Join(p.topics, ",")
+}
+
+func TestOutbox(t *testing.T) {
+	bus := &testEventBus{fail: map[string]bool{}}
+	test := newSQLiteTest(t, ext.IFiberExConfig{
+		UseRedis: true,
+		OutboxConfig: &ext.IOutboxConfig{
+			Backoff:   time.Millisecond,
+			Retention: time.Nanosecond,
+			EventBus:  bus,
+		},
+	})
+	workers.Configure(map[string]string{
+		"server":  test.Redis.Addr(),
+		"process": "1",
+	})
+	if err := test.Ex.MigrateOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	test.Routes(func(app *fiber.App) {
+		app.Post("/orders/:id/:status", test.Ex.TxMiddleware(), func(c *fiber.Ctx) error {
+			tx := test.Ex.Tx(c)
+			id := c.Params("id")
+			if err := test.Ex.OutboxJob(tx, "order:"+id, "test_outbox", "order_created", map[string]string{"id": id}); err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			if err := test.Ex.OutboxEvent(tx, "order:"+id, "order_created_"+id, map[string]string{"id": id}); err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			if c.Params("status") != "200" {
+				return test.Ex.ResultError(c, 400, fmt.Errorf("rollback"))
+			}
+			return test.Ex.Result(c, 200, id)
+		})
+	})
+	relay := test.Ex.NewOutboxRelay()
+	ctx := context.Background()
+	pending := func() interface{} {
+		var count int64
+		if err := ext.DB.Model(&ext.IOutbox{}).Where("delivered_at IS NULL").Count(&count).Error; err != nil {
+			return err
+		}
+		return int(count)
+	}
+	queued := func() interface{} {
+		if !test.Redis.Exists("queue:test_outbox") {
+			return ""
+		}
+		jobs, err := test.Redis.List("queue:test_outbox")
+		if err != nil {
+			return err.Error()
+		}
+		rs := []string{}
+		for _, job := range jobs {
+			msg, err := workers.NewMsg(job)
+			if err != nil {
+				return err.Error()
+			}
+			rs = append(rs, msg.Args().Get("id").MustString())
+		}
+		return strings.Join(rs, ",")
+	}
+	relayOnce := func(want int) func() {
+		return func() {
+			if delivered, err := relay.RelayOnce(ctx); err != nil || delivered != want {
+				t.Errorf("relay: %d, %v", delivered, err)
+			}
+		}
+	}
+
+	test.Api("commit", &ext.ITestRequest{Method: "POST", Path: "/orders/1/200"}, 200, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: 2, Store: pending},
+		{Method: ext.TestMethodEqual, Want: "", Store: queued},
+	}...)
+	test.Api("rollback", &ext.ITestRequest{Method: "POST", Path: "/orders/2/400"}, 400, &ext.ITestCase{
+		Method: ext.TestMethodEqual, Want: 2, Store: pending,
+	})
+	test.Job("relay", func() {}, relayOnce(2), []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: 0, Store: pending},
+		{Method: ext.TestMethodEqual, Want: "1", Store: queued},
+		{Method: ext.TestMethodEqual, Want: "order_created_1", Store: bus.published},
+	}...)
+
+	test.Job("ordering", func() {
+		bus.fail["a1"] = true
+		if err := ext.DB.Transaction(func(tx *gorm.DB) error {
+			for _, event := range [][]string{{"a", "a1"}, {"a", "a2"}, {"b", "b1"}} {
+				if err := test.Ex.OutboxEvent(tx, event[0], event[1], nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}, relayOnce(1), []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: 2, Store: pending},
+		{Method: ext.TestMethodEqual, Want: "order_created_1,b1", Store: bus.published},
+	}...)
+	test.Job("retry", func() {
+		time.Sleep(10 * time.Millisecond)
+	}, relayOnce(2), []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: 0, Store: pending},
+		{Method: ext.TestMethodEqual, Want: "order_created_1,b1,a1,a2", Store: bus.published},
+	}...)
+
+	test.Job("locked", func() {
+		if err := test.Redis.Set("outbox:relay", "other"); err != nil {
+			t.Fatal(err)
+		}
+		if err := test.Ex.OutboxJob(ext.DB, "", "test_outbox", "order_created", map[string]string{"id": "3"}); err != nil {
+			t.Fatal(err)
+		}
+	}, relayOnce(0), &ext.ITestCase{Method: ext.TestMethodEqual, Want: 1, Store: pending})
+
+	test.Job("cleanup", func() {
+		test.Redis.Del("outbox:relay")
+	}, func() {
+		relayOnce(1)()
+		if err := relay.Cleanup(ctx); err != nil {
+			t.Error(err)
+		}
+	}, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: "1,3", Store: queued},
+		{Method: ext.TestMethodEqual, Want: 0, Store: func() interface{} {
+			var count int64
+			ext.DB.Model(&ext.IOutbox{}).Count(&count)
+			return int(count)
+		}},
+	}...)
+
+	// 再送待ちのAggregateKeyが他のAggregateKeyの配送を妨げない
+	test.Job("starvation", func() {
+		bus.topics = nil
+		test.Ex.Config.OutboxConfig.BatchSize = 2
+		if err := ext.DB.Transaction(func(tx *gorm.DB) error {
+			for _, event := range [][]string{{"c", "c1"}, {"c", "c2"}, {"c", "c3"}, {"d", "d1"}} {
+				if err := test.Ex.OutboxEvent(tx, event[0], event[1], nil); err != nil {
+					return err
+				}
+			}
+			return tx.Model(&ext.IOutbox{}).Where("destination = ?", "c1").Update("next_at", time.Now().Add(time.Hour)).Error
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}, func() {
+		defer func() { test.Ex.Config.OutboxConfig.BatchSize = 100 }()
+		relayOnce(1)()
+	}, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: "d1", Store: bus.published},
+		{Method: ext.TestMethodEqual, Want: 3, Store: pending},
+	}...)
+	// 配送中はロックを延長する
+	locked := []string{}
+	test.Job("lock_extend", func() {
+		if err := ext.DB.Where("delivered_at IS NULL").Delete(&ext.IOutbox{}).Error; err != nil {
+			t.Fatal(err)
+		}
+		for _, topic := range []string{"e1", "e2", "e3"} {
+			if err := test.Ex.OutboxEvent(ext.DB, "", topic, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bus.onPublish = func() {
+			test.Redis.FastForward(40 * time.Second)
+			locked = append(locked, fmt.Sprint(test.Redis.Exists("outbox:relay")))
+		}
+	}, func() {
+		defer func() { bus.onPublish = nil }()
+		relayOnce(3)()
+	}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: "true,true,true", Store: func() interface{} {
+		return strings.Join(locked, ",")
+	}})
+}
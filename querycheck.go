@@ -0,0 +1,139 @@
+package gofiber_extend
+
+import (
+	"context"
+	"regexp"
+	"sync"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/utils"
+)
+
+// リクエスト中に実行されたクエリ
+type recordedQuery struct {
+	shape  string
+	sql    string
+	caller string
+}
+
+// リクエスト中のクエリを記録する
+type queryRecorder struct {
+	mutex   sync.Mutex
+	queries []*recordedQuery
+}
+
+func newQueryRecorder() *queryRecorder {
+	return &queryRecorder{}
+}
+
+func (p *queryRecorder) add(query *recordedQuery) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.queries = append(p.queries, query)
+}
+
+func (p *queryRecorder) count() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.queries)
+}
+
+// 同じ形のクエリがthreshold回以上実行されたもの
+func (p *queryRecorder) repeated(threshold int) [][]*recordedQuery {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	shapes := []string{}
+	groups := map[string][]*recordedQuery{}
+	for _, query := range p.queries {
+		if _, ok := groups[query.shape]; !ok {
+			shapes = append(shapes, query.shape)
+		}
+		groups[query.shape] = append(groups[query.shape], query)
+	}
+	rs := [][]*recordedQuery{}
+	for _, shape := range shapes {
+		if len(groups[shape]) >= threshold {
+			rs = append(rs, groups[shape])
+		}
+	}
+	return rs
+}
+
+func contextWithQueryRecorder(ctx context.Context, recorder *queryRecorder) context.Context {
+	return context.WithValue(ctx, contextKeyQueries, recorder)
+}
+
+func queryRecorderFromContext(ctx context.Context) *queryRecorder {
+	if ctx != nil {
+		if recorder, ok := ctx.Value(contextKeyQueries).(*queryRecorder); ok {
+			return recorder
+		}
+	}
+	return nil
+}
+
+var (
+	queryShapeIn      = regexp.MustCompile(`\?(\s*,\s*\?)+`)
+	queryShapeLiteral = regexp.MustCompile(`'(?:[^']|'')*'|\b\d+\b`)
+)
+
+// 値を除いたクエリの形 IN句の要素数の違いも同じ形とみなす
+func queryShape(sql string) string {
+	return queryShapeIn.ReplaceAllString(queryShapeLiteral.ReplaceAllString(sql, "?"), "?")
+}
+
+// gormのコールバックでリクエスト毎のクエリを記録するプラグイン
+type queryCheckPlugin struct{}
+
+func (p *queryCheckPlugin) Name() string {
+	return "query_check"
+}
+
+func (p *queryCheckPlugin) Initialize(db *gorm.DB) error {
+	after := func(db *gorm.DB) {
+		recorder := queryRecorderFromContext(db.Statement.Context)
+		if recorder == nil {
+			return
+		}
+		sql := db.Statement.SQL.String()
+		recorder.add(&recordedQuery{shape: queryShape(sql), sql: sql, caller: utils.FileWithLineNum()})
+	}
+	return registerAround(db, "query_check", nil, anyOperation(after))
+}
+
+// クエリのチェックを行うか DevModeとTestModeのみ
+func (p *IFiberExConfig) queryCheck() bool {
+	return (p.DevMode != nil && *p.DevMode) || (p.TestMode != nil && *p.TestMode)
+}
+
+// N+1の疑いがあるクエリをログに出力する
+func (p *IFiberEx) reportQueries(ctx context.Context, recorder *queryRecorder) {
+	if p.Config.DBConfig == nil || p.Config.DBConfig.RepeatThreshold <= 0 {
+		return
+	}
+	for _, queries := range recorder.repeated(p.Config.DBConfig.RepeatThreshold) {
+		callers := []string{}
+		for _, query := range queries {
+			callers = append(callers, query.caller)
+		}
+		ComponentLoggerFromContext(ctx, LogComponentDB).Warn("db.n_plus_one",
+			zap.String("shape", queries[0].shape),
+			zap.String("sql", queries[0].sql),
+			zap.Int("count", len(queries)),
+			zap.Strings("callers", uniqueStrings(callers)),
+		)
+	}
+}
+
+func uniqueStrings(src []string) []string {
+	rs := []string{}
+	found := map[string]bool{}
+	for _, s := range src {
+		if !found[s] {
+			found[s] = true
+			rs = append(rs, s)
+		}
+	}
+	return rs
+}
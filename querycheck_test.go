@@ -0,0 +1,82 @@
+package gofiber_extend_test
+
+import (
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type queryCheckUser struct {
+	ID    uint
+	Name  string
+	Posts []queryCheckPost `gorm:"foreignKey:UserID"`
+}
+
+type queryCheckPost struct {
+	ID     uint
+	UserID uint
+	Title  string
+}
+
+func TestQueryCheck(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	ext.Log = zap.New(core)
+	defer func() { ext.Log = nil }()
+
+	test := newSQLiteTest(t, ext.IFiberExConfig{
+		DBConfig: &ext.IDBConfig{
+			RepeatThreshold: 3,
+		},
+	})
+	if err := test.Ex.DB.AutoMigrate(&queryCheckUser{}, &queryCheckPost{}); err != nil {
+		t.Fatal(err)
+	}
+	test.Routes(func(app *fiber.App) {
+		// ユーザ毎に投稿を取得する(N+1)
+		app.Get("/users/loop", func(c *fiber.Ctx) error {
+			db := test.Ex.DB.WithContext(test.Ex.Context(c))
+			users := []queryCheckUser{}
+			if err := db.Find(&users).Error; err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			for i := range users {
+				if err := db.Where("user_id = ?", users[i].ID).Find(&users[i].Posts).Error; err != nil {
+					return test.Ex.ResultError(c, 500, err)
+				}
+			}
+			return test.Ex.Result(c, 200, users)
+		})
+		app.Get("/users/preload", func(c *fiber.Ctx) error {
+			users := []queryCheckUser{}
+			if err := test.Ex.DB.WithContext(test.Ex.Context(c)).Preload("Posts").Find(&users).Error; err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			return test.Ex.Result(c, 200, users)
+		})
+	})
+	test.Run("n_plus_one", func() {
+		for _, name := range []string{"a", "b", "c"} {
+			user := &queryCheckUser{Name: name, Posts: []queryCheckPost{{Title: name}}}
+			if err := test.Ex.DB.Create(user).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		test.Api("loop", &ext.ITestRequest{Method: "GET", Path: "/users/loop"}, 200, &ext.ITestCase{
+			Method: ext.TestMethodLen,
+			Want:   1,
+			Store: func() interface{} {
+				return logs.FilterMessage("db.n_plus_one").Len()
+			},
+		})
+		test.Api("preload", &ext.ITestRequest{Method: "GET", Path: "/users/preload"}, 200, test.AssertMaxQueries(2), &ext.ITestCase{
+			Method: ext.TestMethodLen,
+			Want:   1,
+			Store: func() interface{} {
+				return logs.FilterMessage("db.n_plus_one").Len()
+			},
+		})
+	})
+}
@@ -0,0 +1,194 @@
+package gofiber_extend
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/imdario/mergo"
+	"github.com/redis/go-redis/v9"
+)
+
+type IRateLimitAlgorithm int
+
+const (
+	RateLimitSlidingWindow IRateLimitAlgorithm = iota // 直近Window内のリクエスト数で制限する
+	RateLimitTokenBucket                              // Window毎にMax個のトークンを補充する
+)
+
+type IRateLimitConfig struct {
+	Algorithm    IRateLimitAlgorithm
+	Max          int                     // Window内の最大リクエスト数(トークンバケットの容量)
+	Window       time.Duration           // 集計期間
+	Prefix       string                  // redisキーのプレフィックス
+	KeyGenerator func(*fiber.Ctx) string // 制限単位のキー
+	Skip         func(*fiber.Ctx) bool   // trueの場合は制限しない
+	LimitReached func(*fiber.Ctx) error  // 制限超過時のレスポンス
+}
+
+var defaultRateLimitConfig *IRateLimitConfig = &IRateLimitConfig{
+	Algorithm:    RateLimitSlidingWindow,
+	Max:          60,
+	Window:       time.Minute,
+	Prefix:       "ratelimit:",
+	KeyGenerator: RateLimitKeyIP,
+}
+
+// 接続元IP単位
+func RateLimitKeyIP(c *fiber.Ctx) string {
+	return "ip:" + c.IP()
+}
+
+// ユーザ単位 未ログインの場合はIP単位
+func RateLimitKeyUserId(c *fiber.Ctx) string {
+	if userid, ok := c.Locals("userid").(string); ok && userid != "" && userid != "-" {
+		return "user:" + userid
+	}
+	return RateLimitKeyIP(c)
+}
+
+// APIキー単位 キーがない場合はIP単位
+func RateLimitKeyApiKey(c *fiber.Ctx) string {
+	if key := c.Get(ApiKeyHeader); key != "" {
+		return "apikey:" + key
+	}
+	return RateLimitKeyIP(c)
+}
+
+// ルート毎のIP単位
+// c.Route()は登録したハンドラのルートのため、app.Useやgroup.Useではなくルート毎に登録する
+// app.Use("/api", ...)の場合は/api以下の全てのルートで同じキーになる
+func RateLimitKeyRoute(c *fiber.Ctx) string {
+	return "route:" + c.Method() + ":" + c.Route().Path + ":" + c.IP()
+}
+
+// ノード間の時刻のずれの影響を受けないようにredisの時刻(ms)を使用する
+const rateLimitNow = `
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+`
+
+// KEYS[1]: キー ARGV: Window(ms), Max, メンバー
+var rateLimitSlidingWindowScript = redis.NewScript(rateLimitNow + `
+local key = KEYS[1]
+local window = tonumber(ARGV[1])
+local max = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", key, "-inf", now - window)
+local count = redis.call("ZCARD", key)
+local allowed = 0
+if count < max then
+	redis.call("ZADD", key, now, ARGV[3])
+	count = count + 1
+	allowed = 1
+end
+redis.call("PEXPIRE", key, window)
+local reset = window
+local oldest = redis.call("ZRANGE", key, 0, 0, "WITHSCORES")
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, max - count, reset}
+`)
+
+// KEYS[1]: キー ARGV: Window(ms), Max
+var rateLimitTokenBucketScript = redis.NewScript(rateLimitNow + `
+local key = KEYS[1]
+local window = tonumber(ARGV[1])
+local max = tonumber(ARGV[2])
+local rate = max / window
+local state = redis.call("HMGET", key, "tokens", "ts")
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil then
+	tokens = max
+	ts = now
+end
+if now > ts then
+	tokens = math.min(max, tokens + (now - ts) * rate)
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HSET", key, "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", key, window)
+local reset = math.ceil((max - tokens) / rate)
+if allowed == 0 then
+	reset = math.ceil((1 - tokens) / rate)
+end
+return {allowed, math.floor(tokens), reset}
+`)
+
+type IRateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     time.Duration // 制限が解除(トークンが満杯)になるまでの時間
+}
+
+// 制限の判定
+func (p *IFiberEx) RateLimit(config *IRateLimitConfig, key string) (*IRateLimitResult, error) {
+	window := config.Window.Milliseconds()
+	var cmd *redis.Cmd
+	switch config.Algorithm {
+	case RateLimitTokenBucket:
+		cmd = rateLimitTokenBucketScript.Run(background, p.Redis, []string{config.Prefix + key}, window, config.Max)
+	default:
+		member, err := randomHex(8) // 同一時刻のリクエストを区別する
+		if err != nil {
+			return nil, err
+		}
+		cmd = rateLimitSlidingWindowScript.Run(background, p.Redis, []string{config.Prefix + key}, window, config.Max, member)
+	}
+	values, err := cmd.Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 3 {
+		return nil, fmt.Errorf("rate limit: unexpected result: %+v", values)
+	}
+	return &IRateLimitResult{
+		Allowed:   values[0] == 1,
+		Limit:     config.Max,
+		Remaining: int(values[1]),
+		Reset:     time.Duration(values[2]) * time.Millisecond,
+	}, nil
+}
+
+// redisを共有する複数ノード間で有効なレート制限
+func (p *IFiberEx) RateLimiter(config ...IRateLimitConfig) func(*fiber.Ctx) error {
+	conf := IRateLimitConfig{}
+	if len(config) > 0 {
+		conf = config[0]
+	}
+	if err := mergo.Merge(&conf, defaultRateLimitConfig); err != nil {
+		panic(err)
+	}
+	if conf.LimitReached == nil {
+		conf.LimitReached = func(c *fiber.Ctx) error {
+			return p.ResultError(c, 429, fmt.Errorf("rate limit exceeded: %s", conf.KeyGenerator(c)), E42901.Errors()...)
+		}
+	}
+	return func(c *fiber.Ctx) error {
+		if conf.Skip != nil && conf.Skip(c) {
+			return c.Next()
+		}
+		rs, err := p.RateLimit(&conf, conf.KeyGenerator(c))
+		if err != nil {
+			// redis障害時はリクエストを通す
+			p.Log.Error(fmt.Sprintf("rate limit: %s", err))
+			return c.Next()
+		}
+		reset := strconv.FormatInt(int64((rs.Reset+time.Second-1)/time.Second), 10)
+		c.Set("RateLimit-Limit", strconv.Itoa(rs.Limit))
+		c.Set("RateLimit-Remaining", strconv.Itoa(rs.Remaining))
+		c.Set("RateLimit-Reset", reset)
+		if !rs.Allowed {
+			c.Set(fiber.HeaderRetryAfter, reset)
+			return conf.LimitReached(c)
+		}
+		return c.Next()
+	}
+}
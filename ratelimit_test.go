@@ -0,0 +1,57 @@
+package gofiber_extend_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRateLimiter(t *testing.T) {
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		DevMode:      ext.Bool(true),
+		UseRedis:     true,
+		RedisOptions: &redis.Options{},
+	})
+	// スクリプトはredisの時刻を使用する
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.Local)
+	test.Redis.SetTime(now)
+	test.Routes(func(app *fiber.App) {
+		app.Get("/sliding", test.Ex.RateLimiter(ext.IRateLimitConfig{
+			Max:    2,
+			Window: time.Minute,
+		}), func(c *fiber.Ctx) error {
+			return test.Ex.Result(c, 200, map[string]interface{}{"status": "ok"})
+		})
+		app.Get("/bucket", test.Ex.RateLimiter(ext.IRateLimitConfig{
+			Algorithm:    ext.RateLimitTokenBucket,
+			Max:          2,
+			Window:       time.Minute,
+			KeyGenerator: ext.RateLimitKeyRoute,
+		}), func(c *fiber.Ctx) error {
+			return test.Ex.Result(c, 200, map[string]interface{}{"status": "ok"})
+		})
+	})
+	test.Run("sliding_window", func() {
+		test.Api("first", &ext.ITestRequest{Method: "GET", Path: "/sliding"}, 200)
+		test.Api("second", &ext.ITestRequest{Method: "GET", Path: "/sliding"}, 200)
+		test.Api("limited", &ext.ITestRequest{Method: "GET", Path: "/sliding"}, 429, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   `$.error[0].code`,
+			Want:   "E42901",
+		})
+		test.Redis.SetTime(now.Add(time.Minute + time.Second))
+		test.Api("window_passed", &ext.ITestRequest{Method: "GET", Path: "/sliding"}, 200)
+	})
+	test.Run("token_bucket", func() {
+		test.Redis.SetTime(now)
+		test.Api("first", &ext.ITestRequest{Method: "GET", Path: "/bucket"}, 200)
+		test.Api("second", &ext.ITestRequest{Method: "GET", Path: "/bucket"}, 200)
+		test.Api("limited", &ext.ITestRequest{Method: "GET", Path: "/bucket"}, 429)
+		test.Redis.SetTime(now.Add(30 * time.Second)) // 1トークン補充される
+		test.Api("refilled", &ext.ITestRequest{Method: "GET", Path: "/bucket"}, 200)
+		test.Api("empty", &ext.ITestRequest{Method: "GET", Path: "/bucket"}, 429)
+	})
+}
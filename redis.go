@@ -1,25 +1,119 @@
 package gofiber_extend
 
 import (
+	"context"
 	"encoding/json"
+	"net"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
 )
 
-func (p *IFiberExConfig) NewRedis() *redis.Client {
-	client := redis.NewClient(p.RedisOptions)
+// 値が一致する場合のみ削除する 他のノードが取得したロックを解放しないようにする
+var redisUnlockScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`)
+
+// 値が一致する場合のみ有効期限(ミリ秒)を延長する
+var redisExtendScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) end return 0`)
+
+// hooksはログのhookの後に追加する
+// go-redisはNewClientでMinIdleConnsの接続を開始し、その後のAddHookと競合するため
+// MinIdleConnsを0として作成し、hookを追加した後に接続を作成する
+func (p *IFiberExConfig) NewRedis(hooks ...redis.Hook) *redis.Client {
+	opt := *p.RedisOptions
+	opt.MinIdleConns = 0
+	client := redis.NewClient(&opt)
 	if client == nil {
 		panic("connection error: redis")
 	}
+	client.AddHook(&redisLogHook{})
+	for _, hook := range hooks {
+		client.AddHook(hook)
+	}
+	warmRedis(client, p.RedisOptions.MinIdleConns, p.RedisOptions.DialTimeout)
 	return client
 }
 
+// n個の接続を作成してプールに戻す 接続できない場合は最初の使用時に接続する
+func warmRedis(client *redis.Client, n int, timeout time.Duration) {
+	if n <= 0 {
+		return
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(background, timeout)
+	defer cancel()
+	conns := make([]*redis.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		conn := client.Conn()
+		conns = append(conns, conn)
+		if err := conn.Ping(ctx).Err(); err != nil {
+			return
+		}
+	}
+}
+
+// contextのloggerへコマンドを出力するhook
+type redisLogHook struct{}
+
+func (p *redisLogHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (p *redisLogHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		p.log(ctx, start, err, cmd)
+		return err
+	}
+}
+
+func (p *redisLogHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		p.log(ctx, start, err, cmds...)
+		return err
+	}
+}
+
+func (p *redisLogHook) log(ctx context.Context, start time.Time, err error, cmds ...redis.Cmder) {
+	log := ComponentLoggerFromContext(ctx, LogComponentRedis)
+	if log == nil {
+		return
+	}
+	names := []string{}
+	for _, cmd := range cmds {
+		names = append(names, cmd.Name())
+	}
+	fields := []zap.Field{
+		zap.String("elaps", time.Since(start).String()),
+		zap.Strings("cmd", names),
+	}
+	if err != nil && err != redis.Nil {
+		log.Warn(err.Error(), fields...)
+		return
+	}
+	log.Debug("redis.command", fields...)
+}
+
 // json型から変換して取得
+// 存在しない場合はrsを変更せずnilを返す 区別する場合はCache[T]を使用する
 func (p *IFiberEx) GetRedisJson(rs interface{}, key string) error {
 	cmd := p.Redis.Get(background, key)
-	if cmd.Err() != nil {
+	if cmd.Err() == redis.Nil {
 		return nil
+	} else if cmd.Err() != nil {
+		return cmd.Err()
 	}
 	value, _ := cmd.Result()
 	if err := json.Unmarshal([]byte(value), &rs); err != nil {
@@ -0,0 +1,24 @@
+package gofiber_extend_test
+
+import (
+	"testing"
+
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestNewRedis(t *testing.T) {
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		UseRedis:     true,
+		RedisOptions: &redis.Options{MinIdleConns: 3},
+	})
+	test.Job("min_idle_conns", func() {}, func() {}, []*ext.ITestCase{
+		// hookの追加後にMinIdleConnsの接続を作成する
+		{Method: ext.TestMethodEqual, Want: uint32(3), Store: func() interface{} {
+			return test.Ex.Redis.PoolStats().IdleConns
+		}},
+		{Method: ext.TestMethodEqual, Want: 3, Store: func() interface{} {
+			return test.Ex.Config.RedisOptions.MinIdleConns
+		}},
+	}...)
+}
@@ -0,0 +1,309 @@
+package gofiber_extend
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+// レプリカの選択方法
+const (
+	ReplicaPolicyRandom     = "random"
+	ReplicaPolicyRoundRobin = "round_robin"
+)
+
+// レプリカの状態
+type IReplicaStatus struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+type replicaHealth struct {
+	name    string
+	pool    gorm.ConnPool
+	healthy int32
+	err     atomic.Value // string
+}
+
+func (p *replicaHealth) status() IReplicaStatus {
+	rs := IReplicaStatus{Name: p.name, Healthy: atomic.LoadInt32(&p.healthy) == 1}
+	rs.Error, _ = p.err.Load().(string)
+	return rs
+}
+
+// 読み込み用のレプリカ
+type replicaSet struct {
+	policy   string
+	replicas []*replicaHealth
+	counter  uint64
+	stop     context.CancelFunc // ヘルスチェックを停止する
+}
+
+// 接続中のレプリカ
+var dbReplicas *replicaSet
+
+// 正常なレプリカから選択する dbresolverのPolicy
+func (p *replicaSet) Resolve(pools []gorm.ConnPool) gorm.ConnPool {
+	healthy := []gorm.ConnPool{}
+	for _, pool := range pools {
+		if p.healthy(pool) {
+			healthy = append(healthy, pool)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = pools
+	}
+	if p.policy == ReplicaPolicyRoundRobin {
+		return healthy[(atomic.AddUint64(&p.counter, 1)-1)%uint64(len(healthy))]
+	}
+	return healthy[rand.Intn(len(healthy))]
+}
+
+func (p *replicaSet) healthy(pool gorm.ConnPool) bool {
+	for _, replica := range p.replicas {
+		if replica.pool == pool {
+			return atomic.LoadInt32(&replica.healthy) == 1
+		}
+	}
+	return true
+}
+
+func (p *replicaSet) anyHealthy() bool {
+	for _, replica := range p.replicas {
+		if atomic.LoadInt32(&replica.healthy) == 1 {
+			return true
+		}
+	}
+	return len(p.replicas) == 0
+}
+
+// レプリカにpingして状態を更新する
+func (p *replicaSet) check(ctx context.Context) {
+	for _, replica := range p.replicas {
+		var err error
+		if pinger, ok := replica.pool.(interface{ PingContext(context.Context) error }); ok {
+			err = pinger.PingContext(ctx)
+		}
+		if err != nil {
+			atomic.StoreInt32(&replica.healthy, 0)
+			replica.err.Store(err.Error())
+			ComponentLog(LogComponentDB).Warn("db.replica_unhealthy", zap.String("replica", replica.name), zap.Error(err))
+			continue
+		}
+		atomic.StoreInt32(&replica.healthy, 1)
+		replica.err.Store("")
+	}
+}
+
+// 開始時に1回チェックし、以降はinterval毎にチェックする closeで停止する
+func (p *replicaSet) start(interval time.Duration) {
+	ctx, cancel := context.WithCancel(background)
+	p.stop = cancel
+	go p.run(ctx, interval)
+}
+
+func (p *replicaSet) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		check, cancel := context.WithTimeout(ctx, interval)
+		p.check(check)
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *replicaSet) close() {
+	if p.stop != nil {
+		p.stop()
+	}
+}
+
+func (p *replicaSet) statuses() []IReplicaStatus {
+	rs := []IReplicaStatus{}
+	for _, replica := range p.replicas {
+		rs = append(rs, replica.status())
+	}
+	return rs
+}
+
+// レプリカの状態 レプリカを使用していない場合はnil
+func ReplicaStatuses() []IReplicaStatus {
+	if dbReplicas == nil {
+		return nil
+	}
+	return dbReplicas.statuses()
+}
+
+// 書き込み後のリクエストではレプリカの遅延を避けるためプライマリを使用する
+type requestDBState struct {
+	written int32
+}
+
+func contextWithDBState(ctx context.Context, state *requestDBState) context.Context {
+	return context.WithValue(ctx, contextKeyDBState, state)
+}
+
+func dbStateFromContext(ctx context.Context) *requestDBState {
+	if ctx != nil {
+		if state, ok := ctx.Value(contextKeyDBState).(*requestDBState); ok {
+			return state
+		}
+	}
+	return nil
+}
+
+// 以降のクエリをプライマリで実行する
+func UsePrimary(db *gorm.DB) *gorm.DB {
+	return db.Clauses(dbresolver.Write)
+}
+
+// 書き込み後でもレプリカで実行する
+func UseReplica(db *gorm.DB) *gorm.DB {
+	return db.Clauses(dbresolver.Read)
+}
+
+func (p *replicaSet) forcePrimary(db *gorm.DB) {
+	if _, ok := db.Statement.Settings.Load("gorm:db_resolver:read"); ok {
+		return
+	}
+	state := dbStateFromContext(db.Statement.Context)
+	if (state != nil && atomic.LoadInt32(&state.written) == 1) || !p.anyHealthy() {
+		dbresolver.Write.ModifyStatement(db.Statement)
+	}
+}
+
+func (p *replicaSet) markWritten(db *gorm.DB) {
+	if state := dbStateFromContext(db.Statement.Context); state != nil {
+		atomic.StoreInt32(&state.written, 1)
+	}
+}
+
+func (p *replicaSet) markRawWritten(db *gorm.DB) {
+	sql := strings.TrimSpace(db.Statement.SQL.String())
+	if len(sql) < 6 || !strings.EqualFold(sql[:6], "select") {
+		p.markWritten(db)
+	}
+}
+
+func (p *replicaSet) registerCallbacks(db *gorm.DB) error {
+	callback := db.Callback()
+	if err := callback.Query().Before("gorm:query").Register("replica:primary_query", p.forcePrimary); err != nil {
+		return err
+	}
+	if err := callback.Row().Before("gorm:row").Register("replica:primary_row", p.forcePrimary); err != nil {
+		return err
+	}
+	if err := callback.Raw().Before("gorm:raw").Register("replica:primary_raw", p.forcePrimary); err != nil {
+		return err
+	}
+	if err := callback.Create().After("gorm:create").Register("replica:written_create", p.markWritten); err != nil {
+		return err
+	}
+	if err := callback.Update().After("gorm:update").Register("replica:written_update", p.markWritten); err != nil {
+		return err
+	}
+	if err := callback.Delete().After("gorm:delete").Register("replica:written_delete", p.markWritten); err != nil {
+		return err
+	}
+	return callback.Raw().After("gorm:raw").Register("replica:written_raw", p.markRawWritten)
+}
+
+// 未指定の接続情報はプライマリから引き継ぐ
+func (p *IDBConfig) replicaConfig(primary *IDBConfig) *IDBConfig {
+	rs := *p
+	if rs.Dialect == "" {
+		rs.Dialect = primary.Dialect
+	}
+	if rs.Dsn != "" {
+		return &rs
+	}
+	if rs.User == "" {
+		rs.User, rs.Pass = primary.User, primary.Pass
+	}
+	if rs.DBName == "" {
+		rs.DBName = primary.DBName
+	}
+	if rs.TLS == "" {
+		rs.TLS = primary.TLS
+	}
+	if rs.TimeZone == "" {
+		rs.TimeZone = primary.TimeZone
+	}
+	if rs.Timeout == 0 {
+		rs.Timeout = primary.Timeout
+	}
+	if rs.ReadTimeout == 0 {
+		rs.ReadTimeout = primary.ReadTimeout
+	}
+	if rs.WriteTimeout == 0 {
+		rs.WriteTimeout = primary.WriteTimeout
+	}
+	if rs.Params == nil {
+		rs.Params = primary.Params
+	}
+	return &rs
+}
+
+func (p *IDBConfig) replicaName() string {
+	if p.Dsn != "" {
+		return p.Dialect
+	}
+	if p.Addr == "" {
+		return p.DBName
+	}
+	return p.Addr + "/" + p.DBName
+}
+
+// dbresolverでレプリカを登録する
+func (p *IDBConfig) useReplicas(db *gorm.DB, testMode bool) (*dbresolver.DBResolver, *replicaSet, error) {
+	primary, err := db.DB()
+	if err != nil {
+		return nil, nil, err
+	}
+	set := &replicaSet{policy: p.ReplicaPolicy}
+	config := dbresolver.Config{Policy: set}
+	names := []string{}
+	for _, replica := range p.Replicas {
+		replica = replica.replicaConfig(p)
+		if testMode && replica.Dsn == "" && replica.DBName != p.DBName {
+			replica.DBName = replica.testDBName()
+		}
+		config.Replicas = append(config.Replicas, replica.Dialector())
+		names = append(names, replica.replicaName())
+	}
+	resolver := dbresolver.Register(config, p.ReplicaModels...)
+	if err := db.Use(resolver); err != nil {
+		return nil, nil, err
+	}
+	// プライマリ以外がレプリカ(登録順)
+	i := 0
+	if err := resolver.Call(func(pool gorm.ConnPool) error {
+		if db, ok := pool.(*sql.DB); ok && db == primary {
+			return nil
+		}
+		if i < len(names) {
+			set.replicas = append(set.replicas, &replicaHealth{name: names[i], pool: pool, healthy: 1})
+			i++
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	if err := set.registerCallbacks(db); err != nil {
+		return nil, nil, err
+	}
+	return resolver, set, nil
+}
@@ -0,0 +1,96 @@
+package gofiber_extend_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type replicaItem struct {
+	ID   uint
+	Name string
+}
+
+func TestReplica(t *testing.T) {
+	dir := t.TempDir()
+	// レプリカには別のデータを入れておく
+	replica, err := gorm.Open(sqlite.Open(filepath.Join(dir, "replica_test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.AutoMigrate(&replicaItem{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Create(&replicaItem{Name: "replica"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	test := newSQLiteTest(t, ext.IFiberExConfig{
+		DBConfig: &ext.IDBConfig{
+			DBName:        filepath.Join(dir, "primary.db"),
+			MaxOpenConns:  4,
+			Replicas:      []*ext.IDBConfig{{DBName: filepath.Join(dir, "replica.db")}},
+			ReplicaPolicy: ext.ReplicaPolicyRoundRobin,
+		},
+	})
+	// マイグレーションの存在確認がレプリカを参照しないようにプライマリを指定する
+	if err := ext.UsePrimary(ext.DB).AutoMigrate(&replicaItem{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ext.DB.Create(&replicaItem{Name: "primary"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := ext.DB.DB(); err != nil || stats.Stats().MaxOpenConnections != 4 {
+		t.Errorf("max open conns: %+v, %v", stats.Stats(), err)
+	}
+
+	// test.Runのトランザクション外でレプリカを使用する
+	first := func(c *fiber.Ctx, db *gorm.DB) error {
+		item := &replicaItem{}
+		if err := db.Order("id").First(item).Error; err != nil {
+			return test.Ex.ResultError(c, 500, err)
+		}
+		return test.Ex.Result(c, 200, item)
+	}
+	test.Routes(func(app *fiber.App) {
+		app.Get("/items", func(c *fiber.Ctx) error {
+			return first(c, ext.DB.WithContext(test.Ex.Context(c)))
+		})
+		app.Get("/items/primary", func(c *fiber.Ctx) error {
+			return first(c, ext.UsePrimary(ext.DB.WithContext(test.Ex.Context(c))))
+		})
+		app.Post("/items", func(c *fiber.Ctx) error {
+			db := ext.DB.WithContext(test.Ex.Context(c))
+			if err := db.Create(&replicaItem{Name: "new"}).Error; err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			return first(c, db)
+		})
+		app.Get("/ready", test.Ex.Readiness())
+	})
+	test.Run("replica", func() {
+		test.Api("read", &ext.ITestRequest{Method: "GET", Path: "/items"}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   "$.result.Name",
+			Want:   "replica",
+		})
+		test.Api("use_primary", &ext.ITestRequest{Method: "GET", Path: "/items/primary"}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   "$.result.Name",
+			Want:   "primary",
+		})
+		test.Api("read_after_write", &ext.ITestRequest{Method: "POST", Path: "/items"}, 200, &ext.ITestCase{
+			Method: ext.TestMethodEqual,
+			Path:   "$.result.Name",
+			Want:   "primary",
+		})
+		test.Api("readiness", &ext.ITestRequest{Method: "GET", Path: "/ready"}, 200, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Path: "$.result.status", Want: ext.ReadinessOk},
+			{Method: ext.TestMethodEqual, Path: "$.result.replicas[0].healthy", Want: true},
+		}...)
+	})
+}
@@ -0,0 +1,274 @@
+package gofiber_extend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+var (
+	ErrNotFound = gorm.ErrRecordNotFound
+	ErrConflict = errors.New("conflict: record was modified") // Versionが一致しない
+)
+
+// 楽観的ロックに使用するフィールド名
+const VersionField = "Version"
+
+// 検索条件の演算子
+const (
+	FilterEq      = "eq"
+	FilterNe      = "ne"
+	FilterGt      = "gt"
+	FilterGte     = "gte"
+	FilterLt      = "lt"
+	FilterLte     = "lte"
+	FilterLike    = "like"
+	FilterIn      = "in"
+	FilterNull    = "null"
+	FilterNotNull = "notnull"
+)
+
+var filterOperators = map[string]string{
+	FilterEq:   "= ?",
+	FilterNe:   "<> ?",
+	FilterGt:   "> ?",
+	FilterGte:  ">= ?",
+	FilterLt:   "< ?",
+	FilterLte:  "<= ?",
+	FilterLike: "LIKE ?",
+	FilterIn:   "IN ?",
+}
+
+// 検索条件 Fieldはカラム名
+type IFilter struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+type IListOptions struct {
+	Page        int      // 1~
+	Per         int      // 0の場合はすべて
+	Sort        []string // カラム名 降順の場合は-を付与する
+	Filters     []IFilter
+	Scopes      []func(*gorm.DB) *gorm.DB
+	WithDeleted bool // 論理削除したものを含める
+}
+
+type IPage[T any] struct {
+	Items   []*T  `json:"items"`
+	Total   int64 `json:"total"`
+	Page    int   `json:"page"` // ページ数
+	Current int   `json:"current"`
+	Per     int   `json:"per"`
+}
+
+// gormのモデルの汎用的な操作
+// モデルにVersionフィールドがある場合は更新時に楽観的ロックを行う
+// gorm.DeletedAtがある場合は論理削除になる
+type Repository[T any] struct {
+	db *gorm.DB
+}
+
+func NewRepository[T any](db *gorm.DB) *Repository[T] {
+	return &Repository[T]{db: db}
+}
+
+// トランザクション(Tx(c)等)を使用する
+func (p *Repository[T]) WithTx(tx *gorm.DB) *Repository[T] {
+	return &Repository[T]{db: tx}
+}
+
+func (p *Repository[T]) DB(ctx context.Context) *gorm.DB {
+	return p.db.WithContext(ctx)
+}
+
+func (p *Repository[T]) Schema() (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: p.db}
+	if err := stmt.Parse(new(T)); err != nil {
+		return nil, err
+	}
+	return stmt.Schema, nil
+}
+
+func (p *Repository[T]) Find(ctx context.Context, id interface{}, scopes ...func(*gorm.DB) *gorm.DB) (*T, error) {
+	rs := new(T)
+	if err := p.DB(ctx).Scopes(scopes...).First(rs, id).Error; err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (p *Repository[T]) List(ctx context.Context, opts *IListOptions) (*IPage[T], error) {
+	if opts == nil {
+		opts = &IListOptions{}
+	}
+	s, err := p.Schema()
+	if err != nil {
+		return nil, err
+	}
+	db := p.DB(ctx).Model(new(T)).Scopes(opts.Scopes...)
+	if opts.WithDeleted {
+		db = db.Unscoped()
+	}
+	for _, filter := range opts.Filters {
+		if db, err = applyFilter(db, s, filter); err != nil {
+			return nil, err
+		}
+	}
+	rs := &IPage[T]{Items: []*T{}, Current: opts.Page, Per: opts.Per}
+	if err := db.Count(&rs.Total).Error; err != nil {
+		return nil, err
+	}
+	for _, sort := range opts.Sort {
+		column, desc := strings.TrimPrefix(sort, "-"), strings.HasPrefix(sort, "-")
+		if _, ok := s.FieldsByDBName[column]; !ok {
+			return nil, fmt.Errorf("repository: unknown sort field %q", column)
+		}
+		order := s.Table + "." + column
+		if desc {
+			order += " DESC"
+		}
+		db = db.Order(order)
+	}
+	if opts.Per > 0 {
+		if rs.Current < 1 {
+			rs.Current = 1
+		}
+		rs.Page = int((rs.Total + int64(opts.Per) - 1) / int64(opts.Per))
+		db = db.Offset((rs.Current - 1) * opts.Per).Limit(opts.Per)
+	}
+	if err := db.Find(&rs.Items).Error; err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func applyFilter(db *gorm.DB, s *schema.Schema, filter IFilter) (*gorm.DB, error) {
+	if _, ok := s.FieldsByDBName[filter.Field]; !ok {
+		return nil, fmt.Errorf("repository: unknown filter field %q", filter.Field)
+	}
+	column := s.Table + "." + filter.Field
+	switch filter.Op {
+	case FilterNull:
+		return db.Where(column + " IS NULL"), nil
+	case FilterNotNull:
+		return db.Where(column + " IS NOT NULL"), nil
+	case "":
+		filter.Op = FilterEq
+	}
+	operator, ok := filterOperators[filter.Op]
+	if !ok {
+		return nil, fmt.Errorf("repository: unknown filter operator %q", filter.Op)
+	}
+	return db.Where(column+" "+operator, filter.Value), nil
+}
+
+func (p *Repository[T]) Create(ctx context.Context, item *T) error {
+	return p.DB(ctx).Create(item).Error
+}
+
+// fieldsを指定した場合はそのカラムのみ更新する 未指定の場合は主キーと作成日時以外を更新する
+// Versionがある場合は一致する場合のみ更新し、Versionを1つ増やす 一致しない場合はErrConflict
+func (p *Repository[T]) Update(ctx context.Context, item *T, fields ...string) error {
+	s, err := p.Schema()
+	if err != nil {
+		return err
+	}
+	columns := []string{}
+	for _, field := range fields {
+		if _, ok := s.FieldsByDBName[field]; !ok {
+			return fmt.Errorf("repository: unknown field %q", field)
+		}
+		columns = append(columns, field)
+	}
+	if len(columns) == 0 {
+		for _, field := range s.Fields {
+			if field.DBName != "" && !field.PrimaryKey && field.AutoCreateTime == 0 && field.Name != VersionField {
+				columns = append(columns, field.DBName)
+			}
+		}
+	}
+	for _, field := range s.Fields {
+		if field.AutoUpdateTime > 0 {
+			columns = append(columns, field.DBName)
+		}
+	}
+	db := p.DB(ctx).Model(item)
+	value := reflect.ValueOf(item)
+	version := s.LookUpField(VersionField)
+	if version != nil {
+		current, _ := version.ValueOf(ctx, value.Elem())
+		db = db.Where(s.Table+"."+version.DBName+" = ?", current)
+		if err := version.Set(ctx, value.Elem(), addVersion(current, 1)); err != nil {
+			return err
+		}
+		columns = append(columns, version.DBName)
+	}
+	res := db.Select(columns).Updates(item)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 && version != nil {
+		current, _ := version.ValueOf(ctx, value.Elem())
+		_ = version.Set(ctx, value.Elem(), addVersion(current, -1))
+		return ErrConflict
+	}
+	return nil
+}
+
+// バージョンにdeltaを加える 整数・符号なし整数の型に対応する
+func addVersion(current interface{}, delta int64) interface{} {
+	value := reflect.ValueOf(current)
+	rs := reflect.New(value.Type()).Elem()
+	switch {
+	case value.CanInt():
+		rs.SetInt(value.Int() + delta)
+	case value.CanUint():
+		rs.SetUint(value.Uint() + uint64(delta))
+	default:
+		return current
+	}
+	return rs.Interface()
+}
+
+// 論理削除できるモデルの場合は論理削除する
+func (p *Repository[T]) Delete(ctx context.Context, item *T) error {
+	res := p.DB(ctx).Delete(item)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// 論理削除したものも物理削除する
+func (p *Repository[T]) ForceDelete(ctx context.Context, item *T) error {
+	return p.DB(ctx).Unscoped().Delete(item).Error
+}
+
+// 論理削除したものを元に戻す
+func (p *Repository[T]) Restore(ctx context.Context, id interface{}) (*T, error) {
+	s, err := p.Schema()
+	if err != nil {
+		return nil, err
+	}
+	if s.LookUpField("DeletedAt") == nil {
+		return nil, fmt.Errorf("repository: %s is not soft deletable", s.Name)
+	}
+	rs := new(T)
+	if err := p.DB(ctx).Unscoped().First(rs, id).Error; err != nil {
+		return nil, err
+	}
+	if err := p.DB(ctx).Unscoped().Model(rs).Update("deleted_at", nil).Error; err != nil {
+		return nil, err
+	}
+	return p.Find(ctx, id)
+}
@@ -0,0 +1,298 @@
+package gofiber_extend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/exp/slices"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Resourceの操作
+const (
+	ResourceList   = "list"
+	ResourceGet    = "get"
+	ResourceCreate = "create"
+	ResourceUpdate = "update"
+	ResourceDelete = "delete"
+)
+
+// 一覧のパラメータ
+// 検索条件は?name=xxxまたは?age[gte]=20 の形式で指定する
+type IResourceQuery struct {
+	IRequestPaging
+	Sort string `query:"sort"` // カンマ区切り 降順の場合は-を付与する(-created_at)
+}
+
+// Repositoryを使用してRESTのルートを登録する
+// フィールド名はJSONの名前で指定する
+type Resource[T any] struct {
+	Ex      *IFiberEx
+	Actions []string // 登録する操作 未指定の場合はすべて
+	Fields  []string // 作成・更新できるフィールド 作成・更新を登録する場合は必須
+	Filters []string // 検索できるフィールド
+	Sorts   []string // ソートできるフィールド
+	MaxPer  int      // 1ページの最大件数 未指定の場合は100
+	// 権限の確認 エラーを返した場合は403 listの場合itemはnil
+	// create・updateの場合はリクエストの内容を反映したitem
+	Authorize func(c *fiber.Ctx, action string, item *T) error
+	// テナント等で対象を絞り込む
+	Scope func(c *fiber.Ctx, db *gorm.DB) *gorm.DB
+}
+
+func (p *Resource[T]) repository(c *fiber.Ctx) *Repository[T] {
+	return NewRepository[T](p.Ex.Tx(c))
+}
+
+func (p *Resource[T]) scopes(c *fiber.Ctx) []func(*gorm.DB) *gorm.DB {
+	if p.Scope == nil {
+		return nil
+	}
+	return []func(*gorm.DB) *gorm.DB{func(db *gorm.DB) *gorm.DB { return p.Scope(c, db) }}
+}
+
+func (p *Resource[T]) enabled(action string) bool {
+	return len(p.Actions) == 0 || slices.Contains(p.Actions, action)
+}
+
+// ルートを登録する GET / GET /:id POST / PATCH /:id DELETE /:id
+func (p *Resource[T]) Mount(router fiber.Router) {
+	if len(p.Fields) == 0 && (p.enabled(ResourceCreate) || p.enabled(ResourceUpdate)) {
+		panic("resource: Fields is required for create and update")
+	}
+	if p.enabled(ResourceList) {
+		router.Get("/", p.List)
+	}
+	if p.enabled(ResourceGet) {
+		router.Get("/:id", p.Get)
+	}
+	if p.enabled(ResourceCreate) {
+		router.Post("/", p.Create)
+	}
+	if p.enabled(ResourceUpdate) {
+		router.Patch("/:id", p.Update)
+	}
+	if p.enabled(ResourceDelete) {
+		router.Delete("/:id", p.Delete)
+	}
+}
+
+// JSONの名前とフィールド
+func resourceFields(s *schema.Schema) map[string]*schema.Field {
+	rs := map[string]*schema.Field{}
+	for _, field := range s.Fields {
+		if field.DBName == "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		rs[name] = field
+	}
+	return rs
+}
+
+func (p *Resource[T]) writable(name string, field *schema.Field) bool {
+	return slices.Contains(p.Fields, name) && !field.PrimaryKey && field.Name != VersionField
+}
+
+func (p *Resource[T]) authorize(c *fiber.Ctx, action string, item *T) bool {
+	if p.Authorize == nil {
+		return true
+	}
+	if err := p.Authorize(c, action, item); err != nil {
+		_ = p.Ex.ResultError(c, 403, err, E40301.Errors()...)
+		return false
+	}
+	return true
+}
+
+func (p *Resource[T]) resultError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return p.Ex.ResultError(c, 404, err, E40401.Errors()...)
+	case errors.Is(err, ErrConflict):
+		return p.Ex.ResultError(c, 409, err, E40901.Errors()...)
+	}
+	return p.Ex.ResultError(c, 500, err)
+}
+
+func (p *Resource[T]) List(c *fiber.Ctx) error {
+	// RequestParserはGET以外をクエリ文字列から変換するため、変換方法を指定する
+	query := &IResourceQuery{}
+	if !p.Ex.parseRequest(c, query, c.QueryParser) || !p.Ex.validateRequest(c, query) {
+		return nil
+	}
+	if !p.authorize(c, ResourceList, nil) {
+		return nil
+	}
+	repo := p.repository(c)
+	s, err := repo.Schema()
+	if err != nil {
+		return p.resultError(c, err)
+	}
+	fields := resourceFields(s)
+	opts := &IListOptions{Page: query.Page, Per: query.Per, Scopes: p.scopes(c)}
+	maxPer := p.MaxPer
+	if maxPer <= 0 {
+		maxPer = 100
+	}
+	if opts.Per <= 0 {
+		opts.Per = *p.Ex.Config.PagePer
+	}
+	if opts.Per > maxPer {
+		opts.Per = maxPer
+	}
+	for _, sort := range strings.Split(query.Sort, ",") {
+		name := strings.TrimPrefix(sort, "-")
+		if name == "" {
+			continue
+		}
+		field, ok := fields[name]
+		if !ok || !slices.Contains(p.Sorts, name) {
+			return p.Ex.ResultError(c, 400, fmt.Errorf("sort not allowed: %s", name), IError{Code: "E40001", Field: "sort", Message: "ValidationError.sort"})
+		}
+		opts.Sort = append(opts.Sort, strings.TrimSuffix(sort, name)+field.DBName)
+	}
+	var filterErr error
+	c.Context().QueryArgs().VisitAll(func(key []byte, value []byte) {
+		name, op := string(key), FilterEq
+		if i := strings.Index(name, "["); i > 0 && strings.HasSuffix(name, "]") {
+			name, op = name[:i], name[i+1:len(name)-1]
+		}
+		field, ok := fields[name]
+		if !ok || !slices.Contains(p.Filters, name) {
+			return
+		}
+		filter := IFilter{Field: field.DBName, Op: op, Value: string(value)}
+		if op == FilterIn {
+			filter.Value = strings.Split(string(value), ",")
+		}
+		if _, ok := filterOperators[op]; !ok && op != FilterNull && op != FilterNotNull {
+			filterErr = fmt.Errorf("unknown filter operator: %s", op)
+		}
+		opts.Filters = append(opts.Filters, filter)
+	})
+	if filterErr != nil {
+		return p.Ex.ResultError(c, 400, filterErr, E40001.Errors()...)
+	}
+	page, err := repo.List(p.Ex.Context(c), opts)
+	if err != nil {
+		return p.resultError(c, err)
+	}
+	p.Ex.Paging(c, page.Total, page.Page, page.Current)
+	return p.Ex.Result(c, 200, page.Items)
+}
+
+func (p *Resource[T]) find(c *fiber.Ctx) (*T, bool) {
+	item, err := p.repository(c).Find(p.Ex.Context(c), c.Params("id"), p.scopes(c)...)
+	if err != nil {
+		_ = p.resultError(c, err)
+		return nil, false
+	}
+	return item, true
+}
+
+func (p *Resource[T]) Get(c *fiber.Ctx) error {
+	item, ok := p.find(c)
+	if !ok || !p.authorize(c, ResourceGet, item) {
+		return nil
+	}
+	return p.Ex.Result(c, 200, item)
+}
+
+// 許可されたフィールドのみitemに反映する 反映したカラム名を返す
+// 更新の場合はversionを楽観的ロックのため反映する
+func (p *Resource[T]) decode(c *fiber.Ctx, action string, item *T) ([]string, bool) {
+	body := map[string]json.RawMessage{}
+	if !p.Ex.parseRequest(c, &body, c.BodyParser) {
+		return nil, false
+	}
+	s, err := p.repository(c).Schema()
+	if err != nil {
+		_ = p.resultError(c, err)
+		return nil, false
+	}
+	allowed := map[string]json.RawMessage{}
+	columns := []string{}
+	rules := map[string]string{}
+	for name, field := range resourceFields(s) {
+		if rule := maskRule(field.StructField); rule != "" {
+			rules[name] = rule
+		}
+		value, ok := body[name]
+		if !ok {
+			continue
+		}
+		if field.Name == VersionField && action == ResourceUpdate {
+			allowed[name] = value
+		} else if p.writable(name, field) {
+			allowed[name] = value
+			columns = append(columns, field.DBName)
+		}
+	}
+	p.Ex.maskRequestJson(c, body, rules)
+	buf, err := json.Marshal(allowed)
+	if err == nil {
+		err = json.Unmarshal(buf, item)
+	}
+	if err != nil {
+		_ = p.Ex.ResultError(c, 400, err, E40001.Errors()...)
+		return nil, false
+	}
+	if !p.Ex.validateRequest(c, item) {
+		return nil, false
+	}
+	return columns, true
+}
+
+func (p *Resource[T]) Create(c *fiber.Ctx) error {
+	item := new(T)
+	if _, ok := p.decode(c, ResourceCreate, item); !ok {
+		return nil
+	}
+	if !p.authorize(c, ResourceCreate, item) {
+		return nil
+	}
+	if err := p.repository(c).Create(p.Ex.Context(c), item); err != nil {
+		return p.resultError(c, err)
+	}
+	return p.Ex.Result(c, 201, item)
+}
+
+func (p *Resource[T]) Update(c *fiber.Ctx) error {
+	item, ok := p.find(c)
+	if !ok {
+		return nil
+	}
+	columns, ok := p.decode(c, ResourceUpdate, item)
+	if !ok || !p.authorize(c, ResourceUpdate, item) {
+		return nil
+	}
+	if len(columns) == 0 {
+		return p.Ex.Result(c, 200, item)
+	}
+	if err := p.repository(c).Update(p.Ex.Context(c), item, columns...); err != nil {
+		return p.resultError(c, err)
+	}
+	return p.Ex.Result(c, 200, item)
+}
+
+func (p *Resource[T]) Delete(c *fiber.Ctx) error {
+	item, ok := p.find(c)
+	if !ok || !p.authorize(c, ResourceDelete, item) {
+		return nil
+	}
+	if err := p.repository(c).Delete(p.Ex.Context(c), item); err != nil {
+		return p.resultError(c, err)
+	}
+	return p.Ex.Result(c, 200, item)
+}
@@ -0,0 +1,141 @@
+package gofiber_extend_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"gorm.io/gorm"
+)
+
+type resourceItem struct {
+	ID        uint           `json:"id"`
+	Name      string         `json:"name" validate:"required"`
+	Age       int            `json:"age"`
+	Owner     string         `json:"owner"`
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"-"`
+}
+
+// 符号なし整数のバージョン
+type repositoryItem struct {
+	ID      uint
+	Name    string
+	Version uint
+}
+
+func TestResource(t *testing.T) {
+	test := newSQLiteTest(t, ext.IFiberExConfig{})
+	if err := ext.DB.AutoMigrate(&resourceItem{}, &repositoryItem{}); err != nil {
+		t.Fatal(err)
+	}
+	resource := &ext.Resource[resourceItem]{
+		Ex:      test.Ex,
+		Fields:  []string{"name", "age"},
+		Filters: []string{"name", "age"},
+		Sorts:   []string{"age"},
+		Authorize: func(c *fiber.Ctx, action string, item *resourceItem) error {
+			if action == ext.ResourceUpdate || action == ext.ResourceDelete {
+				if item.Owner != c.Get("X-User") {
+					return fmt.Errorf("not owner")
+				}
+			}
+			// 更新後の内容を確認できる
+			if action == ext.ResourceUpdate && item.Age >= 100 {
+				return fmt.Errorf("too old")
+			}
+			return nil
+		},
+		Scope: func(c *fiber.Ctx, db *gorm.DB) *gorm.DB {
+			return db.Where("owner <> ?", "hidden")
+		},
+	}
+	test.Routes(func(app *fiber.App) {
+		resource.Mount(app.Group("/items"))
+	})
+	owner := map[string]string{"X-User": "u1"}
+
+	test.Run("resource", func() {
+		for _, item := range []*resourceItem{
+			{Name: "a", Age: 10, Owner: "u1"},
+			{Name: "b", Age: 20, Owner: "u1"},
+			{Name: "c", Age: 30, Owner: "u2"},
+			{Name: "hidden", Age: 40, Owner: "hidden"},
+		} {
+			if err := test.Ex.DB.Create(item).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		test.Api("list", &ext.ITestRequest{Method: "GET", Path: "/items?per=2&sort=-age"}, 200, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Path: "$.result[0].name", Want: "c"},
+			{Method: ext.TestMethodEqual, Path: "$.result[1].name", Want: "b"},
+			{Method: ext.TestMethodEqual, Path: "$.meta.total", Want: float64(3)},
+			{Method: ext.TestMethodEqual, Path: "$.meta.page", Want: float64(2)},
+		}...)
+		test.Api("filter", &ext.ITestRequest{Method: "GET", Path: "/items?age[gte]=20&age[lt]=40&sort=age"}, 200, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Path: "$.result[0].name", Want: "b"},
+			{Method: ext.TestMethodEqual, Path: "$.meta.total", Want: float64(2)},
+		}...)
+		test.Api("sort_not_allowed", &ext.ITestRequest{Method: "GET", Path: "/items?sort=owner"}, 400)
+		test.Api("query_invalid", &ext.ITestRequest{Method: "GET", Path: "/items?per=abc"}, 400)
+		test.Api("scope", &ext.ITestRequest{Method: "GET", Path: "/items/4"}, 404, &ext.ITestCase{
+			Method: ext.TestMethodEqual, Path: "$.error[0].code", Want: "E40401",
+		})
+		test.Api("create", &ext.ITestRequest{Method: "POST", Path: "/items", Body: map[string]interface{}{"name": "d", "age": 5, "owner": "hidden"}}, 201, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Path: "$.result.name", Want: "d"},
+			{Method: ext.TestMethodEqual, Path: "$.result.owner", Want: ""}, // 許可されていないフィールド
+		}...)
+		test.Api("create_invalid", &ext.ITestRequest{Method: "POST", Path: "/items", Body: map[string]interface{}{"age": 5}}, 400, &ext.ITestCase{
+			Method: ext.TestMethodEqual, Path: "$.error[0].field", Want: "Name",
+		})
+		test.Api("update", &ext.ITestRequest{Method: "PATCH", Path: "/items/1", Headers: owner, Body: map[string]interface{}{"age": 11, "version": 0}}, 200, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Path: "$.result.age", Want: float64(11)},
+			{Method: ext.TestMethodEqual, Path: "$.result.version", Want: float64(1)},
+		}...)
+		test.Api("update_stale", &ext.ITestRequest{Method: "PATCH", Path: "/items/1", Headers: owner, Body: map[string]interface{}{"age": 12, "version": 0}}, 409, &ext.ITestCase{
+			Method: ext.TestMethodEqual, Path: "$.error[0].code", Want: "E40901",
+		})
+		test.Api("update_forbidden", &ext.ITestRequest{Method: "PATCH", Path: "/items/3", Headers: owner, Body: map[string]interface{}{"age": 31}}, 403)
+		test.Api("update_decoded", &ext.ITestRequest{Method: "PATCH", Path: "/items/2", Headers: owner, Body: map[string]interface{}{"age": 100}}, 403)
+		test.Job("fields_required", func() {}, func() {}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: "resource: Fields is required for create and update", Store: func() (rs interface{}) {
+			defer func() { rs = recover() }()
+			(&ext.Resource[resourceItem]{Ex: test.Ex}).Mount(fiber.New())
+			return nil
+		}})
+		test.Api("delete", &ext.ITestRequest{Method: "DELETE", Path: "/items/1", Headers: owner}, 200)
+		test.Api("deleted", &ext.ITestRequest{Method: "GET", Path: "/items/1"}, 404)
+		test.Job("restore", func() {}, func() {
+			if _, err := ext.NewRepository[resourceItem](test.Ex.DB).Restore(context.Background(), 1); err != nil {
+				t.Error(err)
+			}
+		}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: int64(11), Store: func() interface{} {
+			page, err := ext.NewRepository[resourceItem](test.Ex.DB).List(context.Background(), &ext.IListOptions{
+				Filters: []ext.IFilter{{Field: "name", Value: "a"}},
+			})
+			if err != nil || len(page.Items) != 1 {
+				return err
+			}
+			return int64(page.Items[0].Age)
+		}})
+		test.Job("uint_version", func() {}, func() {}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: "1 true 0", Store: func() interface{} {
+			ctx := context.Background()
+			repository := ext.NewRepository[repositoryItem](test.Ex.DB)
+			item := &repositoryItem{Name: "a"}
+			if err := repository.Create(ctx, item); err != nil {
+				return err
+			}
+			if err := repository.Update(ctx, item); err != nil {
+				return err
+			}
+			// 競合した場合はバージョンを戻す
+			stale := &repositoryItem{ID: item.ID, Name: "b"}
+			err := repository.Update(ctx, stale)
+			return fmt.Sprintf("%d %v %d", item.Version, err == ext.ErrConflict, stale.Version)
+		}})
+	})
+}
@@ -8,6 +8,8 @@ import (
 	"io"
 	"net/smtp"
 	"strings"
+
+	"go.uber.org/zap"
 )
 
 func (p *IFiberEx) ExecuteTemplate(out io.Writer, src string, values interface{}) error {
@@ -52,8 +54,15 @@ func (p *IFiberEx) Mail(to []string, subject string, body string, values interfa
 	} else {
 		auth = smtp.PlainAuth("", *p.Config.SmtpUser, *p.Config.SmtpPass, p.Config.SmtpAddr)
 	}
-	if err := smtp.SendMail(p.Config.SmtpAddr, auth, p.Config.SmtpFrom, to, []byte(message)); err != nil {
+	log := ComponentLog(LogComponentMail).With(zap.Strings("to", to), zap.String("subject", title.String()))
+	err := smtp.SendMail(p.Config.SmtpAddr, auth, p.Config.SmtpFrom, to, []byte(message))
+	if p.Metrics != nil {
+		p.Metrics.MailSent(err)
+	}
+	if err != nil {
+		log.Error(err.Error())
 		return err
 	}
+	log.Info("mail.sent")
 	return nil
 }
@@ -0,0 +1,288 @@
+package gofiber_extend
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Subtestのリクエストを識別するヘッダ
+const TestIsolationHeader = "X-Test-Isolation"
+
+// Subtestのデータベースの分離方法
+type ITestIsolation int
+
+const (
+	TestIsolationAuto ITestIsolation = iota // sqliteは複製、それ以外はトランザクション
+	TestIsolationCopy                       // データベースを複製する sqliteのみ
+	TestIsolationTx                         // トランザクション内で実行して破棄する sqliteは書き込めるトランザクションが1つのため並列に実行できない
+)
+
+// contextに格納されたSubtestの接続にクエリを振り分けるConnPool
+// NewTestでDBに設定し、DB.WithContext(ex.Context(c))で実行したクエリが対象になる
+type testConnPool struct {
+	base   gorm.ConnPool
+	mutex  sync.Mutex
+	active map[*IFiberExTest]int // リクエストを処理中のSubtest
+}
+
+func testPoolFromContext(ctx context.Context) gorm.ConnPool {
+	if ctx != nil {
+		if pool, ok := ctx.Value(contextKeyTestDB).(gorm.ConnPool); ok {
+			return pool
+		}
+	}
+	return nil
+}
+
+func (p *testConnPool) pool(ctx context.Context, query string) gorm.ConnPool {
+	if pool := testPoolFromContext(ctx); pool != nil {
+		return pool
+	}
+	p.unbound(query)
+	return p.base
+}
+
+// Subtestのリクエスト中にcontextを渡さずに実行したクエリを記録する
+// 並列に実行している場合はどのリクエストか判別できないため、処理中のすべてのSubtestに記録する
+func (p *testConnPool) unbound(query string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for test := range p.active {
+		test.unboundMutex.Lock()
+		test.unbound = append(test.unbound, query)
+		test.unboundMutex.Unlock()
+	}
+}
+
+func (p *testConnPool) enter(test *IFiberExTest) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.active == nil {
+		p.active = map[*IFiberExTest]int{}
+	}
+	p.active[test]++
+}
+
+func (p *testConnPool) leave(test *IFiberExTest) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.active[test]--; p.active[test] <= 0 {
+		delete(p.active, test)
+	}
+}
+
+func (p *testConnPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return p.pool(ctx, query).PrepareContext(ctx, query)
+}
+
+func (p *testConnPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return p.pool(ctx, query).ExecContext(ctx, query, args...)
+}
+
+func (p *testConnPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return p.pool(ctx, query).QueryContext(ctx, query, args...)
+}
+
+func (p *testConnPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return p.pool(ctx, query).QueryRowContext(ctx, query, args...)
+}
+
+// Subtestのトランザクション内ではセーブポイントを使用する
+func (p *testConnPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	switch pool := p.pool(ctx, "BEGIN").(type) {
+	case *sql.Tx:
+		return newTestSavepoint(ctx, pool)
+	case gorm.TxBeginner:
+		return pool.BeginTx(ctx, opts)
+	case gorm.ConnPoolBeginner:
+		return pool.BeginTx(ctx, opts)
+	}
+	return nil, gorm.ErrInvalidTransaction
+}
+
+func (p *testConnPool) GetDBConn() (*sql.DB, error) {
+	if db, ok := p.base.(*sql.DB); ok {
+		return db, nil
+	}
+	if connector, ok := p.base.(gorm.GetDBConnector); ok {
+		return connector.GetDBConn()
+	}
+	return nil, gorm.ErrInvalidDB
+}
+
+var testSavepointSeq int64
+
+// セーブポイントをトランザクションとして扱う
+type testSavepoint struct {
+	*sql.Tx
+	name string
+}
+
+func newTestSavepoint(ctx context.Context, tx *sql.Tx) (*testSavepoint, error) {
+	sp := &testSavepoint{Tx: tx, name: fmt.Sprintf("test_sp%d", atomic.AddInt64(&testSavepointSeq, 1))}
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT "+sp.name); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+func (p *testSavepoint) Commit() error {
+	_, err := p.Tx.Exec("RELEASE SAVEPOINT " + p.name)
+	return err
+}
+
+func (p *testSavepoint) Rollback() error {
+	_, err := p.Tx.Exec("ROLLBACK TO SAVEPOINT " + p.name)
+	return err
+}
+
+// DBのクエリをSubtestの接続に振り分けられるようにする
+// レプリカを使用する場合はdbresolverが接続を切り替えるため振り分けられない
+func useTestConnPool(db *gorm.DB) {
+	if _, ok := db.ConnPool.(*testConnPool); ok {
+		return
+	}
+	pool := &testConnPool{base: db.ConnPool}
+	db.ConnPool = pool
+	db.Statement.ConnPool = pool
+}
+
+// 実行中のSubtest ヘッダの値: Subtest
+var testIsolations sync.Map
+
+var testIsolationSeq int64
+
+// ヘッダで指定されたSubtestの接続をcontextに格納する
+func (p *IFiberExTest) isolator() func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if id := c.Get(TestIsolationHeader); id != "" {
+			if value, ok := testIsolations.Load(id); ok {
+				test := value.(*IFiberExTest)
+				c.Locals("test", test)
+				c.SetUserContext(context.WithValue(c.UserContext(), contextKeyTestDB, test.pool))
+				if router, ok := p.Ex.DB.ConnPool.(*testConnPool); ok {
+					router.enter(test)
+					defer router.leave(test)
+				}
+			}
+		}
+		return c.Next()
+	}
+}
+
+// Subtestのリクエスト中にSubtestの接続を経由せずに実行されたクエリ
+// ハンドラがcontextを渡さずにDBを使用した場合で、取得しなかったものはサブテストの終了時にエラーとする
+func (p *IFiberExTest) UnboundQueries() []string {
+	p.unboundMutex.Lock()
+	defer p.unboundMutex.Unlock()
+	rs := p.unbound
+	p.unbound = nil
+	return rs
+}
+
+// サブテストを実行する
+// サブテスト毎に独立したデータベース(Isolationで指定 未指定の場合はsqliteは複製、それ以外はトランザクション)を使用し、終了時に破棄する
+// test.Ex.DBとtest.Apiのリクエストのハンドラで実行したクエリが対象になるため、t.Parallel()で並列に実行できる
+// ハンドラはex.Tx(c)またはDB.WithContext(ex.Context(c))を使用すること 使用しなかったクエリはUnboundQueriesで報告する
+// Redis/ESとジョブは共有する
+//
+//	test.Subtest("create", func(test *ext.IFiberExTest) {
+//		test.Parallel()
+//		test.Api("create", &ext.ITestRequest{Method: "POST", Path: "/users"}, 201)
+//	})
+func (p *IFiberExTest) Subtest(name string, tests func(test *IFiberExTest)) {
+	p.t.Run(name, func(t *testing.T) {
+		tests(p.isolate(t))
+	})
+}
+
+func (p *IFiberExTest) isolate(t *testing.T) *IFiberExTest {
+	ex := *p.Ex
+	test := &IFiberExTest{
+		Ex:        &ex,
+		App:       p.App,
+		t:         t,
+		Redis:     p.Redis,
+		fixtures:  p.fixtures,
+		Isolation: p.Isolation,
+	}
+	if !p.Ex.Config.UseDB {
+		return test
+	}
+	pool, err := p.isolatedPool(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.pool = pool
+	test.isolationId = fmt.Sprint(atomic.AddInt64(&testIsolationSeq, 1))
+	testIsolations.Store(test.isolationId, test)
+	t.Cleanup(func() {
+		testIsolations.Delete(test.isolationId)
+		if queries := test.UnboundQueries(); len(queries) > 0 {
+			t.Errorf("test: queries did not use the Subtest database (use ex.Tx(c) or DB.WithContext(ex.Context(c))): %q", queries)
+		}
+	})
+	ex.DB = p.Ex.DB.WithContext(context.WithValue(background, contextKeyTestDB, pool))
+	test.LoadFixtures()
+	return test
+}
+
+// 終了時に破棄する接続
+func (p *IFiberExTest) isolatedPool(t *testing.T) (gorm.ConnPool, error) {
+	router, ok := p.Ex.DB.Statement.ConnPool.(*testConnPool)
+	if !ok {
+		return nil, errors.New("test: Subtest cannot be used in Run or with replicas")
+	}
+	pool := testPoolFromContext(p.Ex.DB.Statement.Context)
+	if pool == nil {
+		pool = router.base
+	}
+	db, ok := pool.(*sql.DB)
+	if !ok {
+		return nil, errors.New("test: nested Subtest is supported only with TestIsolationCopy")
+	}
+	isSQLite := p.Ex.Config.DBConfig.Dialect == DialectSQLite
+	if p.Isolation == TestIsolationCopy && !isSQLite {
+		return nil, errors.New("test: TestIsolationCopy is supported only with sqlite")
+	}
+	if p.Isolation == TestIsolationCopy || (p.Isolation == TestIsolationAuto && isSQLite) {
+		// sqliteは書き込めるトランザクションが1つのため、データベースを複製する
+		path := filepath.Join(t.TempDir(), "isolated.db")
+		if _, err := db.ExecContext(background, "VACUUM INTO ?", path); err != nil {
+			return nil, err
+		}
+		clone, err := sql.Open(sqlite.DriverName, path)
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() {
+			clone.Close()
+		})
+		return clone, nil
+	}
+	tx, err := db.BeginTx(background, nil)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() {
+		if err := tx.Rollback(); err != nil {
+			t.Error(err)
+		}
+	})
+	return tx, nil
+}
+
+// サブテストを並列に実行する
+func (p *IFiberExTest) Parallel() {
+	p.t.Parallel()
+}
@@ -0,0 +1,137 @@
+package gofiber_extend_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+)
+
+func TestSubtest(t *testing.T) {
+	test := newSQLiteTest(t, ext.IFiberExConfig{})
+	if err := ext.DB.AutoMigrate(&fixtureUser{}, &fixturePost{}); err != nil {
+		t.Fatal(err)
+	}
+	test.Fixtures([]string{"testdata/fixtures/*.json", "testdata/fixtures/*.yml"}, &fixtureUser{}, &fixturePost{})
+	test.Routes(func(app *fiber.App) {
+		app.Post("/users", test.Ex.TxMiddleware(), func(c *fiber.Ctx) error {
+			user := &fixtureUser{}
+			if err := c.BodyParser(user); err != nil {
+				return test.Ex.ResultError(c, 400, err)
+			}
+			if err := test.Ex.Tx(c).Create(user).Error; err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			return test.Ex.Result(c, 201, user)
+		})
+		app.Get("/users", func(c *fiber.Ctx) error {
+			var count int64
+			if err := test.Ex.DB.WithContext(test.Ex.Context(c)).Model(&fixtureUser{}).Count(&count).Error; err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			return test.Ex.Result(c, 200, count)
+		})
+	})
+
+	// サブテストの変更は残らない Cleanupはサブテストの終了後に実行される
+	t.Cleanup(func() {
+		var count int64
+		if err := ext.DB.Model(&fixtureUser{}).Count(&count).Error; err != nil || count != 0 {
+			t.Errorf("cleanup: %d, %v", count, err)
+		}
+	})
+	for i := 1; i <= 3; i++ {
+		n := i
+		test.Subtest(fmt.Sprintf("subtest%d", n), func(test *ext.IFiberExTest) {
+			test.Parallel()
+			for j := 0; j < n; j++ {
+				test.Api("create", &ext.ITestRequest{Method: "POST", Path: "/users", Body: map[string]interface{}{
+					"Name": fmt.Sprintf("user%d-%d", n, j),
+				}}, 201)
+			}
+			// フィクスチャと自身が作成したレコードのみ参照できる
+			test.Api("count", &ext.ITestRequest{Method: "GET", Path: "/users"}, 200,
+				&ext.ITestCase{Method: ext.TestMethodEqual, Path: "$.result", Want: float64(2 + n)},
+				test.AssertMaxQueries(1),
+			)
+			test.Job("db", func() {}, func() {}, []*ext.ITestCase{
+				{Method: ext.TestMethodEqual, Want: int64(2 + n), Store: func() interface{} {
+					var count int64
+					if err := test.Ex.DB.Model(&fixtureUser{}).Count(&count).Error; err != nil {
+						return err
+					}
+					return count
+				}},
+				{Method: ext.TestMethodEqual, Want: "alice@example.com", Store: func() interface{} {
+					return ext.FixtureOf[fixtureUser](test, "fixture_users.alice").Email
+				}},
+			}...)
+		})
+	}
+}
+
+func TestSubtestIsolation(t *testing.T) {
+	test := newSQLiteTest(t, ext.IFiberExConfig{})
+	if err := ext.DB.AutoMigrate(&fixtureUser{}); err != nil {
+		t.Fatal(err)
+	}
+	test.Routes(func(app *fiber.App) {
+		app.Post("/users", test.Ex.TxMiddleware(), func(c *fiber.Ctx) error {
+			user := &fixtureUser{}
+			if err := c.BodyParser(user); err != nil {
+				return test.Ex.ResultError(c, 400, err)
+			}
+			if err := test.Ex.Tx(c).Create(user).Error; err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			return test.Ex.Result(c, 201, user)
+		})
+		app.Get("/users", func(c *fiber.Ctx) error {
+			var count int64
+			if err := test.Ex.DB.WithContext(test.Ex.Context(c)).Model(&fixtureUser{}).Count(&count).Error; err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			return test.Ex.Result(c, 200, count)
+		})
+		// contextを渡さずに実行する
+		app.Get("/unbound", func(c *fiber.Ctx) error {
+			var count int64
+			if err := test.Ex.DB.Model(&fixtureUser{}).Count(&count).Error; err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			return test.Ex.Result(c, 200, count)
+		})
+	})
+	count := func() int64 {
+		var count int64
+		if err := ext.DB.Model(&fixtureUser{}).Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	// sqlite以外で使用するトランザクションでの分離
+	test.Isolation = ext.TestIsolationTx
+	test.Subtest("tx", func(test *ext.IFiberExTest) {
+		test.Api("create", &ext.ITestRequest{Method: "POST", Path: "/users", Body: map[string]interface{}{"Name": "tx"}}, 201)
+		test.Api("count", &ext.ITestRequest{Method: "GET", Path: "/users"}, 200,
+			&ext.ITestCase{Method: ext.TestMethodEqual, Path: "$.result", Want: float64(1)},
+		)
+	})
+	if n := count(); n != 0 {
+		t.Errorf("tx: %d", n)
+	}
+
+	test.Isolation = ext.TestIsolationAuto
+	test.Subtest("unbound", func(test *ext.IFiberExTest) {
+		test.Api("unbound", &ext.ITestRequest{Method: "GET", Path: "/unbound"}, 200)
+		test.Job("queries", func() {}, func() {}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: 1, Store: func() interface{} {
+			return len(test.UnboundQueries())
+		}})
+		test.Api("bound", &ext.ITestRequest{Method: "GET", Path: "/users"}, 200)
+		test.Job("none", func() {}, func() {}, &ext.ITestCase{Method: ext.TestMethodEqual, Want: 0, Store: func() interface{} {
+			return len(test.UnboundQueries())
+		}})
+	})
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 
 	miniredis "github.com/alicebob/miniredis/v2"
@@ -17,6 +19,7 @@ import (
 	"github.com/steinfletcher/apitest"
 	jsonpath "github.com/steinfletcher/apitest-jsonpath"
 	"golang.org/x/exp/slices"
+	"gorm.io/gorm"
 )
 
 type IFiberExTest struct {
@@ -25,6 +28,18 @@ type IFiberExTest struct {
 	t      *testing.T
 	Redis  *miniredis.Miniredis
 	Tester *apitest.APITest
+	query  int // 直前のリクエストで実行されたクエリ数
+	// 登録されたフィクスチャと読み込んだレコード
+	fixtures       *fixtureSet
+	fixtureRecords map[string]interface{}
+	// Subtestのデータベースの分離方法
+	Isolation ITestIsolation
+	// Subtestの接続とリクエストに付与する識別子
+	pool        gorm.ConnPool
+	isolationId string
+	// Subtestのリクエスト中に接続を経由せずに実行されたクエリ
+	unboundMutex sync.Mutex
+	unbound      []string
 }
 
 type ITestMethod int
@@ -53,6 +68,7 @@ type ITestRequest struct {
 	Path    string
 	Headers map[string]string
 	Body    interface{}
+	Signer  *IApiSigner // 指定された場合は署名ヘッダを付与する
 }
 
 func NewTest(t *testing.T, config IFiberExConfig) *IFiberExTest {
@@ -61,6 +77,7 @@ func NewTest(t *testing.T, config IFiberExConfig) *IFiberExTest {
 	var r *miniredis.Miniredis
 	if config.UseRedis {
 		r = miniredis.RunT(t)
+		Redis = nil // 前のテストのminiredisに接続したクライアントを破棄する
 		if config.RedisOptions == nil {
 			config.RedisOptions = &redis.Options{}
 		}
@@ -68,7 +85,39 @@ func NewTest(t *testing.T, config IFiberExConfig) *IFiberExTest {
 		config.JobAddr = r.Addr()
 
 	}
+	migrate := config.UseDB && config.MigrateConfig != nil && !config.MigrateConfig.AutoMigrate
 	ex := New(config)
+	if config.UseDB {
+		useTestConnPool(ex.DB)
+		if replicas := dbReplicas; replicas != nil {
+			t.Cleanup(replicas.close)
+		}
+	}
+	// テスト用のデータベースにマイグレーションを適用する
+	if migrate {
+		migrator, err := ex.NewMigrator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := migrator.Up(background); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ex.LocalCache != nil {
+		t.Cleanup(ex.LocalCache.Close)
+	}
+	if shipper := currentLogShipper(); shipper != nil {
+		t.Cleanup(func() {
+			if err := shipper.Close(shipper.config.Timeout); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	if config.UseRedis {
+		// ジョブはプロセスで共有されるため、次のテストのminiredisで開始できるように停止する
+		t.Cleanup(ex.JobStop)
+		t.Cleanup(ex.LogLevelStop)
+	}
 	app := ex.NewApp()
 	test := &IFiberExTest{
 		Ex:    ex,
@@ -76,27 +125,67 @@ func NewTest(t *testing.T, config IFiberExConfig) *IFiberExTest {
 		t:     t,
 		Redis: r,
 	}
-	// apitestを初期化
-	test.Tester = apitest.New().HandlerFunc(test.fiberToHandlerFunc())
+	app.Use(test.isolator(), test.queryCounter())
+	test.NewTester()
 	return test
 }
 
+// apitestを初期化
+// apitestはリクエストとassertを保持し続けるため、呼び出しごとに作り直す
+func (p *IFiberExTest) NewTester() *apitest.APITest {
+	p.Tester = apitest.New().HandlerFunc(p.fiberToHandlerFunc())
+	return p.Tester
+}
+
+// リクエストで実行されたクエリ数を保持する
+func (p *IFiberExTest) queryCounter() func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+		if queries, ok := c.Locals("queries").(*queryRecorder); ok {
+			test := p
+			if isolated, ok := c.Locals("test").(*IFiberExTest); ok {
+				test = isolated
+			}
+			test.query = queries.count()
+		}
+		return err
+	}
+}
+
+// 直前のリクエストのクエリ数がn以下であること
+// クエリはex.Context(c)を渡したDBの呼び出しのみ集計される
+func (p *IFiberExTest) AssertMaxQueries(n int) *ITestCase {
+	return &ITestCase{
+		Method: TestMethodLessThan,
+		Want:   n,
+		Store: func() interface{} {
+			return p.query
+		},
+	}
+}
+
 func (p *IFiberExTest) Routes(routes func(*fiber.App)) {
 	routes(p.App)
 }
 
+// トランザクション内でテストを実行し、終了後にロールバックする
+// p.Ex.DBをトランザクションに置き換えるため、同じtestのRunは並列に実行できない
+// 並列に実行する場合はSubtestを使用する
 func (p *IFiberExTest) Run(it string, tests func()) {
 	p.It(it)
+	db := p.Ex.DB
 	if p.Ex.Config.UseDB {
-		p.Ex.DB = p.Ex.DB.Begin() // トランザクション開始
-		p.Ex.DB.SavePoint(it)
+		p.Ex.DB = db.Begin() // トランザクション開始
+		// t.Fatal等で中断した場合もロールバックしてトランザクションを終了する
+		defer func() {
+			p.Ex.DB.Rollback()
+			p.Ex.DB = db
+			p.fixtureRecords = nil
+		}()
+		p.LoadFixtures()
 	}
 	// テスト実行
 	tests()
-	// ロールバック
-	if p.Ex.Config.UseDB {
-		p.Ex.DB = p.Ex.DB.RollbackTo(it) // dbをロールバックする
-	}
 	if p.Ex.Config.UseRedis {
 		p.Redis.FlushAll() // miniredisの中身をクリアする
 	}
@@ -120,7 +209,11 @@ func (p *IFiberExTest) It(message string) {
 
 func (p *IFiberExTest) Api(message string, request *ITestRequest, status int, asserts ...*ITestCase) {
 	p.It(message)
-	api := request.Call(p.Tester).Expect(p.t).Status(status)
+	call := request.Call(p.NewTester())
+	if p.isolationId != "" {
+		call = call.Header(TestIsolationHeader, p.isolationId)
+	}
+	api := call.Expect(p.t).Status(status)
 	for _, assert := range asserts {
 		api = api.Assert(assert.ApiAssert())
 	}
@@ -152,22 +245,48 @@ func (p *IFiberExTest) fiberToHandlerFunc() http.HandlerFunc {
 
 func (p ITestRequest) Call(test *apitest.APITest) *apitest.Request {
 	var app *apitest.Request
+	// apitestはURLのクエリを上書きするためQueryCollectionで渡す
+	path, rawQuery, _ := strings.Cut(p.Path, "?")
 	switch p.Method {
 	case "POST":
-		app = test.Post(p.Path)
+		app = test.Post(path)
 	case "PATCH":
-		app = test.Patch(p.Path)
+		app = test.Patch(path)
 	case "PUT":
-		app = test.Put(p.Path)
+		app = test.Put(path)
 	case "DELETE":
-		app = test.Delete(p.Path)
+		app = test.Delete(path)
 	default: // "GET"
-		app = test.Get(p.Path)
+		app = test.Get(path)
+	}
+	if rawQuery != "" {
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			panic(err)
+		}
+		app = app.QueryCollection(query)
 	}
 	app = app.Header("Content-Type", "application/json")
 	for key, value := range p.Headers {
 		app = app.Header(key, value)
 	}
+	if p.Signer != nil {
+		body := []byte{}
+		if p.Body != nil {
+			body = []byte(p.ToString())
+		}
+		method := p.Method
+		if method == "" {
+			method = "GET"
+		}
+		headers, err := p.Signer.Headers(method, p.Path, body)
+		if err != nil {
+			panic(err)
+		}
+		for key, value := range headers {
+			app = app.Header(key, value)
+		}
+	}
 	if p.Body != nil {
 		app = app.Body(p.ToString())
 	}
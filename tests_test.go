@@ -3,6 +3,7 @@ package gofiber_extend_test
 import (
 	"context"
 	"io"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -12,6 +13,23 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// sqliteのデータベースでテストを作成する
+// DBConfigのDialectと未指定のDBNameを補完し、終了時にext.DBを戻す
+func newSQLiteTest(t *testing.T, config ext.IFiberExConfig) *ext.IFiberExTest {
+	ext.DB = nil
+	// 並列のサブテストは親の関数の終了後に実行されるためCleanupで戻す
+	t.Cleanup(func() { ext.DB = nil })
+	config.UseDB = true
+	if config.DBConfig == nil {
+		config.DBConfig = &ext.IDBConfig{}
+	}
+	config.DBConfig.Dialect = ext.DialectSQLite
+	if config.DBConfig.DBName == "" {
+		config.DBConfig.DBName = filepath.Join(t.TempDir(), "test.db")
+	}
+	return ext.NewTest(t, config)
+}
+
 func TestIt(t *testing.T) {
 	test := ext.NewTest(t, ext.IFiberExConfig{})
 	test.It("test1")
@@ -0,0 +1,170 @@
+package gofiber_extend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// 依存先の種類
+const (
+	TimingDB    = "db"
+	TimingRedis = "redis"
+	TimingES    = "es"
+	TimingHTTP  = "http"
+)
+
+// 依存先毎の所要時間と呼び出し回数
+type ITiming struct {
+	Count   int    `json:"count"`
+	Elapsed string `json:"elapsed"`
+}
+
+// リクエスト中の依存先の所要時間を集計する
+type requestTimings struct {
+	mutex     sync.Mutex
+	names     []string // 記録順
+	counts    map[string]int
+	durations map[string]time.Duration
+}
+
+func newRequestTimings() *requestTimings {
+	return &requestTimings{counts: map[string]int{}, durations: map[string]time.Duration{}}
+}
+
+func (p *requestTimings) add(name string, elapsed time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.counts[name]; !ok {
+		p.names = append(p.names, name)
+	}
+	p.counts[name]++
+	p.durations[name] += elapsed
+}
+
+func (p *requestTimings) meta() map[string]*ITiming {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.names) == 0 {
+		return nil
+	}
+	rs := map[string]*ITiming{}
+	for _, name := range p.names {
+		rs[name] = &ITiming{Count: p.counts[name], Elapsed: p.durations[name].String()}
+	}
+	return rs
+}
+
+// Server-Timingヘッダの値 https://www.w3.org/TR/server-timing/
+func (p *requestTimings) header(total time.Duration) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	rs := []string{}
+	for _, name := range p.names {
+		rs = append(rs, fmt.Sprintf(`%s;dur=%.3f;desc="%d calls"`, name, milliseconds(p.durations[name]), p.counts[name]))
+	}
+	return strings.Join(append(rs, fmt.Sprintf("total;dur=%.3f", milliseconds(total))), ", ")
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func contextWithTimings(ctx context.Context, timings *requestTimings) context.Context {
+	return context.WithValue(ctx, contextKeyTimings, timings)
+}
+
+func timingsFromContext(ctx context.Context) *requestTimings {
+	if ctx != nil {
+		if timings, ok := ctx.Value(contextKeyTimings).(*requestTimings); ok {
+			return timings
+		}
+	}
+	return nil
+}
+
+// リクエストのcontextに依存先の所要時間を記録する
+// リクエスト外のcontextの場合は何もしない
+func AddTiming(ctx context.Context, name string, elapsed time.Duration) {
+	if timings := timingsFromContext(ctx); timings != nil {
+		timings.add(name, elapsed)
+	}
+}
+
+// gormのコールバックでクエリの所要時間を記録するプラグイン
+type timingPlugin struct{}
+
+const timingStartKey = "timing:start"
+
+func (p *timingPlugin) Name() string {
+	return "timing"
+}
+
+func (p *timingPlugin) Initialize(db *gorm.DB) error {
+	before := func(db *gorm.DB) {
+		db.InstanceSet(timingStartKey, time.Now())
+	}
+	after := func(db *gorm.DB) {
+		if start, ok := db.InstanceGet(timingStartKey); ok {
+			AddTiming(db.Statement.Context, TimingDB, time.Since(start.(time.Time)))
+		}
+	}
+	return registerAround(db, "timing", anyOperation(before), anyOperation(after))
+}
+
+// redisのコマンドの所要時間を記録するhook
+type timingRedisHook struct{}
+
+func (p *timingRedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (p *timingRedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		AddTiming(ctx, TimingRedis, time.Since(start))
+		return err
+	}
+}
+
+func (p *timingRedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		AddTiming(ctx, TimingRedis, time.Since(start))
+		return err
+	}
+}
+
+// 外部へのHTTPリクエストの所要時間を記録するTransport
+type timingTransport struct {
+	name string
+	next http.RoundTripper
+}
+
+func (p *timingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := p.next.RoundTrip(req)
+	AddTiming(req.Context(), p.name, time.Since(start))
+	return res, err
+}
+
+// 外部APIの呼び出しに使用するTransport
+// req.WithContext(ex.Context(c))のリクエストの所要時間がServer-Timingに含まれる
+func TimingTransport(next http.RoundTripper) http.RoundTripper {
+	return newTimingTransport(TimingHTTP, next)
+}
+
+func newTimingTransport(name string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &timingTransport{name: name, next: next}
+}
@@ -0,0 +1,63 @@
+package gofiber_extend_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestTiming(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+	defer upstream.Close()
+	client := &http.Client{Transport: ext.TimingTransport(nil)}
+
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		DevMode:      ext.Bool(true),
+		UseRedis:     true,
+		RedisOptions: &redis.Options{},
+	})
+	test.Routes(func(app *fiber.App) {
+		app.Get("/timing", func(c *fiber.Ctx) error {
+			ctx := test.Ex.Context(c)
+			for i := 0; i < 2; i++ {
+				if err := test.Ex.Redis.Get(ctx, "timing").Err(); err != nil && err != redis.Nil {
+					return test.Ex.ResultError(c, 500, err)
+				}
+			}
+			req, err := http.NewRequestWithContext(ctx, "GET", upstream.URL, nil)
+			if err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			res.Body.Close()
+			return test.Ex.Result(c, 200, map[string]interface{}{"ok": true})
+		})
+	})
+	test.Run("timing", func() {
+		test.Api("meta", &ext.ITestRequest{Method: "GET", Path: "/timing"}, 200, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Path: "$.meta.timings.redis.count", Want: float64(2)},
+			{Method: ext.TestMethodEqual, Path: "$.meta.timings.http.count", Want: float64(1)},
+			{Method: ext.TestMethodNotPresent, Path: "$.meta.timings.db"},
+			{
+				Method: ext.TestMethodMatches,
+				Want:   `^redis;dur=[0-9.]+;desc="2 calls", http;dur=[0-9.]+;desc="1 calls", total;dur=[0-9.]+$`,
+				Store: func() interface{} {
+					res, err := test.App.Test(httptest.NewRequest("GET", "/timing", nil))
+					if err != nil {
+						t.Fatal(err)
+					}
+					return res.Header.Get("Server-Timing")
+				},
+			},
+		}...)
+	})
+}
@@ -0,0 +1,321 @@
+package gofiber_extend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jrallison/go-workers"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	TracingExporterOtlp   = "otlp"   // OTLP/HTTP
+	TracingExporterStdout = "stdout" // 標準出力
+	TracingExporterFile   = "file"   // ファイル(JSON Lines)
+)
+
+type ITracingConfig struct {
+	Exporter    string  // otlp / stdout / file
+	Endpoint    string  // OTLPの送信先 host:port
+	Insecure    bool    // OTLPをhttpで送信する
+	FilePath    string  // fileの場合の出力先
+	SampleRatio float64 // サンプリング率 0〜1
+}
+
+var defaultTracingConfig *ITracingConfig = &ITracingConfig{
+	Exporter:    TracingExporterOtlp,
+	Endpoint:    "localhost:4318",
+	FilePath:    "trace.json",
+	SampleRatio: 1,
+}
+
+// トレーサーの名前
+const tracerName = "github.com/novarca-hnosaka/gofiber_extend"
+
+type ITracing struct {
+	Provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+	file     io.Closer
+}
+
+// 設定したexporterでTracerProviderを作成しotelのグローバルに登録する
+func NewTracing(config *ITracingConfig, appName string, nodeId string) (*ITracing, error) {
+	rs := &ITracing{}
+	var processor sdktrace.SpanProcessor
+	switch config.Exporter {
+	case TracingExporterOtlp:
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(background, options...)
+		if err != nil {
+			return nil, err
+		}
+		processor = sdktrace.NewBatchSpanProcessor(exporter)
+	case TracingExporterStdout:
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+		processor = sdktrace.NewSimpleSpanProcessor(exporter)
+	case TracingExporterFile:
+		file, err := os.OpenFile(config.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		rs.file = file
+		processor = sdktrace.NewSimpleSpanProcessor(exporter)
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter: %s", config.Exporter)
+	}
+
+	res := resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(appName),
+		semconv.ServiceInstanceID(nodeId),
+	)
+	rs.Provider = sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	rs.tracer = rs.Provider.Tracer(tracerName)
+	otel.SetTracerProvider(rs.Provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return rs, nil
+}
+
+// 未送信のspanを送信して終了する
+func (p *ITracing) Shutdown(ctx context.Context) error {
+	err := p.Provider.Shutdown(ctx)
+	if p.file != nil {
+		if e := p.file.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// fasthttpのヘッダをTextMapCarrierとして扱う
+type fiberCarrier struct {
+	c *fiber.Ctx
+}
+
+func (p fiberCarrier) Get(key string) string {
+	return p.c.Get(key)
+}
+
+func (p fiberCarrier) Set(key string, value string) {
+	p.c.Set(key, value)
+}
+
+func (p fiberCarrier) Keys() []string {
+	keys := []string{}
+	p.c.Request().Header.VisitAll(func(key []byte, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// traceparentを引き継いでリクエストのspanを開始する
+// spanはc.UserContext()に格納されるのでex.Context(c)でDBやRedisに引き継がれる
+func (p *ITracing) Middleware() func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), fiberCarrier{c: c})
+		ctx, span := p.tracer.Start(ctx, c.Method(), trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+		status := c.Response().StatusCode()
+		if err != nil {
+			if e, ok := err.(*fiber.Error); ok {
+				status = e.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+			span.RecordError(err)
+		}
+		span.SetName(c.Method() + " " + c.Route().Path)
+		span.SetAttributes(
+			semconv.HTTPMethod(c.Method()),
+			semconv.HTTPRoute(c.Route().Path),
+			semconv.HTTPStatusCode(status),
+			semconv.URLPath(c.Path()),
+		)
+		if requestid, ok := c.Locals("requestid").(string); ok {
+			span.SetAttributes(attribute.String("request.id", requestid))
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+		return err
+	}
+}
+
+// gormのコールバックでクエリのspanを作成するプラグイン
+type tracingPlugin struct {
+	tracing *ITracing
+}
+
+const tracingSpanKey = "tracing:span"
+
+func (p *tracingPlugin) Name() string {
+	return "tracing"
+}
+
+func (p *tracingPlugin) Initialize(db *gorm.DB) error {
+	before := func(operation string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			_, span := p.tracing.tracer.Start(db.Statement.Context, "db."+operation, trace.WithSpanKind(trace.SpanKindClient))
+			db.InstanceSet(tracingSpanKey, span)
+		}
+	}
+	after := func(db *gorm.DB) {
+		value, ok := db.InstanceGet(tracingSpanKey)
+		if !ok {
+			return
+		}
+		span := value.(trace.Span)
+		defer span.End()
+		span.SetAttributes(
+			semconv.DBSystemKey.String(db.Dialector.Name()),
+			semconv.DBSQLTable(db.Statement.Table),
+			semconv.DBStatement(db.Statement.SQL.String()),
+			attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+		)
+		if db.Error != nil && db.Error != gorm.ErrRecordNotFound {
+			span.RecordError(db.Error)
+			span.SetStatus(codes.Error, db.Error.Error())
+		}
+	}
+	return registerAround(db, "tracing", before, anyOperation(after))
+}
+
+func (p *ITracing) InstrumentDB(db *gorm.DB) error {
+	return db.Use(&tracingPlugin{tracing: p})
+}
+
+// redisのコマンドのspanを作成するhook
+type tracingRedisHook struct {
+	tracing *ITracing
+}
+
+func (p *tracingRedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (p *tracingRedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, span := p.tracing.tracer.Start(ctx, "redis."+cmd.Name(), trace.WithSpanKind(trace.SpanKindClient))
+		defer span.End()
+		span.SetAttributes(semconv.DBSystemRedis, semconv.DBOperation(cmd.Name()))
+		err := next(ctx, cmd)
+		if err != nil && err != redis.Nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	}
+}
+
+func (p *tracingRedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ctx, span := p.tracing.tracer.Start(ctx, "redis.pipeline", trace.WithSpanKind(trace.SpanKindClient))
+		defer span.End()
+		span.SetAttributes(semconv.DBSystemRedis, attribute.Int("db.redis.num_cmd", len(cmds)))
+		err := next(ctx, cmds)
+		if err != nil && err != redis.Nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	}
+}
+
+// NewRedisに渡す 使用中のクライアントに追加すると接続と競合する
+func (p *ITracing) RedisHook() redis.Hook {
+	return &tracingRedisHook{tracing: p}
+}
+
+// elasticsearchのリクエストのspanを作成しtraceparentを付与するTransport
+type tracingTransport struct {
+	tracing *ITracing
+	next    http.RoundTripper
+}
+
+func (p *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := p.tracing.tracer.Start(req.Context(), "es."+req.Method, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.SetAttributes(semconv.DBSystemElasticsearch, semconv.HTTPMethod(req.Method), semconv.URLPath(req.URL.Path))
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	res, err := p.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return res, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCode(res.StatusCode))
+	if res.StatusCode >= 500 {
+		span.SetStatus(codes.Error, "")
+	}
+	return res, err
+}
+
+func (p *ITracing) InstrumentTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &tracingTransport{tracing: p, next: next}
+}
+
+// 処理中のジョブのspanを持つcontext jid毎
+var jobContexts sync.Map
+
+// エンキュー時のtrace contextをジョブのメタ情報に格納する
+func injectJobTrace(ctx context.Context, meta map[string]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(meta))
+}
+
+// ジョブのメタ情報からtrace contextを復元してspanを開始する
+func startJobSpan(queue string, msg *workers.Msg) (context.Context, trace.Span) {
+	meta := propagation.MapCarrier{}
+	if values, err := msg.Get(jobMetaKey).Map(); err == nil {
+		for key, value := range values {
+			if s, ok := value.(string); ok {
+				meta[key] = s
+			}
+		}
+	}
+	ctx := otel.GetTextMapPropagator().Extract(background, meta)
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "job "+queue, trace.WithSpanKind(trace.SpanKindConsumer))
+	span.SetAttributes(
+		semconv.MessagingSystem("go-workers"),
+		semconv.MessagingDestinationName(queue),
+		semconv.MessagingMessageID(msg.Jid()),
+	)
+	return ctx, span
+}
@@ -0,0 +1,115 @@
+package gofiber_extend_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jrallison/go-workers"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestTracing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	test := ext.NewTest(t, ext.IFiberExConfig{
+		UseRedis:     true,
+		RedisOptions: &redis.Options{},
+		UseTracing:   true,
+		TracingConfig: &ext.ITracingConfig{
+			Exporter: ext.TracingExporterFile,
+			FilePath: path,
+		},
+	})
+	defer func() {
+		if err := ext.Tracing.Shutdown(context.TODO()); err != nil {
+			t.Error(err)
+		}
+		ext.Tracing = nil
+	}()
+	workers.Configure(map[string]string{
+		"server":  test.Redis.Addr(),
+		"process": "1",
+	})
+	test.Routes(func(app *fiber.App) {
+		app.Get("/users/:id", func(c *fiber.Ctx) error {
+			ctx := test.Ex.Context(c)
+			if err := test.Ex.Redis.Get(ctx, "user:"+c.Params("id")).Err(); err != nil && err != redis.Nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			if err := test.Ex.JobEnqueueContext(ctx, "test_trace", "test_class", nil); err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			return test.Ex.Result(c, 200, map[string]interface{}{"id": c.Params("id")})
+		})
+	})
+
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentId := "00f067aa0ba902b7"
+	spans := func() map[string]map[string]interface{} {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs := map[string]map[string]interface{}{}
+		decoder := json.NewDecoder(strings.NewReader(string(body)))
+		for decoder.More() {
+			span := map[string]interface{}{}
+			if err := decoder.Decode(&span); err != nil {
+				t.Fatal(err)
+			}
+			rs[span["Name"].(string)] = span
+		}
+		return rs
+	}
+	test.Run("trace", func() {
+		test.Api("traceparent", &ext.ITestRequest{
+			Method:  "GET",
+			Path:    "/users/1",
+			Headers: map[string]string{"traceparent": "00-" + traceId + "-" + parentId + "-01"},
+		}, 200, []*ext.ITestCase{
+			{
+				Method: ext.TestMethodEqual,
+				Want:   traceId + "/" + parentId,
+				Store: func() interface{} {
+					span := spans()["GET /users/:id"]
+					if span == nil {
+						return nil
+					}
+					parent := span["Parent"].(map[string]interface{})
+					return parent["TraceID"].(string) + "/" + parent["SpanID"].(string)
+				},
+			},
+			{
+				Method: ext.TestMethodEqual,
+				Want:   traceId,
+				Store: func() interface{} {
+					span := spans()["redis.get"]
+					if span == nil {
+						return nil
+					}
+					return span["SpanContext"].(map[string]interface{})["TraceID"]
+				},
+			},
+			{
+				Method: ext.TestMethodEqual,
+				Want:   true,
+				Store: func() interface{} {
+					jobs, err := test.Redis.List("queue:test_trace")
+					if err != nil || len(jobs) != 1 {
+						return err
+					}
+					msg, err := workers.NewMsg(jobs[0])
+					if err != nil {
+						return err
+					}
+					return strings.HasPrefix(msg.Get("meta").Get("traceparent").MustString(), "00-"+traceId+"-")
+				},
+			},
+		}...)
+	})
+}
@@ -0,0 +1,160 @@
+package gofiber_extend
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// リクエスト毎のトランザクション
+type requestTx struct {
+	tx          *gorm.DB
+	savepoint   string // DBが既にトランザクション中の場合(テスト等)はsavepointを使用する
+	afterCommit []func() error
+	done        bool // コミットまたはロールバック済み
+}
+
+func (p *requestTx) rollback() error {
+	if p.savepoint != "" {
+		return p.tx.RollbackTo(p.savepoint).Error
+	}
+	return p.tx.Rollback().Error
+}
+
+func (p *requestTx) commit() error {
+	if p.savepoint != "" {
+		return nil
+	}
+	return p.tx.Commit().Error
+}
+
+// コミット後に実行する処理を登録する TxMiddlewareのトランザクション外の場合はfalse
+func afterCommitContext(ctx context.Context, fn func() error) bool {
+	if ctx != nil {
+		if state, ok := ctx.Value(contextKeyTx).(*requestTx); ok && !state.done {
+			state.afterCommit = append(state.afterCommit, fn)
+			return true
+		}
+	}
+	return false
+}
+
+func txFromLocals(c *fiber.Ctx) *requestTx {
+	if state, ok := c.Locals("tx").(*requestTx); ok {
+		return state
+	}
+	return nil
+}
+
+// リクエスト毎にトランザクションを開始するミドルウェア
+// 2xxの場合はコミット、エラー/panic/4xx/5xxの場合はロールバックする
+// ルートグループ毎に使用でき、既にトランザクションがある場合はそれを使用する
+func (p *IFiberEx) TxMiddleware(opts ...*sql.TxOptions) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) (err error) {
+		if txFromLocals(c) != nil {
+			return c.Next()
+		}
+		state := &requestTx{}
+		c.SetUserContext(context.WithValue(c.UserContext(), contextKeyTx, state))
+		db := p.DB.WithContext(p.Context(c))
+		if _, ok := db.Statement.ConnPool.(gorm.TxCommitter); ok {
+			state.savepoint = fmt.Sprintf("sp%p", state)
+			state.tx = db.SavePoint(state.savepoint)
+		} else {
+			state.tx = db.Begin(opts...)
+		}
+		if state.tx.Error != nil {
+			return p.ResultError(c, 500, state.tx.Error)
+		}
+		c.Locals("tx", state)
+		defer func() {
+			if e := recover(); e != nil {
+				_ = state.rollback()
+				panic(e) // Recoverで通知する
+			}
+		}()
+		err = c.Next()
+		c.Locals("tx", nil)
+		state.done = true
+		if status := c.Response().StatusCode(); err != nil || status < 200 || status >= 300 {
+			if e := state.rollback(); e != nil {
+				ComponentLoggerFromContext(p.Context(c), LogComponentDB).Warn("db.rollback", zap.Error(e))
+			}
+			return err
+		}
+		if err := state.commit(); err != nil {
+			return p.ResultError(c, 500, err)
+		}
+		// コミット後の処理はレスポンスを変更しない
+		for _, fn := range state.afterCommit {
+			p.runAfterCommit(c, fn)
+		}
+		return nil
+	}
+}
+
+func (p *IFiberEx) runAfterCommit(c *fiber.Ctx, fn func() error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err, ok := e.(error)
+			if !ok {
+				err = fmt.Errorf("%v", e)
+			}
+			p.reportError(c, err, ErrorSourcePanic, panicFrames())
+		}
+	}()
+	if err := fn(); err != nil {
+		ComponentLoggerFromContext(p.Context(c), LogComponentDB).Error("db.after_commit", zap.Error(err))
+	}
+}
+
+// リクエストのトランザクション TxMiddlewareを使用していない場合はDB
+// ネストする場合はSavepointを使用する
+func (p *IFiberEx) Tx(c *fiber.Ctx) *gorm.DB {
+	if state := txFromLocals(c); state != nil {
+		return state.tx
+	}
+	return p.DB.WithContext(p.Context(c))
+}
+
+// savepointを作成してfnを実行する エラーの場合はsavepointまでロールバックする
+// ロールバックした場合はfn内で登録したAfterCommitも破棄する
+func (p *IFiberEx) Savepoint(c *fiber.Ctx, fn func(tx *gorm.DB) error) error {
+	state := txFromLocals(c)
+	if state == nil {
+		return p.Tx(c).Transaction(fn)
+	}
+	callbacks := len(state.afterCommit)
+	err := state.tx.Transaction(func(tx *gorm.DB) error {
+		parent := state.tx
+		state.tx = tx
+		defer func() { state.tx = parent }()
+		return fn(tx)
+	})
+	if err != nil {
+		state.afterCommit = state.afterCommit[:callbacks]
+	}
+	return err
+}
+
+// コミットに成功した後に実行する ロールバックした場合は実行しない
+// トランザクションがない場合はすぐに実行する
+func (p *IFiberEx) AfterCommit(c *fiber.Ctx, fn func() error) {
+	if state := txFromLocals(c); state != nil {
+		state.afterCommit = append(state.afterCommit, fn)
+		return
+	}
+	p.runAfterCommit(c, fn)
+}
+
+// コミット後にジョブを登録する
+func (p *IFiberEx) JobEnqueueAfterCommit(c *fiber.Ctx, queue string, class string, args interface{}) {
+	ctx := p.Context(c)
+	p.AfterCommit(c, func() error {
+		return p.JobEnqueueContext(ctx, queue, class, args)
+	})
+}
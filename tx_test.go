@@ -0,0 +1,106 @@
+package gofiber_extend_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	ext "github.com/novarca-hnosaka/gofiber_extend"
+	"gorm.io/gorm"
+)
+
+type txItem struct {
+	ID   uint
+	Name string
+}
+
+func TestTx(t *testing.T) {
+	test := newSQLiteTest(t, ext.IFiberExConfig{})
+	if err := test.Ex.DB.AutoMigrate(&txItem{}); err != nil {
+		t.Fatal(err)
+	}
+	committed := []string{}
+	test.Routes(func(app *fiber.App) {
+		items := app.Group("/items", test.Ex.TxMiddleware())
+		items.Post("/nested/:name", func(c *fiber.Ctx) error {
+			name := utils.CopyString(c.Params("name"))
+			if err := test.Ex.Tx(c).Create(&txItem{Name: name}).Error; err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			err := test.Ex.Savepoint(c, func(tx *gorm.DB) error {
+				if err := tx.Create(&txItem{Name: name + "_inner"}).Error; err != nil {
+					return err
+				}
+				test.Ex.AfterCommit(c, func() error {
+					committed = append(committed, name+"_inner")
+					return nil
+				})
+				return fmt.Errorf("rollback inner")
+			})
+			return test.Ex.Result(c, 200, err.Error())
+		})
+		items.Post("/:name/:fail?", test.Ex.TxMiddleware(), func(c *fiber.Ctx) error {
+			name := utils.CopyString(c.Params("name"))
+			if err := test.Ex.Tx(c).Create(&txItem{Name: name}).Error; err != nil {
+				return test.Ex.ResultError(c, 500, err)
+			}
+			test.Ex.AfterCommit(c, func() error {
+				committed = append(committed, name)
+				return nil
+			})
+			switch c.Params("fail") {
+			case "400":
+				return test.Ex.ResultError(c, 400, fmt.Errorf("bad request"))
+			case "500":
+				return test.Ex.ResultError(c, 500, fmt.Errorf("internal error"))
+			case "panic":
+				panic("panic")
+			}
+			return test.Ex.Result(c, 200, name)
+		})
+	})
+	names := func() interface{} {
+		rs := []string{}
+		if err := test.Ex.DB.Model(&txItem{}).Order("id").Pluck("name", &rs).Error; err != nil {
+			return err
+		}
+		return strings.Join(rs, ",")
+	}
+	callbacks := func() interface{} {
+		return strings.Join(committed, ",")
+	}
+
+	// test.Runの外では実際にトランザクションを開始する
+	test.Api("commit", &ext.ITestRequest{Method: "POST", Path: "/items/a"}, 200, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: "a", Store: names},
+		{Method: ext.TestMethodEqual, Want: "a", Store: callbacks},
+	}...)
+	test.Api("rollback_400", &ext.ITestRequest{Method: "POST", Path: "/items/b/400"}, 400, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: "a", Store: names},
+		{Method: ext.TestMethodEqual, Want: "a", Store: callbacks},
+	}...)
+	test.Api("rollback_panic", &ext.ITestRequest{Method: "POST", Path: "/items/c/panic"}, 500, &ext.ITestCase{
+		Method: ext.TestMethodEqual, Want: "a", Store: names,
+	})
+	test.Api("nested", &ext.ITestRequest{Method: "POST", Path: "/items/nested/d"}, 200, []*ext.ITestCase{
+		{Method: ext.TestMethodEqual, Want: "a,d", Store: names},
+		{Method: ext.TestMethodEqual, Want: "a", Store: callbacks},
+	}...)
+
+	// test.Runのトランザクション内ではsavepointを使用する
+	test.Run("in_test_transaction", func() {
+		test.Api("commit", &ext.ITestRequest{Method: "POST", Path: "/items/e"}, 200, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: "a,d,e", Store: names},
+			{Method: ext.TestMethodEqual, Want: "a,e", Store: callbacks},
+		}...)
+		test.Api("rollback_500", &ext.ITestRequest{Method: "POST", Path: "/items/f/500"}, 500, []*ext.ITestCase{
+			{Method: ext.TestMethodEqual, Want: "a,d,e", Store: names},
+			{Method: ext.TestMethodEqual, Want: "a,e", Store: callbacks},
+		}...)
+	})
+	test.Job("rollback_test_transaction", func() {}, func() {}, &ext.ITestCase{
+		Method: ext.TestMethodEqual, Want: "a,d", Store: names,
+	})
+}